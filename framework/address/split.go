@@ -21,6 +21,7 @@ package address
 import (
 	"errors"
 	"strings"
+	"unicode/utf8"
 )
 
 // Split splits a email address (as defined by RFC 5321 as a forward-path
@@ -53,6 +54,27 @@ func Split(addr string) (mailbox, domain string, err error) {
 	return
 }
 
+// Redact masks the local-part of the address for logging, leaving only its
+// first character and the domain, e.g. u***@example.org.
+//
+// Values that are not addresses are masked completely except for the first
+// character.
+func Redact(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	mbox, domain, err := Split(addr)
+	if err != nil || mbox == "" {
+		mbox = addr
+		domain = ""
+	}
+	first, _ := utf8.DecodeRuneInString(mbox)
+	if domain == "" {
+		return string(first) + "***"
+	}
+	return string(first) + "***@" + domain
+}
+
 // UnquoteMbox undoes escaping and quoting of the local-part.  That is, for
 // local-part `"test\" @ test"` it will return `test" @test`.
 func UnquoteMbox(mbox string) (string, error) {
@@ -60,6 +60,22 @@ func TestSplit(t *testing.T) {
 	test("postmaster", "postmaster", "", false)
 }
 
+func TestRedact(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"":                     "",
+		"user@example.org":     "u***@example.org",
+		"юзер@пример.рф":       "ю***@пример.рф",
+		"postmaster":           "p***",
+		"not-an-address":       "n***",
+		"@example.org":         "@***",
+		"a\"b@c\"@example.org": "a***@example.org",
+	} {
+		if actual := Redact(addr); actual != expected {
+			t.Errorf("%s: want %s, got %s", addr, expected, actual)
+		}
+	}
+}
+
 func TestUnquoteMbox(t *testing.T) {
 	test := func(inputMbox, expectedMbox string, fail bool) {
 		t.Helper()
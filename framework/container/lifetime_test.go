@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package container
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+type reloadMod struct {
+	name      string
+	reloadErr error
+	reloads   int
+}
+
+func (m *reloadMod) Name() string                          { return "test" }
+func (m *reloadMod) InstanceName() string                  { return m.name }
+func (m *reloadMod) Configure([]string, *config.Map) error { return nil }
+func (m *reloadMod) Start() error                          { return nil }
+func (m *reloadMod) Stop() error                           { return nil }
+func (m *reloadMod) Reload() error                         { m.reloads++; return m.reloadErr }
+
+func TestLifetimeTracker_ReloadAll(t *testing.T) {
+	lt := NewLifetime(log.DefaultLogger.Sublogger("lifetime"))
+	failing := &reloadMod{name: "failing", reloadErr: errors.New("failed")}
+	ok := &reloadMod{name: "ok"}
+	notStarted := &reloadMod{name: "not_started"}
+
+	lt.Add(failing)
+	lt.Add(ok)
+	if err := lt.StartAll(); err != nil {
+		t.Fatal(err)
+	}
+	lt.Add(notStarted)
+
+	if err := lt.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if failing.reloads != 1 || ok.reloads != 1 {
+		t.Errorf("started modules should be reloaded once: %d, %d", failing.reloads, ok.reloads)
+	}
+	if notStarted.reloads != 0 {
+		t.Error("module that is not started should not be reloaded")
+	}
+}
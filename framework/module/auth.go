@@ -18,7 +18,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package module
 
-import "errors"
+import (
+	"errors"
+	"net"
+)
 
 // ErrUnknownCredentials should be returned by auth. provider if supplied
 // credentials are valid for it but are not recognized (e.g. not found in
@@ -33,6 +36,26 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// AuthConnInfo contains information about the client connection
+// credentials are received over.
+type AuthConnInfo struct {
+	RemoteAddr net.Addr
+
+	// Whether the connection is protected using TLS.
+	Secure bool
+}
+
+// PlainConnAuth is an optional interface implemented by PlainAuth modules
+// that need information about the client connection.
+//
+// AuthPlainConn is called instead of AuthPlain if connection information is
+// available. Modules calling other PlainAuth modules (e.g. auth.plain_separate)
+// call AuthPlain and so do not pass the connection information down.
+type PlainConnAuth interface {
+	PlainAuth
+	AuthPlainConn(conn AuthConnInfo, username, password string) error
+}
+
 // PlainUserDB is a local credentials store that can be managed using maddy command
 // utility.
 type PlainUserDB interface {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,17 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	ModTime time.Time
+}
+
+// BlobLister is an optional interface that can be implemented by BlobStore
+// implementations that are able to enumerate stored blobs.
+//
+// It is used to find blobs that are not referenced by the storage anymore.
+type BlobLister interface {
+	ListBlobs(ctx context.Context) ([]BlobInfo, error)
+}
@@ -81,3 +81,18 @@ type ModifierState interface {
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// ModifierCommitHook is an optional interface that may be implemented by
+// the object returned by Modifier.ModStateForMsg if the modifier needs to
+// act only once the message is accepted.
+type ModifierCommitHook interface {
+	ModifierState
+
+	// OnCommit is called after the message is committed by all delivery
+	// targets and before Close. It is not called if the delivery is
+	// aborted or any of the targets fails to commit it.
+	//
+	// The message is already accepted at this point, so errors are only
+	// logged.
+	OnCommit(ctx context.Context) error
+}
@@ -25,6 +25,8 @@ import (
 	"io"
 	"net"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/future"
 )
@@ -36,6 +38,16 @@ type ConnState struct {
 	// over. If the message was generated locally, this field is empty.
 	Proto string
 
+	// Name of the endpoint module that accepted the connection (e.g. "smtp",
+	// "submission" or "lmtp"). Empty if the message was not received over
+	// the network.
+	Endpoint string
+
+	// Hostname the endpoint that accepted the connection uses to identify
+	// itself (A-label form). Endpoints configured for different addresses
+	// can use different hostnames.
+	EndpointHostname string
+
 	// Information about the SMTP connection, including HELO hostname and
 	// source IP. Valid only if Proto refers the SMTP protocol or its variant
 	// (e.g. LMTP).
@@ -94,6 +106,13 @@ type MsgMetadata struct {
 	// Note that addresses may contain unescaped Unicode characters.
 	OriginalFrom string
 
+	// OriginalFromHeader contains the value of the From header field as it
+	// was before it was changed by modifiers (e.g. modify.rewrite_from).
+	//
+	// It is set only by the first modifier that changes the field and is
+	// empty if the field was not changed.
+	OriginalFromHeader string
+
 	// If set - no SrcHostname and SrcAddr will be added to Received
 	// header. These fields are still written to the server log.
 	DontTraceSender bool
@@ -132,6 +151,27 @@ type MsgMetadata struct {
 	// It can be nil for locally generated messages.
 	Conn *ConnState
 
+	// AuthResults contains the results of message authentication checks
+	// (SPF, DKIM, DMARC) computed by the message pipeline.
+	//
+	// It is not preserved when the message is stored in the queue.
+	AuthResults []authres.Result
+
+	// OriginalHeader contains the message header as it was before
+	// modifiers were applied. It is set by the first message pipeline
+	// the message passes through and can be nil. The referenced value
+	// should not be modified.
+	//
+	// It is not preserved when the message is stored in the queue.
+	OriginalHeader *textproto.Header `json:"-"`
+
+	// TraceContext contains the W3C Trace Context fields (traceparent,
+	// tracestate) of the span the message was accepted in. It is used to
+	// continue the trace when the message is delivered from the queue.
+	//
+	// It can be nil.
+	TraceContext map[string]string `json:",omitempty"`
+
 	// This is set by endpoint/smtp to indicate that body contains "TLS-Required: No"
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
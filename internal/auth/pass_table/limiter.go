@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pass_table
+
+import (
+	"sync"
+	"time"
+)
+
+// failureLimiter tracks failed authentication attempts per username
+// using a sliding window.
+type failureLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	lck         sync.Mutex
+	failures    map[string][]time.Time
+	lastCleanup time.Time
+}
+
+func newFailureLimiter(max int, window time.Duration) *failureLimiter {
+	return &failureLimiter{
+		max:      max,
+		window:   window,
+		now:      time.Now,
+		failures: map[string][]time.Time{},
+	}
+}
+
+// recent returns the failures for the key that happened within the
+// window. l.lck should be held.
+func (l *failureLimiter) recent(key string, now time.Time) []time.Time {
+	list := l.failures[key]
+	i := 0
+	for i < len(list) && now.Sub(list[i]) >= l.window {
+		i++
+	}
+	if i == len(list) {
+		delete(l.failures, key)
+		return nil
+	}
+	list = list[i:]
+	l.failures[key] = list
+	return list
+}
+
+// Blocked checks whether the amount of failures within the window reached
+// the limit.
+func (l *failureLimiter) Blocked(key string) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	return len(l.recent(key, l.now())) >= l.max
+}
+
+// Failed records a failed attempt.
+func (l *failureLimiter) Failed(key string) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	now := l.now()
+	list := l.recent(key, now)
+	// Older entries are not needed to make the decision.
+	if len(list) >= l.max {
+		list = list[len(list)-l.max+1:]
+	}
+	l.failures[key] = append(list, now)
+
+	// Remove entries for keys that are not used anymore so the map does not
+	// grow unbounded.
+	if now.Sub(l.lastCleanup) >= l.window {
+		for k := range l.failures {
+			l.recent(k, now)
+		}
+		l.lastCleanup = now
+	}
+}
+
+// Succeeded resets the failures counter for the key.
+func (l *failureLimiter) Succeeded(key string) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	delete(l.failures, key)
+}
@@ -22,6 +22,8 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -37,12 +39,36 @@ type Auth struct {
 	instName string
 
 	table module.Table
+
+	minPasswordLen int
+
+	// Hash function and parameters used for new passwords.
+	hashAlgo string
+	hashOpts HashOpts
+
+	failures *failureLimiter
+
+	requireTLS bool
 }
 
+// Default parameters for new password hashes.
+const (
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 1024
+	defaultArgon2Threads = 1
+)
+
 func New(_ *container.C, modName, instName string) (module.Module, error) {
 	return &Auth{
 		modName:  modName,
 		instName: instName,
+		hashAlgo: DefaultHash,
+		hashOpts: HashOpts{
+			BcryptCost:    bcrypt.DefaultCost,
+			Argon2Time:    defaultArgon2Time,
+			Argon2Memory:  defaultArgon2Memory,
+			Argon2Threads: defaultArgon2Threads,
+		},
 	}, nil
 }
 
@@ -51,9 +77,80 @@ func (a *Auth) Configure(inlineArgs []string, cfg *config.Map) error {
 		return modconfig.ModuleFromNode("table", inlineArgs, cfg.Block, cfg.Globals, &a.table)
 	}
 
+	var (
+		bcryptCost    int
+		argon2Time    int
+		argon2Memory  int
+		argon2Threads int
+
+		maxAuthFailures   int
+		authFailureWindow time.Duration
+	)
+
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
-	_, err := cfg.Process()
-	return err
+	cfg.Int("min_password_length", false, false, 0, &a.minPasswordLen)
+	cfg.Enum("hash", false, false, []string{HashBcrypt, HashArgon2}, DefaultHash, &a.hashAlgo)
+	cfg.Int("bcrypt_cost", false, false, bcrypt.DefaultCost, &bcryptCost)
+	cfg.Int("argon2_time", false, false, defaultArgon2Time, &argon2Time)
+	cfg.Int("argon2_memory", false, false, defaultArgon2Memory, &argon2Memory)
+	cfg.Int("argon2_threads", false, false, defaultArgon2Threads, &argon2Threads)
+	cfg.Int("max_auth_failures", false, false, 0, &maxAuthFailures)
+	cfg.Duration("auth_failure_window", false, false, 5*time.Minute, &authFailureWindow)
+	cfg.Bool("require_tls_auth", false, false, &a.requireTLS)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	// Values below these are considered too weak, values above are
+	// not accepted by the hash functions.
+	if bcryptCost < 10 || bcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s: bcrypt_cost should be in range 10-%d", a.modName, bcrypt.MaxCost)
+	}
+	if argon2Time < 1 || argon2Time > 1024 {
+		return fmt.Errorf("%s: argon2_time should be in range 1-1024", a.modName)
+	}
+	if argon2Threads < 1 || argon2Threads > 255 {
+		return fmt.Errorf("%s: argon2_threads should be in range 1-255", a.modName)
+	}
+	// Argon2 requires at least 8 KiB per thread.
+	if argon2Memory < 8*argon2Threads || argon2Memory > 4*1024*1024 {
+		return fmt.Errorf("%s: argon2_memory should be in range %d-%d (KiB)", a.modName, 8*argon2Threads, 4*1024*1024)
+	}
+
+	if maxAuthFailures < 0 {
+		return fmt.Errorf("%s: max_auth_failures should not be negative", a.modName)
+	}
+	if maxAuthFailures != 0 {
+		if authFailureWindow <= 0 {
+			return fmt.Errorf("%s: auth_failure_window should be positive", a.modName)
+		}
+		a.failures = newFailureLimiter(maxAuthFailures, authFailureWindow)
+	}
+
+	a.hashOpts = HashOpts{
+		BcryptCost:    bcryptCost,
+		Argon2Time:    uint32(argon2Time),
+		Argon2Memory:  uint32(argon2Memory),
+		Argon2Threads: uint8(argon2Threads),
+	}
+	return nil
+}
+
+// DefaultHashOpts returns the hash function and parameters used for new
+// passwords.
+func (a *Auth) DefaultHashOpts() (string, HashOpts) {
+	return a.hashAlgo, a.hashOpts
+}
+
+// checkPassword verifies that the password can be set for the user.
+func (a *Auth) checkPassword(password string) error {
+	if password == "" {
+		return fmt.Errorf("%s: empty password is not allowed", a.modName)
+	}
+	if utf8.RuneCountInString(password) < a.minPasswordLen {
+		return fmt.Errorf("%s: password should be at least %d characters long", a.modName, a.minPasswordLen)
+	}
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -74,13 +171,35 @@ func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
+	if a.requireTLS {
+		// Can't check whether the connection is secure.
+		return fmt.Errorf("%s: auth plain %s: connection information is not available and require_tls_auth is set", a.modName, username)
+	}
+	return a.authPlain(username, password)
+}
+
+func (a *Auth) AuthPlainConn(conn module.AuthConnInfo, username, password string) error {
+	if a.requireTLS && !conn.Secure {
+		return fmt.Errorf("%s: auth plain %s: connection is not protected using TLS", a.modName, username)
+	}
+	return a.authPlain(username, password)
+}
+
+func (a *Auth) authPlain(username, password string) error {
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
 		return err
 	}
 
+	if a.failures != nil && a.failures.Blocked(key) {
+		return fmt.Errorf("%s: auth plain %s: too many failed attempts", a.modName, key)
+	}
+
 	hash, ok, err := a.table.Lookup(context.TODO(), key)
 	if !ok {
+		if err == nil {
+			a.authFailed(key)
+		}
 		return module.ErrUnknownCredentials
 	}
 	if err != nil {
@@ -95,7 +214,24 @@ func (a *Auth) AuthPlain(username, password string) error {
 	if hashVerify == nil {
 		return fmt.Errorf("%s: auth plain %s: unknown hash: %s", a.modName, key, parts[0])
 	}
-	return hashVerify(password, parts[1])
+	if err := hashVerify(password, parts[1]); err != nil {
+		a.authFailed(key)
+		return err
+	}
+
+	if a.failures != nil {
+		a.failures.Succeeded(key)
+	}
+	return nil
+}
+
+// authFailed records the failed attempt if max_auth_failures is used.
+// Table lookup errors are not counted so users are not locked out due to
+// backend failures.
+func (a *Auth) authFailed(key string) {
+	if a.failures != nil {
+		a.failures.Failed(key)
+	}
 }
 
 func (a *Auth) ListUsers() ([]string, error) {
@@ -112,9 +248,7 @@ func (a *Auth) ListUsers() ([]string, error) {
 }
 
 func (a *Auth) CreateUser(username, password string) error {
-	return a.CreateUserHash(username, password, HashBcrypt, HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	})
+	return a.CreateUserHash(username, password, a.hashAlgo, a.hashOpts)
 }
 
 func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts HashOpts) error {
@@ -126,6 +260,9 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 	if _, ok := HashCompute[hashAlgo]; !ok {
 		return fmt.Errorf("%s: unknown hash function: %v", a.modName, hashAlgo)
 	}
+	if err := a.checkPassword(password); err != nil {
+		return err
+	}
 
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
@@ -162,15 +299,16 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	if err := a.checkPassword(password); err != nil {
+		return err
+	}
+
+	hash, err := HashCompute[a.hashAlgo](a.hashOpts, password)
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, a.hashAlgo+":"+hash); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
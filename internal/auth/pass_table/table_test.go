@@ -19,11 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/container"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuth_AuthPlain(t *testing.T) {
@@ -63,3 +67,179 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func TestAuth_SetUserPassword(t *testing.T) {
+	a := &Auth{
+		modName:        "pass_table",
+		table:          mutableTable{testutils.Table{M: map[string]string{}}},
+		minPasswordLen: 8,
+		hashAlgo:       HashBcrypt,
+		hashOpts:       HashOpts{BcryptCost: bcrypt.MinCost},
+	}
+
+	if err := a.SetUserPassword("foxcpp", ""); err == nil {
+		t.Error("expected error for empty password")
+	}
+	if err := a.SetUserPassword("foxcpp", "short"); err == nil {
+		t.Error("expected error for short password")
+	}
+	if err := a.CreateUser("foxcpp", "short"); err == nil {
+		t.Error("expected error for short password in CreateUser")
+	}
+
+	if err := a.SetUserPassword("foxcpp", "long enough"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("foxcpp", "long enough"); err != nil {
+		t.Error("password was not changed:", err)
+	}
+}
+
+func TestAuth_HashOpts(t *testing.T) {
+	configure := func(children ...config.Node) (*Auth, error) {
+		t.Helper()
+
+		mod, err := New(container.New(), "pass_table", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, config.Node{Name: "table", Args: []string{"dummy"}})
+		err = mod.Configure(nil, config.NewMap(nil, config.Node{Children: children}))
+		return mod.(*Auth), err
+	}
+
+	a, err := configure(
+		config.Node{Name: "hash", Args: []string{"argon2"}},
+		config.Node{Name: "argon2_time", Args: []string{"1"}},
+		config.Node{Name: "argon2_memory", Args: []string{"64"}},
+		config.Node{Name: "argon2_threads", Args: []string{"2"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.table = tbl
+	if err := a.SetUserPassword("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["foxcpp"], "argon2:1:64:2:") {
+		t.Errorf("configured hash parameters are not used: %s", tbl.M["foxcpp"])
+	}
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Error(err)
+	}
+
+	for _, node := range []config.Node{
+		{Name: "bcrypt_cost", Args: []string{"4"}},
+		{Name: "bcrypt_cost", Args: []string{"32"}},
+		{Name: "argon2_time", Args: []string{"0"}},
+		{Name: "argon2_threads", Args: []string{"0"}},
+		{Name: "argon2_memory", Args: []string{"4"}},
+	} {
+		if _, err := configure(node); err == nil {
+			t.Errorf("expected an error for %s %v", node.Name, node.Args)
+		}
+	}
+}
+
+func TestAuth_MaxAuthFailures(t *testing.T) {
+	addSHA256()
+
+	now := time.Unix(0, 0)
+	a := &Auth{
+		modName: "pass_table",
+		table: testutils.Table{
+			M: map[string]string{
+				"foxcpp": "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
+			},
+		},
+		failures: newFailureLimiter(2, time.Minute),
+	}
+	a.failures.now = func() time.Time { return now }
+
+	if err := a.AuthPlain("foxcpp", "wrong"); err == nil {
+		t.Fatal("expected an error for wrong password")
+	}
+	// Successful authentication resets the counter.
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := a.AuthPlain("foxcpp", "wrong"); err == nil {
+			t.Fatal("expected an error for wrong password")
+		}
+	}
+	if err := a.AuthPlain("foxcpp", "password"); err == nil {
+		t.Fatal("correct password should be rejected after too many failures")
+	}
+
+	now = now.Add(time.Minute)
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal("failures should expire after the window:", err)
+	}
+
+	// Unknown users are limited too and entries are cleaned up eventually.
+	for i := 0; i < 3; i++ {
+		_ = a.AuthPlain("unknown", "password")
+	}
+	if !a.failures.Blocked("unknown") {
+		t.Error("unknown user is not blocked")
+	}
+	now = now.Add(2 * time.Minute)
+	a.failures.Failed("other")
+	if _, ok := a.failures.failures["unknown"]; ok {
+		t.Error("expired entries are not cleaned up")
+	}
+}
+
+func TestAuth_RequireTLSAuth(t *testing.T) {
+	addSHA256()
+
+	a := &Auth{
+		modName: "pass_table",
+		table: testutils.Table{
+			M: map[string]string{
+				"foxcpp": "sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=",
+			},
+		},
+		requireTLS: true,
+	}
+
+	if err := a.AuthPlainConn(module.AuthConnInfo{Secure: true}, "foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlainConn(module.AuthConnInfo{}, "foxcpp", "password"); err == nil {
+		t.Error("authentication over insecure connection should be rejected")
+	}
+	if err := a.AuthPlain("foxcpp", "password"); err == nil {
+		t.Error("authentication without connection information should be rejected")
+	}
+
+	a.requireTLS = false
+	if err := a.AuthPlainConn(module.AuthConnInfo{}, "foxcpp", "password"); err != nil {
+		t.Error(err)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
@@ -101,6 +100,13 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 }
 
 func (s *SASLAuth) AuthPlain(username, password string) error {
+	return s.AuthPlainConn(module.AuthConnInfo{}, username, password)
+}
+
+// AuthPlainConn is similar to AuthPlain but also passes the information
+// about the client connection to providers implementing
+// module.PlainConnAuth.
+func (s *SASLAuth) AuthPlainConn(conn module.AuthConnInfo, username, password string) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
@@ -116,7 +122,11 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 			"mapped_username", mappedUsername, "original_username", username,
 			"module", p)
 
-		lastErr = p.AuthPlain(mappedUsername, password)
+		if connAuth, ok := p.(module.PlainConnAuth); ok {
+			lastErr = connAuth.AuthPlainConn(conn, mappedUsername, password)
+		} else {
+			lastErr = p.AuthPlain(mappedUsername, password)
+		}
 		if lastErr == nil {
 			return nil
 		}
@@ -135,7 +145,7 @@ type ContextData struct {
 
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
 func (s *SASLAuth) CreateSASL(
-	mech string, remoteAddr net.Addr,
+	mech string, conn module.AuthConnInfo,
 	successCb func(identity string, data ContextData) error,
 ) sasl.Server {
 	switch mech {
@@ -151,9 +161,9 @@ func (s *SASLAuth) CreateSASL(
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlainConn(conn, username, password)
 			if err != nil {
-				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", conn.RemoteAddr)
 				if s.ErrorMap != nil {
 					return s.ErrorMap(ErrInvalidAuthCred)
 				}
@@ -179,9 +189,9 @@ func (s *SASLAuth) CreateSASL(
 				return err
 			}
 
-			err = s.AuthPlain(username, password)
+			err = s.AuthPlainConn(conn, username, password)
 			if err != nil {
-				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", conn.RemoteAddr)
 				if s.ErrorMap != nil {
 					return s.ErrorMap(ErrInvalidAuthCred)
 				}
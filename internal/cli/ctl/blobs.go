@@ -0,0 +1,96 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+// BlobGCStorage is implemented by module.Storage implementations that can
+// remove message blobs not referenced by the storage anymore.
+type BlobGCStorage interface {
+	FsstoreGC(dryRun bool) (removed int, err error)
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-blobs",
+			Usage: "IMAP storage message blobs management",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "gc",
+					Usage: "Remove orphaned message blobs",
+					Description: `Remove message blobs that are not referenced by the storage
+database anymore. Such blobs can be left in the message store after crashes.
+
+Blobs created less than an hour ago are never removed, so it is safe
+to run this command while the server is running.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:    "dry-run",
+							Aliases: []string{"n"},
+							Usage:   "Only report the amount of orphaned blobs, do not remove them",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapBlobsGC(be, ctx)
+					},
+				},
+			},
+		})
+}
+
+func imapBlobsGC(be module.Storage, ctx *cli.Context) error {
+	var target any = be
+	if ms, ok := be.(*managedStorage); ok {
+		target = ms.ManageableStorage
+	}
+	gcStore, ok := target.(BlobGCStorage)
+	if !ok {
+		return cli.Exit("Error: storage does not support blobs garbage collection", 2)
+	}
+
+	dryRun := ctx.Bool("dry-run")
+	removed, err := gcStore.FsstoreGC(dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Println(removed, "orphaned blobs found")
+	} else {
+		fmt.Println(removed, "orphaned blobs removed")
+	}
+	return nil
+}
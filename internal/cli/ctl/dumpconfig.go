@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+// ConfigDumper is implemented by module.Storage implementations that can
+// report their effective configuration.
+type ConfigDumper interface {
+	DumpConfig() map[string]interface{}
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-config",
+			Usage: "IMAP storage configuration inspection",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "dump",
+					Usage: "Print the effective storage configuration in JSON",
+					Description: `Print the configuration the storage module is using after
+defaults and inline arguments are applied.
+
+Passwords in database DSNs are redacted.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapConfigDump(be)
+					},
+				},
+			},
+		})
+}
+
+func imapConfigDump(be module.Storage) error {
+	var target any = be
+	if ms, ok := be.(*managedStorage); ok {
+		target = ms.ManageableStorage
+	}
+	dumper, ok := target.(ConfigDumper)
+	if !ok {
+		return cli.Exit("Error: storage does not support configuration dumping", 2)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dumper.DumpConfig())
+}
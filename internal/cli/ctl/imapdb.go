@@ -0,0 +1,141 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+// Optimizer is implemented by module.Storage implementations that can
+// compact the underlying database.
+type Optimizer interface {
+	Optimize() error
+}
+
+// IntegrityVerifier is implemented by module.Storage implementations that
+// can check stored messages against checksums.
+type IntegrityVerifier interface {
+	VerifyIntegrity(accountName string) ([]string, error)
+}
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-db",
+			Usage: "IMAP storage database maintenance",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "optimize",
+					Usage: "Compact the database and update query planner statistics",
+					Description: `Run VACUUM and PRAGMA optimize for SQLite, OPTIMIZE TABLE for
+MySQL or VACUUM ANALYZE for PostgreSQL.
+
+The database is locked while the command runs, deliveries and IMAP
+operations are delayed until it completes. Run it when there is little
+traffic.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapDBOptimize(be)
+					},
+				},
+				{
+					Name:      "verify",
+					Usage:     "Check stored messages of the account against checksums",
+					ArgsUsage: "USERNAME",
+					Description: `Read message bodies of the account and compare them with checksums
+stored when messages were delivered (store_checksums). Keys of objects
+that are missing or have a different checksum are printed.
+
+Messages stored without a checksum are not checked.`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapDBVerify(be, ctx)
+					},
+				},
+			},
+		})
+}
+
+func imapDBOptimize(be module.Storage) error {
+	var target any = be
+	if ms, ok := be.(*managedStorage); ok {
+		target = ms.ManageableStorage
+	}
+	optimizer, ok := target.(Optimizer)
+	if !ok {
+		return cli.Exit("Error: storage does not support database optimization", 2)
+	}
+	return optimizer.Optimize()
+}
+
+func imapDBVerify(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+
+	var target any = be
+	if ms, ok := be.(*managedStorage); ok {
+		target = ms.ManageableStorage
+	}
+	verifier, ok := target.(IntegrityVerifier)
+	if !ok {
+		return cli.Exit("Error: storage does not support integrity verification", 2)
+	}
+
+	corrupted, err := verifier.VerifyIntegrity(username)
+	if err != nil {
+		return err
+	}
+	for _, key := range corrupted {
+		fmt.Println(key)
+	}
+	if len(corrupted) != 0 {
+		return cli.Exit(fmt.Sprintf("Error: %d objects failed the check", len(corrupted)), 1)
+	}
+	return nil
+}
@@ -200,9 +200,16 @@ func usersCreate(be module.PlainUserDB, ctx *cli.Context) error {
 	}
 
 	if beHash, ok := be.(*pass_table.Auth); ok {
-		return beHash.CreateUserHash(username, pass, ctx.String("hash"), pass_table.HashOpts{
-			BcryptCost: ctx.Int("bcrypt-cost"),
-		})
+		// Use parameters from the module configuration unless
+		// overridden.
+		hashAlgo, opts := beHash.DefaultHashOpts()
+		if ctx.IsSet("hash") {
+			hashAlgo = ctx.String("hash")
+		}
+		if ctx.IsSet("bcrypt-cost") {
+			opts.BcryptCost = ctx.Int("bcrypt-cost")
+		}
+		return beHash.CreateUserHash(username, pass, hashAlgo, opts)
 	} else if ctx.IsSet("hash") || ctx.IsSet("bcrypt-cost") {
 		return cli.Exit("Error: --hash cannot be used with non-pass_table credentials DB", 2)
 	} else {
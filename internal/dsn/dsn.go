@@ -157,7 +157,7 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Diagnostic-Code", fmt.Sprintf("smtp; %d %d.%d.%d %s",
 			smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
 			strings.ReplaceAll(strings.ReplaceAll(smtpErr.Message, "\n", " "), "\r", " ")))
-	} else if utf8 {
+	} else if utf8 && info.DiagnosticCode != nil {
 		// It might contain Unicode, so don't include it if we are not allowed to.
 		// ... I didn't bother implementing mangling logic to remove Unicode
 		// characters.
@@ -200,7 +200,11 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	if allDelivered(rcptsInfo) {
+		reportHeader.Add("Subject", "Successful Mail Delivery Report")
+	} else {
+		reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	}
 
 	if err := writeHumanReadablePart(partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
@@ -208,15 +212,30 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
 	}
-	if err := writeHeader(utf8, partWriter, failedHeader); err != nil {
+	if err := writeHeader(utf8, partWriter, failedHeader, allDelivered(rcptsInfo)); err != nil {
 		return textproto.Header{}, err
 	}
 	return reportHeader, partWriter.Close()
 }
 
-func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
+// allDelivered reports whether the DSN is a delivery receipt rather than a
+// failure notification.
+func allDelivered(rcptsInfo []RecipientInfo) bool {
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action != ActionDelivered {
+			return false
+		}
+	}
+	return len(rcptsInfo) != 0
+}
+
+func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header, delivered bool) error {
 	partHeader := textproto.Header{}
-	partHeader.Add("Content-Description", "Undelivered message header")
+	if delivered {
+		partHeader.Add("Content-Description", "Delivered message header")
+	} else {
+		partHeader.Add("Content-Description", "Undelivered message header")
+	}
 	if utf8 {
 		partHeader.Add("Content-Type", "message/global-headers")
 	} else {
@@ -272,6 +291,19 @@ Last delivery attempt: {{.LastAttemptDate}}
 
 `))
 
+// deliveredText is the text of the human-readable part of DSN if all
+// recipients are delivered.
+var deliveredText = template.Must(template.New("dsn-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was successfully delivered to the recipients listed below.
+This report was requested by the message sender.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+
+`))
+
 func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
@@ -285,11 +317,21 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAIn
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
+	text := failedText
+	if allDelivered(rcptsInfo) {
+		text = deliveredText
+	}
+	if err := text.Execute(humanWriter, mtaInfo); err != nil {
 		return err
 	}
 
 	for _, rcpt := range rcptsInfo {
+		if rcpt.Action == ActionDelivered {
+			if _, err := fmt.Fprintf(humanWriter, "Delivery to %s succeeded.\n", rcpt.FinalRecipient); err != nil {
+				return err
+			}
+			continue
+		}
 		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
 			return err
 		}
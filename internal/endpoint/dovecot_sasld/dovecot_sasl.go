@@ -31,6 +31,7 @@ import (
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/container"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/framework/module/modules"
 	"github.com/foxcpp/maddy/framework/resource/netresource"
 	"github.com/foxcpp/maddy/internal/auth"
@@ -92,7 +93,8 @@ func (endp *Endpoint) Configure(_ []string, cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string, _ auth.ContextData) error { return nil })
+			connInfo := module.AuthConnInfo{RemoteAddr: remoteAddr, Secure: req.Secured}
+			return endp.saslAuth.CreateSASL(mech, connInfo, func(_ string, _ auth.ContextData) error { return nil })
 		})
 	}
 
@@ -40,6 +40,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -89,6 +90,7 @@ type Session struct {
 	msgLock     sync.Mutex
 	msgCtx      context.Context
 	msgTask     *trace.Task
+	msgSpan     tracing.Span
 	mailFrom    string
 	opts        smtp.MailOptions
 	msgMeta     *module.MsgMetadata
@@ -103,13 +105,20 @@ func (s *Session) AuthMechanisms() []string {
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(identity string, data auth.ContextData) error {
+	return s.endp.saslAuth.CreateSASL(mech, s.authConnInfo(), func(identity string, data auth.ContextData) error {
 		s.connState.AuthUser = identity
 		s.connState.AuthPassword = data.Password
 		return nil
 	}), nil
 }
 
+func (s *Session) authConnInfo() module.AuthConnInfo {
+	return module.AuthConnInfo{
+		RemoteAddr: s.connState.RemoteAddr,
+		Secure:     s.connState.TLS.HandshakeComplete,
+	}
+}
+
 func (s *Session) Reset() {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
@@ -137,16 +146,22 @@ func (s *Session) releaseLimits() {
 	s.endp.limits.ReleaseMsg(addr.IP, domain)
 }
 
+// errAborted is recorded in the message span if the transaction is aborted
+// before the message is accepted.
+var errAborted = errors.New("smtp: transaction aborted")
+
 func (s *Session) abort(ctx context.Context) {
 	if err := s.delivery.Abort(ctx); err != nil {
 		s.endp.log.Error("delivery abort failed", err)
 	}
 	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
 	abortedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
-	s.cleanSession()
+	s.cleanSession(errAborted)
 }
 
-func (s *Session) cleanSession() {
+// cleanSession ends the message transaction. err is the error that ended
+// it, nil if the message was accepted.
+func (s *Session) cleanSession(err error) {
 	s.releaseLimits()
 
 	s.mailFrom = ""
@@ -156,6 +171,7 @@ func (s *Session) cleanSession() {
 	s.deliveryErr = nil
 	s.msgCtx = nil
 	s.msgTask.End()
+	s.msgSpan.End(err)
 }
 
 func (s *Session) AuthPlain(username, password string) error {
@@ -165,7 +181,7 @@ func (s *Session) AuthPlain(username, password string) error {
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.AuthPlainConn(s.authConnInfo(), username, password)
 	if err != nil {
 		s.endp.log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
@@ -253,6 +269,9 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	}
 
 	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
+	s.msgCtx, s.msgSpan = tracing.StartSpan(s.msgCtx, msgMeta, "smtp.Message")
+	s.msgSpan.SetAttr("maddy.endpoint", s.endp.name)
+	tracing.Inject(s.msgCtx, msgMeta)
 
 	mailCtx, mailTask := trace.NewTask(s.msgCtx, "MAIL FROM")
 	defer mailTask.End()
@@ -261,6 +280,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
+		s.msgSpan.End(err)
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
 		return msgMeta.ID, err
 	}
@@ -448,7 +468,7 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 	return header, buf, nil
 }
 
-func (s *Session) Data(r io.Reader) error {
+func (s *Session) Data(r io.Reader) (retErr error) {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -470,7 +490,7 @@ func (s *Session) Data(r io.Reader) error {
 		}
 
 		// go-smtp will call Reset, but it will call Abort if delivery is non-nil.
-		s.cleanSession()
+		s.cleanSession(retErr)
 	}()
 
 	if err := s.checkRoutingLoops(header); err != nil {
@@ -503,7 +523,7 @@ func (sw statusWrapper) SetStatus(rcpt string, err error) {
 	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
 }
 
-func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
+func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) (retErr error) {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -525,7 +545,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		}
 
 		// go-smtp will call Reset, but it will call Abort if delivery is non-nil.
-		s.cleanSession()
+		s.cleanSession(retErr)
 	}()
 
 	if strings.EqualFold(header.Get("TLS-Required"), "No") {
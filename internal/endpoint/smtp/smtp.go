@@ -411,9 +411,11 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 	}
 
 	s.connState = module.ConnState{
-		Hostname:   conn.Hostname(),
-		LocalAddr:  conn.Conn().LocalAddr(),
-		RemoteAddr: conn.Conn().RemoteAddr(),
+		Endpoint:         endp.name,
+		EndpointHostname: endp.serv.Domain,
+		Hostname:         conn.Hostname(),
+		LocalAddr:        conn.Conn().LocalAddr(),
+		RemoteAddr:       conn.Conn().RemoteAddr(),
 	}
 	if tlsState, ok := conn.TLSConnectionState(); ok {
 		s.connState.TLS = tlsState
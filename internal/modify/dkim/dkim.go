@@ -24,9 +24,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/mail"
 	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -40,7 +43,9 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/framework/module/modules"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
 	"golang.org/x/net/idna"
 )
 
@@ -90,6 +95,17 @@ var (
 		"Resent-Cc",
 	}
 
+	// resentFields are signed before other fields if use_resent is enabled
+	// and the message contains Resent-From field.
+	resentFields = []string{
+		"Resent-From",
+		"Resent-Sender",
+		"Resent-Date",
+		"Resent-To",
+		"Resent-Cc",
+		"Resent-Message-Id",
+	}
+
 	hashFuncs = map[string]crypto.Hash{
 		"sha256": crypto.SHA256,
 	}
@@ -100,6 +116,7 @@ type Modifier struct {
 
 	domains        []string
 	selector       string
+	signersLck     sync.RWMutex
 	signers        map[string]crypto.Signer
 	oversignHeader []string
 	signHeader     []string
@@ -107,8 +124,72 @@ type Modifier struct {
 	bodyCanon      dkim.Canonicalization
 	sigExpiry      time.Duration
 	hash           crypto.Hash
+	queryMethod    dkim.QueryMethod
 	multipleFromOk bool
 	signSubdomains bool
+	stripExisting  bool
+	minSize        int64
+	maxSize        int64
+
+	maxHeaderOccurrences int
+
+	// bodyCanonByType maps lower-case media types (or "type/*" patterns)
+	// to body canonicalization to use. Key "default" is used for
+	// types not listed explicitly.
+	bodyCanonByType map[string]dkim.Canonicalization
+
+	defaultIdentityLocal  string
+	defaultIdentityDomain string
+
+	enforceAuthDomain bool
+
+	// requireSignature is set if messages that can't be signed due to
+	// a missing key should be rejected. It applies only in multi-domain
+	// mode, see multiDomain.
+	requireSignature bool
+
+	useResent bool
+
+	// domainPolicy maps normalized signing domains to whether messages
+	// should be signed. Key "default" is used for domains not listed
+	// explicitly.
+	domainPolicy map[string]bool
+
+	// rcptHashField is the name of the header field with the hash of
+	// the recipients list to add and sign. Empty if disabled.
+	rcptHashField string
+
+	// redactPII is set if local-parts of addresses should be masked in
+	// log messages.
+	redactPII bool
+
+	// onlyEndpoints lists endpoints messages from which should be
+	// signed. If empty, all messages are signed.
+	onlyEndpoints []string
+
+	// signSem limits the number of concurrent signing operations. The
+	// zero value does not limit it.
+	signSem limiters.Semaphore
+
+	// headerPlacement is either "top" or "bottom".
+	headerPlacement string
+
+	// selfTest is set if keys should be checked by signing and verifying
+	// a sample message when they are loaded.
+	selfTest bool
+
+	// Set if key_source pkcs11 is used.
+	pkcs11 *pkcs11Config
+
+	keyPathTemplate string
+	newKeyAlgo      string
+	keyFlags        []string
+
+	// keyDir is the directory to discover keys in. If it is set, selectors
+	// maps each normalized domain to the selector of its key and the
+	// signing domain is taken from the From header field.
+	keyDir    string
+	selectors map[string]string
 
 	log *log.Logger
 }
@@ -123,6 +204,8 @@ func New(c *container.C, modName, instName string) (module.Module, error) {
 	return m, nil
 }
 
+var _ container.ReloadModule = &Modifier{}
+
 func (m *Modifier) Name() string {
 	return "modify.dkim"
 }
@@ -145,12 +228,16 @@ func (m *Modifier) Configure(inlineArgs []string, cfg *config.Map) error {
 		hashName        string
 		keyPathTemplate string
 		newKeyAlgo      string
+		defaultIdentity string
+		maxSignings     int
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Bool("redact_pii", false, true, &m.redactPII)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
 	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.String("key_dir", false, false, "", &m.keyDir)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
 	cfg.Enum("header_canon", false, false,
@@ -159,26 +246,77 @@ func (m *Modifier) Configure(inlineArgs []string, cfg *config.Map) error {
 	cfg.Enum("body_canon", false, false,
 		[]string{string(dkim.CanonicalizationRelaxed), string(dkim.CanonicalizationSimple)},
 		dkim.CanonicalizationRelaxed, (*string)(&m.bodyCanon))
+	cfg.Custom("canon_by_type", false, false, nil, parseCanonByType, &m.bodyCanonByType)
 	cfg.Duration("sig_expiry", false, false, 5*Day, &m.sigExpiry)
 	cfg.Enum("hash", false, false,
 		[]string{"sha256"}, "sha256", &hashName)
+	cfg.Enum("query_method", false, false,
+		[]string{string(dkim.QueryMethodDNSTXT)}, string(dkim.QueryMethodDNSTXT), (*string)(&m.queryMethod))
 	cfg.Enum("newkey_algo", false, false,
 		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.StringList("key_flags", false, false, nil, &m.keyFlags)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Bool("strip_existing", false, false, &m.stripExisting)
+	cfg.DataSize("min_size", false, false, 0, &m.minSize)
+	cfg.DataSize("max_size", false, false, 0, &m.maxSize)
+	cfg.Int("max_header_occurrences", false, false, 0, &m.maxHeaderOccurrences)
+	cfg.String("default_identity", false, false, "", &defaultIdentity)
+	cfg.Bool("enforce_auth_domain", false, false, &m.enforceAuthDomain)
+	cfg.Bool("require_signature", false, false, &m.requireSignature)
+	cfg.Bool("use_resent", false, false, &m.useResent)
+	cfg.String("recipient_hash_field", false, false, "", &m.rcptHashField)
+	cfg.StringList("only_endpoints", false, false, nil, &m.onlyEndpoints)
+	cfg.Custom("domain_policy", false, false, nil, parseDomainPolicy, &m.domainPolicy)
+	cfg.Custom("key_source", false, false, func() (interface{}, error) {
+		return (*pkcs11Config)(nil), nil
+	}, parseKeySource, &m.pkcs11)
+	cfg.Enum("header_placement", false, false,
+		[]string{"top", "bottom"}, "top", &m.headerPlacement)
+	cfg.Bool("selftest", false, false, &m.selfTest)
+	cfg.Int("max_concurrent_signings", false, false, 0, &maxSignings)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if len(m.domains) == 0 {
-		return errors.New("sign_domain: at least one domain is needed")
-	}
-	if m.selector == "" {
-		return errors.New("sign_domain: selector is not specified")
+	if m.keyDir != "" {
+		if len(m.domains) != 0 {
+			return errors.New("modify.dkim: domains can't be used together with key_dir")
+		}
+		if m.signSubdomains {
+			return errors.New("modify.dkim: sign_subdomains can't be used together with key_dir")
+		}
+		if m.pkcs11 != nil {
+			return errors.New("modify.dkim: key_source pkcs11 can't be used together with key_dir")
+		}
+	} else {
+		if len(m.domains) == 0 {
+			return errors.New("modify.dkim: at least one domain is needed")
+		}
+		if m.selector == "" {
+			return errors.New("modify.dkim: selector is not specified")
+		}
 	}
 	if m.signSubdomains && len(m.domains) > 1 {
-		return errors.New("sign_domain: only one domain is supported when sign_subdomains is enabled")
+		return errors.New("modify.dkim: only one domain is supported when sign_subdomains is enabled")
+	}
+	if m.maxSize != 0 && m.minSize > m.maxSize {
+		return errors.New("modify.dkim: min_size is bigger than max_size")
+	}
+
+	if m.maxHeaderOccurrences < 0 {
+		return errors.New("modify.dkim: max_header_occurrences should not be negative")
+	}
+	if maxSignings < 0 {
+		return errors.New("modify.dkim: max_concurrent_signings should not be negative")
+	}
+	m.signSem = limiters.NewSemaphore(maxSignings)
+
+	if defaultIdentity != "" {
+		if err := m.setDefaultIdentity(defaultIdentity); err != nil {
+			return err
+		}
 	}
 
 	m.hash = hashFuncs[hashName]
@@ -186,17 +324,242 @@ func (m *Modifier) Configure(inlineArgs []string, cfg *config.Map) error {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
+	for _, flag := range m.keyFlags {
+		// RFC 6376, Section 3.6.1.
+		if flag != "y" && flag != "s" {
+			return fmt.Errorf("modify.dkim: unknown key flag: %s", flag)
+		}
+	}
+
+	if m.rcptHashField != "" {
+		if err := checkFieldName(m.rcptHashField); err != nil {
+			return fmt.Errorf("modify.dkim: recipient_hash_field: %w", err)
+		}
+	}
+
+	m.keyPathTemplate = keyPathTemplate
+	m.newKeyAlgo = newKeyAlgo
+
 	for _, domain := range m.domains {
 		if _, err := idna.ToASCII(domain); err != nil {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
+	}
+
+	signers, selectors, err := m.loadKeys()
+	if err != nil {
+		m.pkcs11.close()
+		return err
+	}
+	if m.selfTest {
+		if err := m.checkKeys(signers, selectors); err != nil {
+			m.pkcs11.close()
+			return err
+		}
+	}
+	m.signers = signers
+	m.selectors = selectors
+
+	return nil
+}
+
+func (m *Modifier) Start() error {
+	return nil
+}
+
+// Stop releases the PKCS#11 token session if key_source pkcs11 is used.
+func (m *Modifier) Stop() error {
+	return m.pkcs11.close()
+}
+
+func parseCanonByType(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+	if len(node.Children) == 0 {
+		return nil, config.NodeErr(node, "at least one media type is required")
+	}
+
+	res := make(map[string]dkim.Canonicalization, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one argument required")
+		}
+		canon := dkim.Canonicalization(child.Args[0])
+		if canon != dkim.CanonicalizationRelaxed && canon != dkim.CanonicalizationSimple {
+			return nil, config.NodeErr(child, "unknown canonicalization: %s", child.Args[0])
+		}
+
+		typ := strings.ToLower(child.Name)
+		if typ != "default" && !strings.Contains(typ, "/") {
+			return nil, config.NodeErr(child, "malformed media type: %s", child.Name)
+		}
+		if _, ok := res[typ]; ok {
+			return nil, config.NodeErr(child, "duplicate media type: %s", child.Name)
+		}
+		res[typ] = canon
+	}
+	return res, nil
+}
+
+func parseDomainPolicy(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "unexpected arguments")
+	}
+	if len(node.Children) == 0 {
+		return nil, config.NodeErr(node, "at least one domain is required")
+	}
+
+	res := make(map[string]bool, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one argument required")
+		}
+		var sign bool
+		switch child.Args[0] {
+		case "sign":
+			sign = true
+		case "skip":
+		default:
+			return nil, config.NodeErr(child, "unknown policy: %s, should be sign or skip", child.Args[0])
+		}
+
+		domain := "default"
+		if child.Name != "default" {
+			var err error
+			domain, err = dns.ForLookup(child.Name)
+			if err != nil {
+				return nil, config.NodeErr(child, "malformed domain: %v", err)
+			}
+		}
+		if _, ok := res[domain]; ok {
+			return nil, config.NodeErr(child, "duplicate domain: %s", child.Name)
+		}
+		res[domain] = sign
+	}
+	return res, nil
+}
+
+// policyAllows checks whether domain_policy allows signing messages using
+// the key for the specified normalized domain.
+func (m *Modifier) policyAllows(normDomain string) bool {
+	if m.domainPolicy == nil {
+		return true
+	}
+	if sign, ok := m.domainPolicy[normDomain]; ok {
+		return sign
+	}
+	if sign, ok := m.domainPolicy["default"]; ok {
+		return sign
+	}
+	return true
+}
+
+// bodyCanonFor returns the body canonicalization to use for the message with
+// the specified header.
+func (m *Modifier) bodyCanonFor(h *textproto.Header) dkim.Canonicalization {
+	if m.bodyCanonByType == nil {
+		return m.bodyCanon
+	}
+
+	// RFC 2045, Section 5.2: Default is text/plain.
+	typ := "text/plain"
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		typ, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			typ = ""
+		}
+	}
+
+	if typ != "" {
+		if canon, ok := m.bodyCanonByType[typ]; ok {
+			return canon
+		}
+		if slash := strings.IndexByte(typ, '/'); slash != -1 {
+			if canon, ok := m.bodyCanonByType[typ[:slash]+"/*"]; ok {
+				return canon
+			}
+		}
+	}
+	if canon, ok := m.bodyCanonByType["default"]; ok {
+		return canon
+	}
+	return m.bodyCanon
+}
+
+// setDefaultIdentity parses the default_identity value. It can be either
+// a domain or an address.
+func (m *Modifier) setDefaultIdentity(identity string) error {
+	local, domain := "", identity
+	if strings.Contains(identity, "@") {
+		var err error
+		local, domain, err = address.Split(identity)
+		if err != nil {
+			return fmt.Errorf("modify.dkim: malformed default_identity: %w", err)
+		}
+	}
+	if domain == "" {
+		return errors.New("modify.dkim: default_identity should contain a domain")
+	}
+	if strings.ContainsAny(local, "; \t=") {
+		return errors.New("modify.dkim: default_identity local-part can't be used in a signature")
+	}
+
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return fmt.Errorf("modify.dkim: malformed default_identity: %w", err)
+	}
+	for _, d := range m.domains {
+		normD, err := dns.ForLookup(d)
+		if err != nil {
+			continue
+		}
+		if normD == normDomain {
+			m.defaultIdentityLocal = local
+			m.defaultIdentityDomain = domain
+			return nil
+		}
+	}
+	return fmt.Errorf("modify.dkim: default_identity domain %s is not in the domains list", domain)
+}
 
+// loadKeys reads (or generates) keys for all configured domains.
+//
+// If key_dir is used, keys are discovered in it instead and the selector
+// for each domain is returned too.
+func (m *Modifier) loadKeys() (map[string]crypto.Signer, map[string]string, error) {
+	if m.keyDir != "" {
+		return m.discoverKeys()
+	}
+
+	signers := make(map[string]crypto.Signer, len(m.domains))
+	for _, domain := range m.domains {
 		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return nil, nil, fmt.Errorf("modify.dkim: unable to normalize domain %s: %w", domain, err)
+		}
+
+		if m.pkcs11 != nil {
+			signer, err := m.pkcs11.loadHSMKey(keyValues.Replace(m.pkcs11.keyLabel))
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := checkKeyType(signer); err != nil {
+				return nil, nil, fmt.Errorf("modify.dkim: pkcs11: %s: %w", domain, err)
+			}
+			signers[normDomain] = signer
+			continue
+		}
 
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		keyPath := keyValues.Replace(m.keyPathTemplate)
+		signer, newKey, err := m.loadOrGenerateKey(keyPath, m.newKeyAlgo)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		if err := checkKeyType(signer); err != nil {
+			return nil, nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 
 		if newKey {
@@ -206,25 +569,76 @@ func (m *Modifier) Configure(inlineArgs []string, cfg *config.Map) error {
 			}
 			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
 				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
+				m.newKeyAlgo, keyPath, dnsPath, m.selector, domain)
 		}
+		signers[normDomain] = signer
+	}
+	return signers, nil, nil
+}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+// Reload rereads keys from disk and replaces ones used for signing.
+//
+// Messages that are being signed at the time of the call continue using
+// old keys. If selftest is enabled and new keys fail it, old keys are kept.
+func (m *Modifier) Reload() error {
+	signers, selectors, err := m.loadKeys()
+	if err != nil {
+		return err
+	}
+	if m.selfTest {
+		if err := m.checkKeys(signers, selectors); err != nil {
+			return err
 		}
-		m.signers[normDomain] = signer
 	}
 
+	m.signersLck.Lock()
+	defer m.signersLck.Unlock()
+	m.signers = signers
+	m.selectors = selectors
 	return nil
 }
 
-func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
+// signer returns the key and the selector to use for the domain.
+// multiDomain reports whether the signing domain is selected from the
+// message, i.e. keys are discovered in key_dir or there are several domains
+// configured.
+func (m *Modifier) multiDomain() bool {
+	return m.keyDir != "" || len(m.domains) > 1
+}
+
+func (m *Modifier) signer(normDomain string) (crypto.Signer, string) {
+	m.signersLck.RLock()
+	defer m.signersLck.RUnlock()
+	if m.selectors != nil {
+		return m.signers[normDomain], m.selectors[normDomain]
+	}
+	return m.signers[normDomain], m.selector
+}
+
+func (m *Modifier) fieldsToSign(h *textproto.Header, resent bool) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
 	seen := make(map[string]struct{})
 
-	res := make([]string, 0, len(m.oversignHeader)+len(m.signHeader))
+	res := make([]string, 0, len(resentFields)+len(m.oversignHeader)+len(m.signHeader)+2)
+	if m.rcptHashField != "" {
+		// Oversigned so another field can't be added later.
+		seen[strings.ToLower(m.rcptHashField)] = struct{}{}
+		if h.Has(m.rcptHashField) {
+			res = append(res, m.rcptHashField)
+		}
+		res = append(res, m.rcptHashField)
+	}
+	if resent {
+		// Resent-* fields are not oversigned so further resending
+		// does not break the signature.
+		for _, key := range resentFields {
+			seen[strings.ToLower(key)] = struct{}{}
+			for field, n := h.FieldsByKey(key), 0; field.Next() && !m.occurrencesExceeded(n); n++ {
+				res = append(res, key)
+			}
+		}
+	}
 	for _, key := range m.oversignHeader {
 		if _, ok := seen[strings.ToLower(key)]; ok {
 			continue
@@ -232,7 +646,7 @@ func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 		seen[strings.ToLower(key)] = struct{}{}
 
 		// Add to signing list once per each key use.
-		for field := h.FieldsByKey(key); field.Next(); {
+		for field, n := h.FieldsByKey(key), 0; field.Next() && !m.occurrencesExceeded(n); n++ {
 			res = append(res, key)
 		}
 		// And once more to "oversign" it.
@@ -245,18 +659,99 @@ func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 		seen[strings.ToLower(key)] = struct{}{}
 
 		// Add to signing list once per each key use.
-		for field := h.FieldsByKey(key); field.Next(); {
+		for field, n := h.FieldsByKey(key), 0; field.Next() && !m.occurrencesExceeded(n); n++ {
 			res = append(res, key)
 		}
 	}
 	return res
 }
 
+// logAddr returns the address in the form suitable for logging, see
+// redact_pii.
+func (m *Modifier) logAddr(addr string) string {
+	if m.redactPII {
+		return address.Redact(addr)
+	}
+	return addr
+}
+
+func (m *Modifier) occurrencesExceeded(n int) bool {
+	return m.maxHeaderOccurrences != 0 && n >= m.maxHeaderOccurrences
+}
+
+// authDomainMatches checks whether the domain of the From (or Resent-From)
+// header field address matches the domain of the authenticated user.
+func (s *state) authDomainMatches(h *textproto.Header, fromField string) bool {
+	if s.meta.Conn == nil || s.meta.Conn.AuthUser == "" {
+		s.log.Msg("not signing, message is not from an authenticated session")
+		return false
+	}
+	_, authDomain, err := address.Split(s.meta.Conn.AuthUser)
+	if err != nil || authDomain == "" {
+		s.log.Msg("not signing, authenticated username does not contain a domain", "auth_user", s.m.logAddr(s.meta.Conn.AuthUser))
+		return false
+	}
+
+	list, err := mail.ParseAddressList(h.Get(fromField))
+	if err != nil || len(list) == 0 {
+		s.log.Msg("not signing, malformed header field", "field", fromField)
+		return false
+	}
+	if len(list) > 1 && !s.m.multipleFromOk {
+		s.log.Msg("not signing, multiple addresses", "field", fromField)
+		return false
+	}
+	_, fromDomain, err := address.Split(list[0].Address)
+	if err != nil {
+		s.log.Msg("not signing, malformed header field", "field", fromField)
+		return false
+	}
+
+	normAuth, err := dns.ForLookup(authDomain)
+	if err != nil {
+		return false
+	}
+	normFrom, err := dns.ForLookup(fromDomain)
+	if err != nil {
+		return false
+	}
+	if normAuth != normFrom {
+		s.log.Msg("not signing, From domain does not match authenticated user domain",
+			"from_domain", fromDomain, "auth_user", s.m.logAddr(s.meta.Conn.AuthUser))
+		return false
+	}
+	return true
+}
+
+// addressDomain returns the domain of the first address in the first
+// header field with the specified name.
+func addressDomain(h *textproto.Header, field string) (string, error) {
+	list, err := mail.ParseAddressList(h.Get(field))
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", errors.New("empty address list")
+	}
+	_, domain, err := address.Split(list[0].Address)
+	if err != nil {
+		return "", err
+	}
+	if domain == "" {
+		return "", errors.New("address without domain")
+	}
+	return domain, nil
+}
+
 type state struct {
-	m    *Modifier
-	meta *module.MsgMetadata
-	from string
-	log  *log.Logger
+	m     *Modifier
+	meta  *module.MsgMetadata
+	from  string
+	rcpts []string
+	log   *log.Logger
+
+	// signedDomain is the domain the message was signed for by RewriteBody.
+	signedDomain string
 }
 
 func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
@@ -267,32 +762,105 @@ func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetada
 	}, nil
 }
 
+// endpointAllowed checks whether the message was received via one of the
+// endpoints listed in only_endpoints. Messages without connection
+// information (e.g. generated locally or passed via the queue) are not
+// signed if the list is not empty.
+func (s *state) endpointAllowed() bool {
+	if len(s.m.onlyEndpoints) == 0 {
+		return true
+	}
+	if s.meta.Conn == nil || s.meta.Conn.Endpoint == "" {
+		s.log.DebugMsg("not signing, message endpoint is unknown")
+		return false
+	}
+	for _, endp := range s.m.onlyEndpoints {
+		if endp == s.meta.Conn.Endpoint {
+			return true
+		}
+	}
+	s.log.DebugMsg("not signing, message endpoint is not listed in only_endpoints", "endpoint", s.meta.Conn.Endpoint)
+	return false
+}
+
 func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
 	s.from = mailFrom
 	return mailFrom, nil
 }
 
 func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	if s.m.rcptHashField != "" {
+		s.rcpts = append(s.rcpts, rcptTo)
+	}
 	return []string{rcptTo}, nil
 }
 
 func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "modify.dkim/RewriteBody").End()
 
-	var domain string
-	if s.from != "" {
+	ctx, span := tracing.StartSpan(ctx, s.meta, "modify.dkim.RewriteBody")
+	err := s.rewriteBody(ctx, h, body)
+	span.SetAttr("maddy.dkim.signed", s.signedDomain != "")
+	if s.signedDomain != "" {
+		span.SetAttr("maddy.dkim.domain", s.signedDomain)
+	}
+	span.End(err)
+	return err
+}
+
+func (s *state) rewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if !s.endpointAllowed() {
+		return nil
+	}
+
+	if size := int64(body.Len()); size < s.m.minSize || (s.m.maxSize != 0 && size > s.m.maxSize) {
+		s.log.DebugMsg("not signing, body size is out of range", "size", size)
+		return nil
+	}
+
+	// Resent-* blocks are prepended to the header, so the first
+	// Resent-From field belongs to the most recent resending.
+	resent := s.m.useResent && h.Has("Resent-From")
+	fromField := "From"
+	if resent {
+		fromField = "Resent-From"
+	}
+
+	if s.m.enforceAuthDomain && !s.authDomainMatches(h, fromField) {
+		return nil
+	}
+
+	var (
+		domain        string
+		identityLocal string
+	)
+	if resent || s.m.keyDir != "" {
+		var err error
+		domain, err = addressDomain(h, fromField)
+		if err != nil {
+			s.log.Msg("not signing, malformed header field", "field", fromField, "reason", err.Error())
+			return nil
+		}
+	} else if s.from != "" {
 		var err error
 		_, domain, err = address.Split(s.from)
 		if err != nil {
-			return err
+			if s.m.defaultIdentityDomain == "" {
+				s.log.Msg("not signing, malformed envelope sender and no default_identity set", "from", s.m.logAddr(s.from))
+				return nil
+			}
+			domain = ""
 		}
 	}
-	// Use first key for null return path (<>) and postmaster (<postmaster>)
 	if domain == "" {
-		domain = s.m.domains[0]
+		if s.m.defaultIdentityDomain != "" {
+			domain = s.m.defaultIdentityDomain
+			identityLocal = s.m.defaultIdentityLocal
+		} else {
+			// Use first key for null return path (<>) and postmaster (<postmaster>)
+			domain = s.m.domains[0]
+		}
 	}
-	selector := s.m.selector
-
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
 		if strings.HasSuffix(domain, "."+topDomain) {
@@ -304,9 +872,29 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
+	if !s.m.policyAllows(normDomain) {
+		s.log.DebugMsg("not signing, disabled by domain_policy", "domain", normDomain)
+		return nil
+	}
+	keySigner, selector := s.m.signer(normDomain)
 	if keySigner == nil {
-		s.log.Msg("no key for domain", "domain", normDomain)
+		if s.m.requireSignature && s.m.multiDomain() {
+			s.log.Msg("rejecting, no key for domain and require_signature is set", "domain", normDomain)
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Sender domain is not allowed",
+				ModifierName: "modify.dkim",
+				Misc: map[string]interface{}{
+					"domain": normDomain,
+				},
+			}
+		}
+		if s.m.keyDir != "" {
+			s.log.DebugMsg("no key for domain", "domain", normDomain)
+		} else {
+			s.log.Msg("no key for domain", "domain", normDomain)
+		}
 		return nil
 	}
 
@@ -323,17 +911,46 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		if err != nil {
 			return nil
 		}
+
+		if !address.IsASCII(identityLocal) {
+			identityLocal = ""
+		}
+	}
+
+	// The header is not changed until the slot is acquired, so a rejected
+	// message is left intact. Waiting is bounded by the delivery context.
+	if err := s.m.signSem.TakeContext(ctx); err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+			Message:      "Server is busy, try again later",
+			ModifierName: "modify.dkim",
+			Err:          err,
+		}
+	}
+	defer s.m.signSem.Release()
+
+	if s.m.stripExisting {
+		// Only DKIM-Signature fields are removed, ARC-* and
+		// Authentication-Results are left intact.
+		h.Del("DKIM-Signature")
+	}
+	if s.m.rcptHashField != "" {
+		// Never keep the value set by the message originator.
+		h.Del(s.m.rcptHashField)
+		h.Add(s.m.rcptHashField, rcptHash(s.rcpts))
 	}
 
 	opts := dkim.SignOptions{
 		Domain:                 domain,
 		Selector:               selector,
-		Identifier:             "@" + domain,
+		Identifier:             identityLocal + "@" + domain,
 		Signer:                 keySigner,
 		Hash:                   s.m.hash,
 		HeaderCanonicalization: s.m.headerCanon,
-		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
+		BodyCanonicalization:   s.m.bodyCanonFor(h),
+		HeaderKeys:             s.m.fieldsToSign(h, resent),
+		QueryMethods:           []dkim.QueryMethod{s.m.queryMethod},
 	}
 	if s.m.sigExpiry != 0 {
 		opts.Expiration = time.Now().Add(s.m.sigExpiry)
@@ -360,13 +977,43 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
 
-	h.AddRaw([]byte(signer.Signature()))
+	if s.m.headerPlacement == "bottom" {
+		if err := appendField(h, []byte(signer.Signature())); err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+	} else {
+		// AddRaw inserts the field at the top of the header.
+		h.AddRaw([]byte(signer.Signature()))
+	}
 
+	s.signedDomain = domain
 	s.m.log.DebugMsg("signed", "domain", domain)
 
 	return nil
 }
 
+// appendField adds the raw field after all other fields of the header.
+// textproto.Header can only insert fields at the top so the header is
+// rebuilt.
+func appendField(h *textproto.Header, kv []byte) error {
+	var fields [][]byte
+	for field := h.Fields(); field.Next(); {
+		raw, err := field.Raw()
+		if err != nil {
+			return err
+		}
+		fields = append(fields, raw)
+	}
+
+	newHdr := textproto.Header{}
+	newHdr.AddRaw(kv)
+	for i := len(fields) - 1; i >= 0; i-- {
+		newHdr.AddRaw(fields[i])
+	}
+	*h = newHdr
+	return nil
+}
+
 func (s *state) Close() error {
 	return nil
 }
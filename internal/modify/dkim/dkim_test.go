@@ -21,11 +21,16 @@ package dkim
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/dkim"
@@ -33,7 +38,9 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/container"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -236,7 +243,7 @@ func TestFieldsToSign(t *testing.T) {
 		oversignHeader: []string{"A", "B"},
 		signHeader:     []string{"C"},
 	}
-	fields := m.fieldsToSign(&h)
+	fields := m.fieldsToSign(&h, false)
 	sort.Strings(fields)
 	expected := []string{"A", "A", "A", "B", "B", "C", "C"}
 
@@ -244,3 +251,736 @@ func TestFieldsToSign(t *testing.T) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
 	}
 }
+
+func TestFieldsToSign_MaxOccurrences(t *testing.T) {
+	h := textproto.Header{}
+	for i := 0; i < 50; i++ {
+		h.Add("Received", "hop")
+	}
+	h.Add("From", "1")
+	h.Add("List-Id", "2")
+	h.Add("List-Id", "3")
+	h.Add("List-Id", "4")
+
+	m := Modifier{
+		oversignHeader:       []string{"From", "Received"},
+		signHeader:           []string{"List-Id"},
+		maxHeaderOccurrences: 2,
+	}
+	fields := m.fieldsToSign(&h, false)
+	sort.Strings(fields)
+	expected := []string{"From", "From", "List-Id", "List-Id", "Received", "Received", "Received"}
+
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
+	}
+}
+
+func TestStripExisting(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.stripExisting = true
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHdr := textproto.Header{}
+	testHdr.Add("From", "<hello@hello>")
+	testHdr.Add("DKIM-Signature", "v=1; a=rsa-sha256; d=origin.test; s=old; b=AAAA")
+	testHdr.Add("ARC-Seal", "i=1; a=rsa-sha256; d=origin.test; s=arc; cv=none; b=BBBB")
+	testHdr.Add("Authentication-Results", "origin.test; dkim=pass")
+	body := []byte("hello there\r\n")
+
+	if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &testHdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	sigs := 0
+	for field := testHdr.FieldsByKey("DKIM-Signature"); field.Next(); {
+		sigs++
+		if strings.Contains(field.Value(), "d=origin.test") {
+			t.Error("pre-existing DKIM-Signature was not removed")
+		}
+	}
+	if sigs != 1 {
+		t.Errorf("expected exactly one DKIM-Signature, got %d", sigs)
+	}
+	if !testHdr.Has("ARC-Seal") || !testHdr.Has("Authentication-Results") {
+		t.Error("ARC-Seal or Authentication-Results was removed")
+	}
+
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+}
+
+func TestSizeLimits(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	body := []byte("hello there\r\n")
+	test := func(minSize, maxSize int64, expectSigned bool) {
+		t.Helper()
+
+		m.minSize, m.maxSize = minSize, maxSize
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Has("DKIM-Signature") != expectSigned {
+			t.Errorf("min_size %d, max_size %d: expected signed = %v", minSize, maxSize, expectSigned)
+		}
+	}
+
+	test(0, 0, true)
+	test(int64(len(body)), int64(len(body)), true)
+	test(int64(len(body))+1, 0, false)
+	test(0, int64(len(body))-1, false)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	testHdr, body := signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+
+	// Replace the key with a new one generated in a different directory.
+	newDir := t.TempDir()
+	newTestModifier(t, newDir, "ed25519", []string{"maddy.test"})
+	for _, name := range []string{"maddy.test.key", "maddy.test.dns"} {
+		blob, err := os.ReadFile(filepath.Join(newDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), blob, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	testHdr, body = signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, testHdr, body)
+}
+
+func TestDefaultIdentity(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test", "maddy2.test"})
+
+	// Malformed envelope sender, no default_identity - message is not signed.
+	hdr, _ := signTestMsg(t, m, "malformed")
+	if hdr.Has("DKIM-Signature") {
+		t.Error("message with malformed sender should not be signed")
+	}
+
+	if err := m.setDefaultIdentity("postmaster@maddy2.test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []string{"", "malformed"} {
+		hdr, body := signTestMsg(t, m, from)
+		sig := hdr.Get("DKIM-Signature")
+		if !strings.Contains(sig, "i=postmaster@maddy2.test") || !strings.Contains(sig, "d=maddy2.test") {
+			t.Errorf("wrong identity used for %q: %s", from, sig)
+		}
+		verifyTestMsg(t, dir, []string{"maddy2.test"}, hdr, body)
+	}
+
+	for _, identity := range []string{"example.org", "postmaster@example.org", "a;b@maddy.test", "@@"} {
+		if err := m.setDefaultIdentity(identity); err == nil {
+			t.Errorf("expected an error for %q", identity)
+		}
+	}
+}
+
+func TestEnforceAuthDomain(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.enforceAuthDomain = true
+
+	sign := func(authUser, from string) bool {
+		t.Helper()
+
+		meta := &module.MsgMetadata{}
+		if authUser != "" {
+			meta.Conn = &module.ConnState{AuthUser: authUser}
+		}
+		state, err := m.ModStateForMsg(context.Background(), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr.Has("DKIM-Signature")
+	}
+
+	if !sign("user@maddy.test", "<user@MADDY.test>") {
+		t.Error("message with matching From domain should be signed")
+	}
+	if sign("user@example.org", "<user@maddy.test>") {
+		t.Error("message with From not matching auth domain should not be signed")
+	}
+	if sign("user", "<user@maddy.test>") {
+		t.Error("message from user without domain should not be signed")
+	}
+	if sign("", "<user@maddy.test>") {
+		t.Error("message from unauthenticated session should not be signed")
+	}
+	if sign("user@maddy.test", "<user@maddy.test>, <user2@maddy.test>") {
+		t.Error("message with multiple From addresses should not be signed")
+	}
+}
+
+func TestCanonByType(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	sign := func(contentType string) string {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		if contentType != "" {
+			hdr.Add("Content-Type", contentType)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr.Get("DKIM-Signature")
+	}
+	check := func(contentType, expectedCanon string) {
+		t.Helper()
+		sig := sign(contentType)
+		if !strings.Contains(sig, "c="+expectedCanon+";") {
+			t.Errorf("Content-Type %q: expected c=%s, got signature: %s", contentType, expectedCanon, sig)
+		}
+	}
+
+	check("text/plain", "relaxed/relaxed")
+
+	canonMap, err := parseCanonByType(nil, config.Node{
+		Name: "canon_by_type",
+		Children: []config.Node{
+			{Name: "text/plain", Args: []string{"simple"}},
+			{Name: "multipart/*", Args: []string{"simple"}},
+			{Name: "default", Args: []string{"relaxed"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.bodyCanonByType = canonMap.(map[string]dkim.Canonicalization)
+	m.bodyCanon = dkim.CanonicalizationSimple
+
+	check("", "relaxed/simple")
+	check("Text/Plain; charset=utf-8", "relaxed/simple")
+	check("multipart/alternative; boundary=x", "relaxed/simple")
+	check("text/html", "relaxed/relaxed")
+	check("malformed", "relaxed/relaxed")
+
+	delete(m.bodyCanonByType, "default")
+	check("text/html", "relaxed/simple")
+
+	for _, children := range [][]config.Node{
+		{{Name: "text/plain", Args: []string{"nofws"}}},
+		{{Name: "text", Args: []string{"simple"}}},
+		{{Name: "text/plain", Args: []string{"simple"}}, {Name: "TEXT/PLAIN", Args: []string{"relaxed"}}},
+		{},
+	} {
+		if _, err := parseCanonByType(nil, config.Node{Name: "canon_by_type", Children: children}); err == nil {
+			t.Errorf("expected an error for %v", children)
+		}
+	}
+}
+
+func TestUseResent(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test", "maddy2.test"})
+	m.useResent = true
+
+	sign := func(hdr textproto.Header) textproto.Header {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<user@example.org>")
+	hdr.Add("Resent-From", "<old@example.org>")
+	hdr.Add("Resent-Date", "Mon, 1 Jan 2024 00:00:00 +0000")
+	hdr.Add("Resent-From", "<user@maddy2.test>")
+	hdr.Add("Resent-Date", "Tue, 2 Jan 2024 00:00:00 +0000")
+	hdr = sign(hdr)
+	verifyTestMsg(t, dir, []string{"maddy2.test"}, hdr, []byte("hello\r\n"))
+
+	sig := hdr.Get("DKIM-Signature")
+	if !strings.Contains(strings.ReplaceAll(sig, "\r\n ", ""), "h=Resent-From:Resent-From:Resent-Date:Resent-Date:") {
+		t.Errorf("Resent-* fields are not signed first: %s", sig)
+	}
+
+	hdr = textproto.Header{}
+	hdr.Add("From", "<user@maddy2.test>")
+	hdr = sign(hdr)
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, []byte("hello\r\n"))
+
+	hdr = textproto.Header{}
+	hdr.Add("Resent-From", "<user>")
+	if hdr = sign(hdr); hdr.Has("DKIM-Signature") {
+		t.Error("message with malformed Resent-From should not be signed")
+	}
+}
+
+func TestKeyDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// Generate keys named as expected by key_dir.
+	keysMod, err := New(container.New(), "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysMod.(*Modifier).log = testutils.Logger(t, "modify.dkim")
+	err = keysMod.Configure(nil, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"maddy.test", "maddy2.test"}},
+			{Name: "selector", Args: []string{"default"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verifyTestMsg expects {domain}.dns files.
+	for _, domain := range []string{"maddy.test", "maddy2.test"} {
+		if err := os.Rename(filepath.Join(dir, domain+"_default.dns"), filepath.Join(dir, domain+".dns")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := New(container.New(), "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	err = m.Configure(nil, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_dir", Args: []string{dir}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.signers) != 2 {
+		t.Fatalf("expected 2 keys to be discovered, got %d", len(m.signers))
+	}
+
+	sign := func(from string) textproto.Header {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+
+	hdr := sign("<user@maddy2.test>")
+	verifyTestMsg(t, dir, []string{"maddy2.test"}, hdr, []byte("hello\r\n"))
+
+	if hdr := sign("<user@example.org>"); hdr.Has("DKIM-Signature") {
+		t.Error("message from domain without key should not be signed")
+	}
+
+	m.requireSignature = true
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr = textproto.Header{}
+	hdr.Add("From", "<user@example.org>")
+	err = state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")})
+	if err == nil {
+		t.Fatal("expected an error for domain without key with require_signature")
+	}
+	if exterrors.IsTemporaryOrUnspec(err) {
+		t.Errorf("expected a permanent error, got %v", err)
+	}
+}
+
+func TestRequireSignature_SingleDomain(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.requireSignature = true
+
+	// require_signature is ignored if only one domain is configured.
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.RewriteSender(context.Background(), "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("From", "<user@example.org>")
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+		t.Fatal("unexpected error in single-domain mode:", err)
+	}
+	if hdr.Has("DKIM-Signature") {
+		t.Error("message from domain without key should not be signed")
+	}
+}
+
+func TestQueryMethod(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	if sig := hdr.Get("DKIM-Signature"); !strings.Contains(sig, "q=dns/txt") {
+		t.Errorf("q= tag is missing: %s", sig)
+	}
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, body)
+
+	mod, err := New(container.New(), "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Configure([]string{"maddy.test", "default"}, config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}.key")}},
+			{Name: "query_method", Args: []string{"dns/srv"}},
+		},
+	}))
+	if err == nil {
+		t.Error("expected an error for unknown query method")
+	}
+}
+
+func TestDomainPolicy(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test", "maddy2.test", "maddy3.test"})
+
+	policy, err := parseDomainPolicy(nil, config.Node{
+		Name: "domain_policy",
+		Children: []config.Node{
+			{Name: "MADDY.test", Args: []string{"sign"}},
+			{Name: "maddy2.test", Args: []string{"skip"}},
+			{Name: "default", Args: []string{"skip"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.domainPolicy = policy.(map[string]bool)
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, body)
+
+	for _, from := range []string{"test@maddy2.test", "test@maddy3.test"} {
+		hdr, _ := signTestMsg(t, m, from)
+		if hdr.Has("DKIM-Signature") {
+			t.Errorf("message from %s should not be signed", from)
+		}
+	}
+
+	for _, children := range [][]config.Node{
+		{{Name: "maddy.test", Args: []string{"maybe"}}},
+		{{Name: "maddy.test", Args: []string{"sign"}}, {Name: "Maddy.test", Args: []string{"skip"}}},
+		{{Name: "maddy.test"}},
+	} {
+		if _, err := parseDomainPolicy(nil, config.Node{Name: "domain_policy", Children: children}); err == nil {
+			t.Errorf("expected an error for %v", children)
+		}
+	}
+}
+
+func TestHeaderPlacement(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	for _, placement := range []string{"top", "bottom"} {
+		m.headerPlacement = placement
+		hdr, body := signTestMsg(t, m, "test@maddy.test")
+
+		var keys []string
+		for field := hdr.Fields(); field.Next(); {
+			keys = append(keys, field.Key())
+		}
+		expected := []string{"Dkim-Signature", "To", "Subject", "From"}
+		if placement == "bottom" {
+			expected = []string{"To", "Subject", "From", "Dkim-Signature"}
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("%s: wrong field order: %v", placement, keys)
+		}
+
+		verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, body)
+	}
+}
+
+func TestParseKeySource(t *testing.T) {
+	cfg, err := parseKeySource(nil, config.Node{Name: "key_source", Args: []string{"file"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.(*pkcs11Config) != nil {
+		t.Error("file key source should not have PKCS#11 config")
+	}
+
+	cfg, err = parseKeySource(nil, config.Node{
+		Name: "key_source",
+		Args: []string{"pkcs11"},
+		Children: []config.Node{
+			{Name: "module", Args: []string{"/usr/lib/softhsm/libsofthsm2.so"}},
+			{Name: "slot", Args: []string{"1"}},
+			{Name: "pin", Args: []string{"1234"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p11 := cfg.(*pkcs11Config)
+	if p11.module != "/usr/lib/softhsm/libsofthsm2.so" || p11.slot != 1 || p11.pin != "1234" {
+		t.Errorf("wrong config: %+v", p11)
+	}
+	if p11.keyLabel != "{domain}_{selector}" {
+		t.Errorf("wrong default key label: %s", p11.keyLabel)
+	}
+
+	for _, node := range []config.Node{
+		{Name: "key_source"},
+		{Name: "key_source", Args: []string{"vault"}},
+		{Name: "key_source", Args: []string{"pkcs11"}},
+		{Name: "key_source", Args: []string{"file"}, Children: []config.Node{{Name: "module", Args: []string{"x"}}}},
+		{Name: "key_source", Args: []string{"pkcs11"}, Children: []config.Node{
+			{Name: "module", Args: []string{"x"}},
+			{Name: "slot", Args: []string{"-1"}},
+		}},
+	} {
+		if _, err := parseKeySource(nil, node); err == nil {
+			t.Errorf("expected an error for %v", node)
+		}
+	}
+}
+
+// mismatchedSigner signs using one key but reports the public key of
+// another one.
+type mismatchedSigner struct {
+	crypto.Signer
+	pub crypto.PublicKey
+}
+
+func (s mismatchedSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	for _, algo := range []string{"ed25519", "rsa2048"} {
+		m := newTestModifier(t, dir, algo, []string{algo + ".maddy.test"})
+		if err := m.checkKeys(m.signers, m.selectors); err != nil {
+			t.Errorf("%s: unexpected error: %v", algo, err)
+		}
+	}
+
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]crypto.Signer{
+		"maddy.test": mismatchedSigner{Signer: m.signers["maddy.test"], pub: otherPub},
+	}
+	if err := m.checkKeys(signers, nil); err == nil {
+		t.Error("expected an error for mismatched key")
+	}
+}
+
+func TestRecipientHash(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.rcptHashField = "X-Recipient-Hash"
+
+	sign := func(rcpts ...string) textproto.Header {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if _, err := state.RewriteRcpt(context.Background(), rcpt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		hdr.Add("X-Recipient-Hash", "forged")
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+
+	hdr := sign("b@example.org", "A@example.org")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, []byte("hello\r\n"))
+	if n := len(hdr.Values("X-Recipient-Hash")); n != 1 {
+		t.Fatalf("expected 1 X-Recipient-Hash field, got %d", n)
+	}
+	hash := hdr.Get("X-Recipient-Hash")
+	if hash == "forged" || !strings.HasPrefix(hash, "sha256=") {
+		t.Errorf("wrong X-Recipient-Hash value: %s", hash)
+	}
+	if !strings.Contains(hdr.Get("DKIM-Signature"), "X-Recipient-Hash:X-Recipient-Hash") {
+		t.Errorf("X-Recipient-Hash is not oversigned: %s", hdr.Get("DKIM-Signature"))
+	}
+
+	otherHdr := sign("a@example.org", "b@example.org")
+	if other := otherHdr.Get("X-Recipient-Hash"); other != hash {
+		t.Errorf("hash depends on recipients order or case: %s != %s", other, hash)
+	}
+	otherHdr = sign("a@example.org")
+	if other := otherHdr.Get("X-Recipient-Hash"); other == hash {
+		t.Error("hash does not depend on recipients")
+	}
+
+	for _, name := range []string{"", "X Hash", "X:Hash", "DKIM-Signature"} {
+		if err := checkFieldName(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+}
+
+func TestOnlyEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.onlyEndpoints = []string{"submission"}
+
+	signed := func(conn *module.ConnState) bool {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{Conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		return hdr.Has("DKIM-Signature")
+	}
+
+	if !signed(&module.ConnState{Endpoint: "submission"}) {
+		t.Error("message from submission should be signed")
+	}
+	if signed(&module.ConnState{Endpoint: "smtp"}) {
+		t.Error("message from smtp should not be signed")
+	}
+	if signed(nil) {
+		t.Error("message without connection information should not be signed")
+	}
+
+	m.onlyEndpoints = nil
+	if !signed(nil) {
+		t.Error("message should be signed if only_endpoints is not set")
+	}
+}
+
+func TestMaxConcurrentSignings(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+	m.signSem = limiters.NewSemaphore(1)
+	m.stripExisting = true
+	m.rcptHashField = "X-Rcpt-Hash"
+
+	sign := func(ctx context.Context) (textproto.Header, error) {
+		t.Helper()
+
+		state, err := m.ModStateForMsg(ctx, &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(ctx, "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		hdr.Add("DKIM-Signature", "old")
+		err = state.RewriteBody(ctx, &hdr, buffer.MemoryBuffer{Slice: []byte("hello\r\n")})
+		return hdr, err
+	}
+
+	// Slot is taken by another signing operation.
+	m.signSem.Take()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	hdr, err := sign(ctx)
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("expected a temporary error, got %v", err)
+	}
+	if hdr.Get("DKIM-Signature") != "old" || hdr.Has("X-Rcpt-Hash") {
+		t.Error("header should not be changed if the message is not signed")
+	}
+	m.signSem.Release()
+
+	hdr, err = sign(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, []byte("hello\r\n"))
+}
@@ -31,6 +31,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
 )
 
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
@@ -103,16 +106,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
+		pkey crypto.Signer
+		err  error
 	)
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
@@ -134,7 +134,7 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
+	_, err = writeDNSRecord(keyPath, pkey, m.keyFlags)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
@@ -154,35 +154,125 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+// dnsRecord returns the DKIM key record (RFC 6376, Section 3.6.1) for the
+// public key.
+//
+// For Ed25519 keys, the raw 32-byte key is used as required by RFC 8463,
+// RSA keys are encoded as SubjectPublicKeyInfo.
+func dnsRecord(pubkey crypto.PublicKey, flags []string) (string, error) {
 	var (
+		algo    string
 		keyBlob []byte
-		pubkey  = pkey.Public()
 	)
 	switch pubkey := pubkey.(type) {
 	case *rsa.PublicKey:
 		var err error
+		algo = "rsa"
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
 		if err != nil {
 			return "", err
 		}
 	case ed25519.PublicKey:
+		if len(pubkey) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("malformed ed25519 public key: %d bytes", len(pubkey))
+		}
+		algo = "ed25519"
 		keyBlob = pubkey
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("unsupported public key type: %T", pubkey)
 	}
 
-	dnsPath := keyPath + ".dns"
-	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	record := "v=DKIM1; k=" + algo
+	if len(flags) != 0 {
+		record += "; t=" + strings.Join(flags, ":")
+	}
+	return record + "; p=" + base64.StdEncoding.EncodeToString(keyBlob), nil
+}
+
+// checkKeyType checks that the key can be used for signing. Only RSA and
+// Ed25519 keys are supported.
+//
+// The hash function is not checked: sha256 is the only one allowed by the
+// hash directive and it is the one required for both key types by RFC 8301
+// and RFC 8463.
+func checkKeyType(signer crypto.Signer) error {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type: %T", signer.Public())
 	}
-	dnsF, err := os.Create(dnsPath)
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer, flags []string) (string, error) {
+	keyRecord, err := dnsRecord(pkey.Public(), flags)
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
-	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
+
+	dnsPath := keyPath + ".dns"
+	if filepath.Ext(keyPath) == ".key" {
+		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	}
+	if err := os.WriteFile(dnsPath, []byte(keyRecord), 0o666); err != nil {
 		return "", err
 	}
 	return dnsPath, nil
 }
+
+// discoverKeys reads all keys from key_dir. Key files should be named
+// {domain}_{selector}.key, files with other extensions are ignored.
+//
+// If there are multiple keys for the same domain, the one with
+// lexicographically greatest selector is used. Keys that can't be loaded
+// are skipped.
+func (m *Modifier) discoverKeys() (map[string]crypto.Signer, map[string]string, error) {
+	entries, err := os.ReadDir(m.keyDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("modify.dkim: key_dir: %w", err)
+	}
+
+	signers := make(map[string]crypto.Signer)
+	selectors := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".key" {
+			continue
+		}
+		domain, selector, ok := strings.Cut(strings.TrimSuffix(name, ".key"), "_")
+		if !ok || domain == "" || selector == "" {
+			m.log.Msg("key_dir: skipping file with malformed name", "file", name)
+			continue
+		}
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			m.log.Msg("key_dir: skipping file with malformed domain", "file", name)
+			continue
+		}
+
+		if prev, ok := selectors[normDomain]; ok {
+			if prev > selector {
+				m.log.Msg("key_dir: multiple keys for domain, using the greatest selector",
+					"domain", normDomain, "selector", prev, "skipped_selector", selector)
+				continue
+			}
+			m.log.Msg("key_dir: multiple keys for domain, using the greatest selector",
+				"domain", normDomain, "selector", selector, "skipped_selector", prev)
+		}
+
+		// Files are known to exist, so no keys are generated here.
+		signer, _, err := m.loadOrGenerateKey(filepath.Join(m.keyDir, name), m.newKeyAlgo)
+		if err != nil {
+			m.log.Error("key_dir: failed to load key", err, "file", name)
+			continue
+		}
+		if err := checkKeyType(signer); err != nil {
+			m.log.Error("key_dir: key can't be used", err, "file", name)
+			continue
+		}
+		signers[normDomain] = signer
+		selectors[normDomain] = selector
+	}
+	m.log.DebugMsg("key_dir: keys loaded", "count", len(signers))
+	return signers, selectors, nil
+}
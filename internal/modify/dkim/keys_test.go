@@ -19,7 +19,11 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dkim
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
 	"os"
@@ -154,3 +158,67 @@ func TestKeyLoad_existing_pkcs1(t *testing.T) {
 		t.Fatalf("wrong public key returned by loadOrGenerateKey, got %s", pubkey.N.String())
 	}
 }
+
+const pubkeyRSA = `MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAuxWwDR9ADiuV2b9xF+btOIgwS5W0yJeS/Dht4HlUELrye2JZ7TCQpx2Hs1FY5Tkj4VLnYHTPftS6cLYNx6hQbWZMhj5qmP9ccQ8rqdgdLB5RqCn3zo8wbKFZ8ygYt1yZyNOfJLNTBjIcC1BCKoZosA7MWHUOwRtt1ARVmldsNH3iio0lwHjyKNYd0Kqw4uGEg6sulK69lw4G8YTnKtCt0G8vCpQHyQepolOMF7Q1NZEw02/UE54qgaaC+ym+BQsqqF5iodmuIfLX+W0kKDee2YYhjuxNaFcPhE5j35LlGHCsrL0Xh4+2VZSYXuAO5aWpwX9jrrSFyCJLD/aYGMgdrwIDAQAB`
+
+func TestDNSRecord(t *testing.T) {
+	m := Modifier{}
+	m.log = testutils.Logger(t, m.Name())
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ed25519.key"), []byte(pkeyEd25519), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rsa.key"), []byte(pkeyRSA), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, _, err := m.loadOrGenerateKey(filepath.Join(dir, "ed25519.key"), "ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, _, err := m.loadOrGenerateKey(filepath.Join(dir, "rsa.key"), "rsa2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		key      crypto.Signer
+		flags    []string
+		expected string
+	}{
+		{key: ed25519Key, expected: "v=DKIM1; k=ed25519; p=" + pubkeyEd25519},
+		{key: ed25519Key, flags: []string{"s"}, expected: "v=DKIM1; k=ed25519; t=s; p=" + pubkeyEd25519},
+		{key: rsaKey, expected: "v=DKIM1; k=rsa; p=" + pubkeyRSA},
+		{key: rsaKey, flags: []string{"y", "s"}, expected: "v=DKIM1; k=rsa; t=y:s; p=" + pubkeyRSA},
+	} {
+		record, err := dnsRecord(c.key.Public(), c.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record != c.expected {
+			t.Errorf("wrong record\nwant: %s\ngot:  %s", c.expected, record)
+		}
+	}
+
+	if _, err := dnsRecord(ed25519.PublicKey([]byte{1, 2, 3}), nil); err == nil {
+		t.Error("expected an error for malformed ed25519 key")
+	}
+}
+
+func TestCheckKeyType(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyType(priv); err != nil {
+		t.Error(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyType(ecKey); err == nil {
+		t.Error("expected an error for ECDSA key")
+	}
+}
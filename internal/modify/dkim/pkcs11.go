@@ -0,0 +1,98 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// pkcs11Config is the configuration of the PKCS#11 key_source.
+type pkcs11Config struct {
+	module string
+	slot   int
+	pin    string
+	// keyLabel is the CKA_LABEL of the key objects, '{domain}' and
+	// '{selector}' placeholders are replaced.
+	keyLabel string
+
+	// Set by openHSM.
+	hsm *hsm
+}
+
+// parseKeySource parses the key_source directive. nil is returned for the
+// file key source.
+func parseKeySource(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument required")
+	}
+
+	switch node.Args[0] {
+	case "file":
+		if len(node.Children) != 0 {
+			return nil, config.NodeErr(node, "no block expected for file key source")
+		}
+		return (*pkcs11Config)(nil), nil
+	case "pkcs11":
+		cfg := &pkcs11Config{}
+		childM := config.NewMap(nil, node)
+		childM.String("module", false, true, "", &cfg.module)
+		childM.Int("slot", false, false, 0, &cfg.slot)
+		childM.String("pin", false, false, "", &cfg.pin)
+		childM.String("key_label", false, false, "{domain}_{selector}", &cfg.keyLabel)
+		if _, err := childM.Process(); err != nil {
+			return nil, err
+		}
+		if cfg.slot < 0 {
+			return nil, config.NodeErr(node, "slot should not be negative")
+		}
+		return cfg, nil
+	default:
+		return nil, config.NodeErr(node, "unknown key source: %s", node.Args[0])
+	}
+}
+
+// loadHSMKey returns the signer for the key with the label stored in the
+// token. Keys are not generated, they should exist in the token.
+func (cfg *pkcs11Config) loadHSMKey(label string) (crypto.Signer, error) {
+	if cfg.hsm == nil {
+		var err error
+		cfg.hsm, err = openHSM(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signer, err := cfg.hsm.signer(label)
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: pkcs11: %s: %w", label, err)
+	}
+	return signer, nil
+}
+
+// close releases the token session, if any.
+func (cfg *pkcs11Config) close() error {
+	if cfg == nil || cfg.hsm == nil {
+		return nil
+	}
+	err := cfg.hsm.Close()
+	cfg.hsm = nil
+	return err
+}
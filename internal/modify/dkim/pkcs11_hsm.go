@@ -0,0 +1,376 @@
+//go:build cgo && pkcs11
+// +build cgo,pkcs11
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 3.0 values not defined by github.com/miekg/pkcs11.
+const (
+	ckkECEdwards = 0x00000040
+	ckmEdDSA     = 0x00001057
+)
+
+// digestInfoPrefixes contain DER-encoded DigestInfo prefixes (RFC 8017,
+// Section 9.2) for CKM_RSA_PKCS mechanism that expects the DigestInfo
+// structure instead of a raw digest.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+}
+
+// sharedCtx is the PKCS#11 library context shared by all users of the
+// library. The library can be initialized only once per process, so the
+// context can't be owned by a single modifier instance. During reload, the
+// new instance is configured before the old one is stopped.
+type sharedCtx struct {
+	ctx  *pkcs11.Ctx
+	refs int
+}
+
+var (
+	p11CtxsLck sync.Mutex
+	p11Ctxs    = map[string]*sharedCtx{}
+)
+
+func acquireCtx(module string) (*pkcs11.Ctx, error) {
+	p11CtxsLck.Lock()
+	defer p11CtxsLck.Unlock()
+
+	if shared, ok := p11Ctxs[module]; ok {
+		shared.refs++
+		return shared.ctx, nil
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("modify.dkim: pkcs11: failed to load module %s", module)
+	}
+	// The library might be already initialized by some other code in the
+	// process, this is fine.
+	err := ctx.Initialize()
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("modify.dkim: pkcs11: %w", err)
+	}
+	p11Ctxs[module] = &sharedCtx{ctx: ctx, refs: 1}
+	return ctx, nil
+}
+
+func releaseCtx(module string) error {
+	p11CtxsLck.Lock()
+	defer p11CtxsLck.Unlock()
+
+	shared, ok := p11Ctxs[module]
+	if !ok {
+		return nil
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+	delete(p11Ctxs, module)
+	err := shared.ctx.Finalize()
+	shared.ctx.Destroy()
+	return err
+}
+
+// hsm is a PKCS#11 token session shared by all keys of the modifier.
+type hsm struct {
+	module string
+	ctx    *pkcs11.Ctx
+	slot   uint
+	pin    string
+
+	lck     sync.Mutex
+	session pkcs11.SessionHandle
+	open    bool
+	closed  bool
+}
+
+func openHSM(cfg *pkcs11Config) (*hsm, error) {
+	ctx, err := acquireCtx(cfg.module)
+	if err != nil {
+		return nil, err
+	}
+	return &hsm{
+		module: cfg.module,
+		ctx:    ctx,
+		slot:   uint(cfg.slot),
+		pin:    cfg.pin,
+	}, nil
+}
+
+// Close closes the session and releases the library context.
+//
+// Logout is not called explicitly since the login state is shared by all
+// sessions of the process, including the ones opened by the new modifier
+// instance during reload. The token logs out once its last session is
+// closed.
+func (h *hsm) Close() error {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+
+	var err error
+	if h.open {
+		err = h.ctx.CloseSession(h.session)
+		h.open = false
+	}
+	if releaseErr := releaseCtx(h.module); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// isSessionErr checks whether the error means that the session needs to be
+// opened again.
+func isSessionErr(err error) bool {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return false
+	}
+	switch p11Err {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN, pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT:
+		return true
+	}
+	return false
+}
+
+// ensureSession opens the session and logs in if needed. h.lck should be
+// held.
+func (h *hsm) ensureSession() error {
+	if h.closed {
+		return errors.New("modify.dkim: pkcs11: module is stopped")
+	}
+	if h.open {
+		return nil
+	}
+	session, err := h.ctx.OpenSession(h.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return err
+	}
+	if h.pin != "" {
+		err := h.ctx.Login(session, pkcs11.CKU_USER, h.pin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			_ = h.ctx.CloseSession(session)
+			return err
+		}
+	}
+	h.session = session
+	h.open = true
+	return nil
+}
+
+// withSession runs f with the open session. If it fails due to the session
+// being closed (e.g. the token was reconnected), session is opened again
+// and f is retried once.
+func (h *hsm) withSession(f func(session pkcs11.SessionHandle) error) error {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if err := h.ensureSession(); err != nil {
+			return err
+		}
+		err := f(h.session)
+		if err == nil || attempt > 0 || !isSessionErr(err) {
+			return err
+		}
+		_ = h.ctx.CloseSession(h.session)
+		h.open = false
+	}
+}
+
+func (h *hsm) findObject(session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := h.ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	objs, _, err := h.ctx.FindObjects(session, 1)
+	if finalErr := h.ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, errors.New("key not found in the token")
+	}
+	return objs[0], nil
+}
+
+func (h *hsm) publicKey(session pkcs11.SessionHandle, label string) (crypto.PublicKey, error) {
+	privKey, err := h.findObject(session, pkcs11.CKO_PRIVATE_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := h.ctx.GetAttributeValue(session, privKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyType, err := ulongValue(attrs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := h.ctx.GetAttributeValue(session, privKey, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case ckkECEdwards:
+		// Private key objects do not contain the public key, it is read
+		// from the object with the same label.
+		pubKey, err := h.findObject(session, pkcs11.CKO_PUBLIC_KEY, label)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := h.ctx.GetAttributeValue(session, pubKey, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		point := attrs[0].Value
+		// Usually it is DER-encoded OCTET STRING, but some tokens return
+		// raw bytes.
+		if len(point) != ed25519.PublicKeySize {
+			if _, err := asn1.Unmarshal(attrs[0].Value, &point); err != nil {
+				return nil, fmt.Errorf("malformed EC point: %w", err)
+			}
+		}
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("only Ed25519 keys are supported for EdDSA")
+		}
+		return ed25519.PublicKey(point), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %#x", keyType)
+	}
+}
+
+// ulongValue decodes CK_ULONG attribute value, it is stored in the native
+// byte order.
+func ulongValue(b []byte) (uint64, error) {
+	switch len(b) {
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b)), nil
+	case 8:
+		return binary.NativeEndian.Uint64(b), nil
+	default:
+		return 0, fmt.Errorf("unexpected CK_ULONG size: %d", len(b))
+	}
+}
+
+func (h *hsm) signer(label string) (crypto.Signer, error) {
+	s := &hsmSigner{h: h, label: label}
+	err := h.withSession(func(session pkcs11.SessionHandle) error {
+		var err error
+		s.pub, err = h.publicKey(session, label)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// hsmSigner implements crypto.Signer using the private key stored in the
+// token.
+type hsmSigner struct {
+	h     *hsm
+	label string
+	pub   crypto.PublicKey
+}
+
+func (s *hsmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *hsmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var (
+		mech uint
+		data []byte
+	)
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("modify.dkim: pkcs11: unsupported hash function: %v", opts.HashFunc())
+		}
+		mech = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case ed25519.PublicKey:
+		if opts.HashFunc() != 0 {
+			return nil, errors.New("modify.dkim: pkcs11: Ed25519 keys sign unhashed messages")
+		}
+		mech = ckmEdDSA
+		data = digest
+	}
+
+	var sig []byte
+	err := s.h.withSession(func(session pkcs11.SessionHandle) error {
+		privKey, err := s.h.findObject(session, pkcs11.CKO_PRIVATE_KEY, s.label)
+		if err != nil {
+			return err
+		}
+		if err := s.h.ctx.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, privKey); err != nil {
+			return err
+		}
+		sig, err = s.h.ctx.Sign(session, data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("modify.dkim: pkcs11: %s: %w", s.label, err)
+	}
+	return sig, nil
+}
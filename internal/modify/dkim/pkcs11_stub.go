@@ -0,0 +1,41 @@
+//go:build !cgo || !pkcs11
+// +build !cgo !pkcs11
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"crypto"
+	"errors"
+)
+
+type hsm struct{}
+
+func openHSM(*pkcs11Config) (*hsm, error) {
+	return nil, errors.New("modify.dkim: maddy is built without PKCS#11 support (pkcs11 build tag)")
+}
+
+func (*hsm) signer(string) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 support is not available")
+}
+
+func (*hsm) Close() error {
+	return nil
+}
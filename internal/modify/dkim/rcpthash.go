@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// rcptHash computes the value of recipient_hash_field for the list of
+// envelope recipients.
+//
+// Recipients are normalized and sorted so the value does not depend on the
+// order of RCPT TO commands. The value is the hex-encoded SHA-256 hash of
+// recipients separated by newlines.
+func rcptHash(rcpts []string) string {
+	normRcpts := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		norm, err := address.ForLookup(rcpt)
+		if err != nil {
+			norm = rcpt
+		}
+		normRcpts = append(normRcpts, norm)
+	}
+	sort.Strings(normRcpts)
+
+	sum := sha256.Sum256([]byte(strings.Join(normRcpts, "\n")))
+	return "sha256=" + hex.EncodeToString(sum[:])
+}
+
+// checkFieldName checks that the header field name is valid as defined by
+// RFC 5322, Section 2.2.
+func checkFieldName(name string) error {
+	if name == "" {
+		return errors.New("empty field name")
+	}
+	for _, ch := range name {
+		if ch < 33 || ch > 126 || ch == ':' {
+			return errors.New("malformed field name")
+		}
+	}
+	if strings.EqualFold(name, "DKIM-Signature") {
+		return errors.New("DKIM-Signature can't be used")
+	}
+	return nil
+}
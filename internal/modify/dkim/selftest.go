@@ -0,0 +1,103 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"golang.org/x/net/idna"
+)
+
+const selfTestMsg = "From: <postmaster@%[1]s>\r\n" +
+	"To: <postmaster@%[1]s>\r\n" +
+	"Subject: DKIM self-test\r\n" +
+	"Date: Thu, 1 Jan 1970 00:00:00 +0000\r\n" +
+	"Message-Id: <selftest@%[1]s>\r\n" +
+	"\r\n" +
+	"This message is used to check that DKIM keys are usable.\r\n"
+
+// checkKeys signs a sample message using each key and verifies the signature
+// using the public key without doing any DNS lookups.
+func (m *Modifier) checkKeys(signers map[string]crypto.Signer, selectors map[string]string) error {
+	for normDomain, signer := range signers {
+		selector := m.selector
+		if selectors != nil {
+			selector = selectors[normDomain]
+		}
+		if err := m.checkKey(normDomain, selector, signer); err != nil {
+			return fmt.Errorf("modify.dkim: selftest: %s: %w", normDomain, err)
+		}
+	}
+	return nil
+}
+
+func (m *Modifier) checkKey(domain, selector string, signer crypto.Signer) error {
+	domain, err := idna.ToASCII(domain)
+	if err != nil {
+		return err
+	}
+	selector, err = idna.ToASCII(selector)
+	if err != nil {
+		return err
+	}
+	record, err := dnsRecord(signer.Public(), nil)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf(selfTestMsg, domain)
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 signer,
+		Hash:                   m.hash,
+		HeaderCanonicalization: m.headerCanon,
+		BodyCanonicalization:   m.bodyCanon,
+		HeaderKeys:             []string{"From", "To", "Subject", "Date", "Message-Id"},
+		QueryMethods:           []dkim.QueryMethod{m.queryMethod},
+	})
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+
+	recordName := selector + "._domainkey." + domain
+	verifications, err := dkim.VerifyWithOptions(&signed, &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			if name != recordName {
+				return nil, fmt.Errorf("unexpected lookup: %s", name)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if len(verifications) != 1 {
+		return fmt.Errorf("verify: expected 1 signature, got %d", len(verifications))
+	}
+	if err := verifications[0].Err; err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	return nil
+}
@@ -123,6 +123,23 @@ func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body
 	return nil
 }
 
+func (gs groupState) OnCommit(ctx context.Context) error {
+	// Hooks of all state objects are called even if one of them fails,
+	// the message is already accepted.
+
+	var lastErr error
+	for _, state := range gs.states {
+		hook, ok := state.(module.ModifierCommitHook)
+		if !ok {
+			continue
+		}
+		if err := hook.OnCommit(ctx); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 func (gs groupState) Close() error {
 	// We still try close all state objects to minimize
 	// resource leaks when Close fails for one object..
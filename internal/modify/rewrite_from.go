@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/container"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/module/modules"
+)
+
+// rewriteFrom is a module that replaces the domain of the envelope sender
+// and From header field addresses using module.Table implementation.
+//
+// Table keys are normalized domains, values are replacement domains.
+type rewriteFrom struct {
+	modName  string
+	instName string
+
+	table module.Table
+}
+
+func NewRewriteFrom(c *container.C, modName, instName string) (module.Module, error) {
+	return &rewriteFrom{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (r *rewriteFrom) Configure(inlineArgs []string, cfg *config.Map) error {
+	return modconfig.ModuleFromNode("table", inlineArgs, cfg.Block, cfg.Globals, &r.table)
+}
+
+func (r *rewriteFrom) Name() string {
+	return r.modName
+}
+
+func (r *rewriteFrom) InstanceName() string {
+	return r.instName
+}
+
+func (r *rewriteFrom) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return rewriteFromState{m: r, msgMeta: msgMeta}, nil
+}
+
+func (r *rewriteFrom) Close() error {
+	return nil
+}
+
+type rewriteFromState struct {
+	m       *rewriteFrom
+	msgMeta *module.MsgMetadata
+}
+
+func (s rewriteFromState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return s.m.rewrite(ctx, mailFrom)
+}
+
+func (s rewriteFromState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s rewriteFromState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	value := h.Get("From")
+	if value == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		// Malformed field is left as is, it is not our job to reject it.
+		return nil
+	}
+
+	changed := false
+	for _, addr := range list {
+		replaced, err := s.m.rewrite(ctx, addr.Address)
+		if err != nil {
+			return err
+		}
+		if replaced != addr.Address {
+			addr.Address = replaced
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	formatted := make([]string, 0, len(list))
+	for _, addr := range list {
+		// Display name is kept, it is re-encoded if needed.
+		formatted = append(formatted, addr.String())
+	}
+	if s.msgMeta.OriginalFromHeader == "" {
+		s.msgMeta.OriginalFromHeader = value
+	}
+	h.Set("From", strings.Join(formatted, ", "))
+	return nil
+}
+
+func (s rewriteFromState) Close() error {
+	return nil
+}
+
+// rewrite replaces the domain of the address if it is present in the table.
+// Addresses without domain (null sender, postmaster) are not changed.
+func (r *rewriteFrom) rewrite(ctx context.Context, addr string) (string, error) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return addr, nil
+	}
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return addr, nil
+	}
+
+	replacement, ok, err := r.table.Lookup(ctx, normDomain)
+	if err != nil {
+		return addr, err
+	}
+	if !ok {
+		return addr, nil
+	}
+
+	replaced := mbox + "@" + replacement
+	if !address.Valid(replaced) {
+		return addr, fmt.Errorf("refusing to replace domain with invalid value %s", replacement)
+	}
+	return replaced, nil
+}
+
+func init() {
+	modules.Register("modify.rewrite_from", NewRewriteFrom)
+}
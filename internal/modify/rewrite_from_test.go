@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package modify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/container"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testRewriteFrom(t *testing.T) *rewriteFrom {
+	t.Helper()
+
+	mod, err := NewRewriteFrom(container.New(), "modify.rewrite_from", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*rewriteFrom)
+	if err := m.Configure([]string{"dummy"}, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	m.table = testutils.Table{M: map[string]string{
+		"old.example.org": "example.org",
+	}}
+	return m
+}
+
+func TestRewriteFrom_Sender(t *testing.T) {
+	m := testRewriteFrom(t)
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, expected := range map[string]string{
+		"":                         "",
+		"postmaster":               "postmaster",
+		"test@example.com":         "test@example.com",
+		"test@old.example.org":     "test@example.org",
+		"TeSt@OLD.example.org":     "TeSt@example.org",
+		`"a b"@old.example.org`:    `"a b"@example.org`,
+		"test@sub.old.example.org": "test@sub.old.example.org",
+	} {
+		actual, err := state.RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("%s: want %s, got %s", addr, expected, actual)
+		}
+	}
+}
+
+func TestRewriteFrom_Body(t *testing.T) {
+	m := testRewriteFrom(t)
+
+	test := func(from, expected string) {
+		t.Helper()
+
+		msgMeta := &module.MsgMetadata{}
+		state, err := m.ModStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if actual := hdr.Get("From"); actual != expected {
+			t.Errorf("want %s, got %s", expected, actual)
+		}
+
+		if from == expected {
+			if msgMeta.OriginalFromHeader != "" {
+				t.Errorf("OriginalFromHeader should not be set for unchanged field, got %s", msgMeta.OriginalFromHeader)
+			}
+		} else if msgMeta.OriginalFromHeader != from {
+			t.Errorf("wrong OriginalFromHeader: want %s, got %s", from, msgMeta.OriginalFromHeader)
+		}
+	}
+
+	test("Test User <test@old.example.org>", `"Test User" <test@example.org>`)
+	test("test@old.example.org", "<test@example.org>")
+	test("Test User <test@example.com>", "Test User <test@example.com>")
+	test("A <a@old.example.org>, B <b@example.com>", `"A" <a@example.org>, "B" <b@example.com>`)
+	test("not an address", "not an address")
+}
@@ -331,6 +331,7 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	// we should put into Authentication-Results header.
 	if len(cr.mergedRes.AuthResult) != 0 {
 		header.Add("Authentication-Results", authres.Format(hostname, cr.mergedRes.AuthResult))
+		cr.msgMeta.AuthResults = cr.mergedRes.AuthResult
 	}
 
 	for field := cr.mergedRes.Header.Fields(); field.Next(); {
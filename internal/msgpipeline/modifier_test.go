@@ -19,9 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package msgpipeline
 
 import (
+	"context"
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -707,3 +710,70 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+// commitHookModifier counts OnCommit calls.
+type commitHookModifier struct {
+	commits *int
+}
+
+func (m commitHookModifier) ModStateForMsg(context.Context, *module.MsgMetadata) (module.ModifierState, error) {
+	return m, nil
+}
+
+func (commitHookModifier) RewriteSender(_ context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (commitHookModifier) RewriteRcpt(_ context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (commitHookModifier) RewriteBody(context.Context, *textproto.Header, buffer.Buffer) error {
+	return nil
+}
+
+func (m commitHookModifier) OnCommit(context.Context) error {
+	*m.commits++
+	return nil
+}
+
+func (commitHookModifier) Close() error {
+	return nil
+}
+
+func TestMsgPipeline_ModifierCommitHook(t *testing.T) {
+	commits := 0
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{commitHookModifier{commits: &commits}},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{commitHookModifier{commits: &commits}},
+				},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	if commits != 2 {
+		t.Fatalf("expected 2 OnCommit calls, got %d", commits)
+	}
+
+	commits = 0
+	target.CommitErr = errors.New("commit failed")
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if commits != 0 {
+		t.Fatalf("OnCommit should not be called if the commit fails, got %d calls", commits)
+	}
+}
@@ -409,6 +409,8 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		return err
 	}
 
+	dd.saveOriginalHeader(header)
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -432,6 +434,17 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	return nil
 }
 
+// saveOriginalHeader stores the copy of the header before modifiers are
+// applied in the message metadata, unless it was already set by a previous
+// pipeline.
+func (dd *msgpipelineDelivery) saveOriginalHeader(header textproto.Header) {
+	if dd.msgMeta.OriginalHeader != nil {
+		return
+	}
+	hdrCopy := header.Copy()
+	dd.msgMeta.OriginalHeader = &hdrCopy
+}
+
 // statusCollector wraps StatusCollector and adds reverse translation
 // of recipients for all statuses.]
 //
@@ -471,6 +484,8 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		return
 	}
 
+	dd.saveOriginalHeader(header)
+
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
 	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
@@ -507,7 +522,7 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 }
 
 func (dd *msgpipelineDelivery) Commit(ctx context.Context) error {
-	dd.close()
+	defer dd.close()
 
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Commit(ctx); err != nil {
@@ -515,9 +530,29 @@ func (dd *msgpipelineDelivery) Commit(ctx context.Context) error {
 			return err
 		}
 	}
+
+	dd.commitModifiers(ctx)
 	return nil
 }
 
+// commitModifiers runs module.ModifierCommitHook for all modifiers after the
+// message is committed.
+func (dd *msgpipelineDelivery) commitModifiers(ctx context.Context) {
+	states := []module.ModifierState{dd.globalModifiersState, dd.sourceModifiersState}
+	for _, modifiers := range dd.rcptModifiersState {
+		states = append(states, modifiers)
+	}
+	for _, state := range states {
+		hook, ok := state.(module.ModifierCommitHook)
+		if !ok {
+			continue
+		}
+		if err := hook.OnCommit(ctx); err != nil {
+			dd.log.Error("modifier commit hook failed", err)
+		}
+	}
+}
+
 func (dd *msgpipelineDelivery) close() {
 	dd.checkRunner.close()
 
@@ -92,7 +92,35 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+func (s *FSStore) ListBlobs(_ context.Context) ([]module.BlobInfo, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]module.BlobInfo, 0, len(entries))
+	for _, ent := range entries {
+		if !ent.Type().IsRegular() {
+			continue
+		}
+		info, err := ent.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		blobs = append(blobs, module.BlobInfo{Key: ent.Name(), ModTime: info.ModTime()})
+	}
+	return blobs, nil
+}
+
 func init() {
 	var _ module.BlobStore = &FSStore{}
+	var _ module.BlobLister = &FSStore{}
 	modules.Register((&FSStore{}).Name(), New)
 }
+
+// Root returns the directory where blobs are stored.
+func (s *FSStore) Root() string {
+	return s.root
+}
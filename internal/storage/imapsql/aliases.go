@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// aliasResolver expands recipient addresses using aliases_table.
+//
+// Table values are the lists of targets, either returned by LookupMulti if
+// the table supports it or separated by commas. Targets can be aliases
+// themselves.
+type aliasResolver struct {
+	table    module.Table
+	maxDepth int
+	ttl      time.Duration
+
+	cacheLck sync.Mutex
+	cache    map[string]aliasCacheEntry
+}
+
+type aliasCacheEntry struct {
+	targets []string
+	expiry  time.Time
+}
+
+func newAliasResolver(table module.Table, maxDepth int, ttl time.Duration) *aliasResolver {
+	return &aliasResolver{
+		table:    table,
+		maxDepth: maxDepth,
+		ttl:      ttl,
+		cache:    map[string]aliasCacheEntry{},
+	}
+}
+
+// lookup returns the targets of the alias. The result is nil if key is not
+// an alias.
+func (r *aliasResolver) lookup(ctx context.Context, key string) ([]string, error) {
+	if r.ttl != 0 {
+		r.cacheLck.Lock()
+		entry, ok := r.cache[key]
+		r.cacheLck.Unlock()
+		if ok && time.Now().Before(entry.expiry) {
+			return entry.targets, nil
+		}
+	}
+
+	var targets []string
+	if multi, ok := r.table.(module.MultiTable); ok {
+		vals, err := multi.LookupMulti(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			targets = append(targets, splitAliasTargets(val)...)
+		}
+	} else {
+		val, ok, err := r.table.Lookup(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			targets = splitAliasTargets(val)
+		}
+	}
+
+	if r.ttl != 0 {
+		r.cacheLck.Lock()
+		defer r.cacheLck.Unlock()
+		now := time.Now()
+		for key, entry := range r.cache {
+			if now.After(entry.expiry) {
+				delete(r.cache, key)
+			}
+		}
+		r.cache[key] = aliasCacheEntry{
+			targets: targets,
+			expiry:  now.Add(r.ttl),
+		}
+	}
+	return targets, nil
+}
+
+func splitAliasTargets(val string) []string {
+	var targets []string
+	for _, target := range strings.Split(val, ",") {
+		target = strings.TrimSpace(target)
+		if target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// expand returns the list of addresses the recipient should be delivered
+// to, following chained aliases. The result is nil if rcptTo is not an
+// alias.
+func (r *aliasResolver) expand(ctx context.Context, rcptTo string) ([]string, error) {
+	key, err := address.ForLookup(rcptTo)
+	if err != nil {
+		// Reported by the regular resolution.
+		return nil, nil
+	}
+	targets, err := r.lookup(ctx, key)
+	if err != nil {
+		return nil, aliasLookupErr(err)
+	}
+	if targets == nil {
+		return nil, nil
+	}
+
+	var (
+		result []string
+		seen   = map[string]struct{}{}
+		path   = map[string]struct{}{key: {}}
+	)
+	var walk func(targets []string, depth int) error
+	walk = func(targets []string, depth int) error {
+		for _, target := range targets {
+			key, err := address.ForLookup(target)
+			if err != nil {
+				key = target
+			}
+			if _, ok := path[key]; ok {
+				return &exterrors.SMTPError{
+					Code:         554,
+					EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+					Message:      "Alias loop detected",
+					TargetName:   "imapsql",
+					Misc: map[string]interface{}{
+						"alias": key,
+					},
+				}
+			}
+
+			next, err := r.lookup(ctx, key)
+			if err != nil {
+				return aliasLookupErr(err)
+			}
+			if next == nil {
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					result = append(result, target)
+				}
+				continue
+			}
+			if depth >= r.maxDepth {
+				return &exterrors.SMTPError{
+					Code:         554,
+					EnhancedCode: exterrors.EnhancedCode{5, 3, 5},
+					Message:      "Too many nested aliases",
+					TargetName:   "imapsql",
+					Misc: map[string]interface{}{
+						"alias": key,
+					},
+				}
+			}
+
+			path[key] = struct{}{}
+			if err := walk(next, depth+1); err != nil {
+				return err
+			}
+			delete(path, key)
+		}
+		return nil
+	}
+	if err := walk(targets, 1); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func aliasLookupErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error, try again later",
+		TargetName:   "imapsql",
+		Err:          err,
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// checkArchiveTemplate validates the archive_by_date template.
+func checkArchiveTemplate(tmpl string) error {
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			continue
+		}
+		if i+1 == len(tmpl) {
+			return errors.New("imapsql: archive_by_date: unterminated placeholder")
+		}
+		i++
+		switch tmpl[i] {
+		case 'Y', 'm', 'd', '%':
+		default:
+			return fmt.Errorf("imapsql: archive_by_date: unknown placeholder: %%%c", tmpl[i])
+		}
+	}
+	return nil
+}
+
+// formatArchiveFolder expands the archive_by_date template using the
+// specified time. Template should be validated using checkArchiveTemplate.
+func formatArchiveFolder(tmpl string, t time.Time) string {
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i+1 == len(tmpl) {
+			sb.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'Y':
+			fmt.Fprintf(&sb, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&sb, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&sb, "%02d", t.Day())
+		case '%':
+			sb.WriteByte('%')
+		}
+	}
+	return sb.String()
+}
+
+// archiveFolder returns the folder for the always_bcc copy of the message
+// according to archive_by_date. Date header field is used if it is valid,
+// receipt time otherwise.
+func (d *delivery) archiveFolder(header textproto.Header) string {
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	return d.store.backendMailbox(formatArchiveFolder(d.store.archiveByDate, date.UTC()))
+}
+
+// storeRawArchive stores the always_bcc copy of the message using the
+// header as it was before modifiers were applied (archive_raw).
+//
+// go-imap-sql shares the header between all recipients of a delivery, so a
+// separate delivery is used for the copy. It is started only after the main
+// delivery is committed since SQLite does not allow concurrent write
+// transactions. Errors are logged.
+func (d *delivery) storeRawArchive() {
+	header := d.msgMeta.OriginalHeader.Copy()
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+	userHeader := textproto.Header{}
+	userHeader.Add("Delivered-To", target.SanitizeForHeader(d.store.alwaysBcc))
+
+	archive := d.store.Back.NewDelivery()
+	if err := archive.AddRcpt(d.store.alwaysBcc, userHeader); err != nil {
+		d.store.log.Error("failed to add always_bcc recipient", err, "rcpt", d.store.logAddr(d.store.alwaysBcc), "msg_id", d.msgMeta.ID)
+		return
+	}
+	if d.store.archiveByDate != "" {
+		folder := d.archiveFolder(header)
+		d.createMailbox(d.store.alwaysBcc, folder)
+		archive.UserMailbox(d.store.alwaysBcc, folder, nil)
+	}
+	d.createMailboxes()
+	err := archive.BodyParsed(header, d.archiveBody.Len(), d.archiveBody)
+	if err == nil {
+		err = archive.Commit()
+	}
+	if err != nil {
+		d.store.log.Error("failed to store always_bcc copy", err, "rcpt", d.store.logAddr(d.store.alwaysBcc), "msg_id", d.msgMeta.ID)
+		if err := archive.Abort(); err != nil {
+			d.store.log.Error("failed to abort always_bcc delivery", err, "msg_id", d.msgMeta.ID)
+		}
+	}
+}
+
+type newMailbox struct {
+	accountName string
+	name        string
+}
+
+// createMailbox schedules the creation of the folder for the account.
+//
+// go-imap-sql starts the delivery transaction only in BodyParsed and does
+// not allow to create folders in it, so folders are created by
+// createMailboxes right before that, once all checks of the message passed.
+// If the message is rejected earlier, no folders are created.
+func (d *delivery) createMailbox(accountName, mbox string) {
+	d.newMboxes = append(d.newMboxes, newMailbox{accountName: accountName, name: mbox})
+}
+
+// createMailboxes creates folders scheduled using createMailbox.
+func (d *delivery) createMailboxes() {
+	for _, mbox := range d.newMboxes {
+		d.store.createMailbox(mbox.accountName, mbox.name)
+	}
+	d.newMboxes = nil
+}
+
+// createMailbox creates the mailbox for the account if it does not exist
+// yet, creating parent mailboxes as needed. Errors are logged.
+func (store *Storage) createMailbox(accountName, mbox string) {
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		store.log.Error("failed to create folder", err, "rcpt", store.logAddr(accountName), "folder", mbox)
+		return
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.log.Error("logout failed", err, "username", store.logAddr(accountName))
+		}
+	}()
+	if err := u.CreateMailbox(mbox); err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+		store.log.Error("failed to create folder", err, "rcpt", store.logAddr(accountName), "folder", mbox)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is an append-only log of delivery events.
+//
+// Each entry is a single line containing a JSON object.
+type auditLog struct {
+	path    string
+	maxSize int64
+
+	lck  sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	MsgID    string    `json:"msg_id"`
+	MailFrom string    `json:"mail_from,omitempty"`
+	Rcpts    []string  `json:"rcpts,omitempty"`
+	Result   string    `json:"result,omitempty"`
+}
+
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.size = info.Size()
+	return nil
+}
+
+// rotatedPath returns the unused name for the rotated log file, it is the
+// log path with the current time appended. If the file with such name
+// already exists, a counter is appended as well.
+func (l *auditLog) rotatedPath() (string, error) {
+	base := l.path + "." + time.Now().UTC().Format("20060102T150405Z")
+	path := base
+	for i := 1; ; i++ {
+		_, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		path = fmt.Sprintf("%s.%d", base, i)
+	}
+}
+
+// rotate renames the current log file using rotatedPath and starts a new
+// file. Existing rotated files are never replaced.
+//
+// If the file cannot be renamed, it is reopened and the error is returned,
+// rotation is retried on the next write.
+func (l *auditLog) rotate() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+
+	path, err := l.rotatedPath()
+	if err == nil {
+		err = os.Rename(l.path, path)
+	}
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return fmt.Errorf("imapsql: audit log rotation failed: %w", err)
+	}
+	return nil
+}
+
+// Write adds the entry to the buffer. If flush is true, buffer is written
+// to the file.
+//
+// If rotation fails, the entry is still written and the rotation error is
+// returned.
+func (l *auditLog) Write(entry auditEntry, flush bool) error {
+	entry.Time = entry.Time.UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	// Reopening failed during the previous rotation.
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	var rotateErr error
+	if l.maxSize != 0 && l.size != 0 && l.size+int64(len(line)) > l.maxSize {
+		rotateErr = l.rotate()
+		if l.f == nil {
+			return rotateErr
+		}
+	}
+
+	if _, err := l.w.Write(line); err != nil {
+		return err
+	}
+	l.size += int64(len(line))
+	if flush {
+		if err := l.w.Flush(); err != nil {
+			return err
+		}
+	}
+	return rotateErr
+}
+
+func (l *auditLog) Close() error {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// blobGCMinAge is the minimal age of an unreferenced blob for it to be
+// considered orphaned.
+//
+// Message body is written to the blob store before the transaction adding
+// the message to the database is committed, so recently created blobs may
+// belong to deliveries that are still in progress.
+var blobGCMinAge = time.Hour
+
+// FsstoreGC removes message blobs that are not referenced by the database
+// anymore (e.g. left after a crash during delivery).
+//
+// If dryRun is true, blobs are not removed, only the amount of blobs that
+// would be removed is returned.
+func (store *Storage) FsstoreGC(dryRun bool) (removed int, err error) {
+	lister, ok := store.blobStore.(module.BlobLister)
+	if !ok {
+		return 0, fmt.Errorf("imapsql: message store does not support listing of stored objects")
+	}
+
+	ctx := context.TODO()
+	cutoff := time.Now().Add(-blobGCMinAge)
+
+	// Listing is done before querying references so blobs added to the
+	// database in the meantime are not considered orphaned.
+	blobs, err := lister.ListBlobs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: list blobs: %w", err)
+	}
+
+	referenced, err := store.referencedBlobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	orphans := make([]string, 0)
+	for _, blob := range blobs {
+		if _, ok := referenced[blob.Key]; ok {
+			continue
+		}
+		// Checksums are kept as long as the object is.
+		if key, ok := strings.CutSuffix(blob.Key, checksumSuffix); ok {
+			if _, ok := referenced[key]; ok {
+				continue
+			}
+		}
+		if blob.ModTime.After(cutoff) {
+			continue
+		}
+		orphans = append(orphans, blob.Key)
+	}
+
+	if dryRun || len(orphans) == 0 {
+		return len(orphans), nil
+	}
+
+	store.log.Debugln("removing orphaned blobs:", orphans)
+	if err := store.blobStore.Delete(ctx, orphans); err != nil {
+		return 0, fmt.Errorf("imapsql: delete blobs: %w", err)
+	}
+	return len(orphans), nil
+}
+
+func (store *Storage) referencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, `SELECT id FROM extKeys`)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]struct{})
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+		}
+		referenced[key] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+	}
+	return referenced, nil
+}
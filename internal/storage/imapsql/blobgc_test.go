@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStorage_FsstoreGC(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	dir := t.TempDir()
+	blobDir := filepath.Join(dir, "messages")
+
+	mod, err := fs.New(nil, "storage.blob.fs", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Configure([]string{blobDir}, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	blobStore := mod.(module.BlobStore)
+
+	db, err := imapsql.New(sqliteprovider.MapDriverName("sqlite3"), filepath.Join(dir, "imapsql.db"),
+		ExtBlobStore{Base: blobStore}, imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	store := &Storage{
+		Back:      db,
+		instName:  "test",
+		log:       testutils.Logger(t, "imapsql"),
+		blobStore: blobStore,
+		junkMbox:  "Junk",
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	writeBlob := func(key string, mtime time.Time) {
+		t.Helper()
+		path := filepath.Join(blobDir, key)
+		if err := os.WriteFile(path, []byte("orphan"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBlob("orphan-old", time.Now().Add(-2*time.Hour))
+	writeBlob("orphan-new", time.Now())
+
+	blobCount := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(blobDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	if count := blobCount(); count != 3 {
+		t.Fatalf("expected 3 blobs before GC, got %d", count)
+	}
+
+	removed, err := store.FsstoreGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("dry run: expected 1 orphaned blob, got %d", removed)
+	}
+	if count := blobCount(); count != 3 {
+		t.Errorf("dry run should not remove blobs, got %d blobs", count)
+	}
+
+	removed, err = store.FsstoreGC(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 removed blob, got %d", removed)
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, "orphan-old")); !os.IsNotExist(err) {
+		t.Error("old orphaned blob was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, "orphan-new")); err != nil {
+		t.Error("recently created blob should not be removed:", err)
+	}
+	if count := blobCount(); count != 2 {
+		t.Errorf("expected 2 blobs after GC, got %d", count)
+	}
+}
+
+func TestStorage_VerifyIntegrity(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	dir := t.TempDir()
+	blobDir := filepath.Join(dir, "messages")
+
+	mod, err := fs.New(nil, "storage.blob.fs", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Configure([]string{blobDir}, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	blobStore := mod.(module.BlobStore)
+
+	store := &Storage{
+		instName:       "test",
+		log:            testutils.Logger(t, "imapsql"),
+		blobStore:      blobStore,
+		storeChecksums: true,
+		junkMbox:       "Junk",
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+	store.Back, err = imapsql.New(sqliteprovider.MapDriverName("sqlite3"), filepath.Join(dir, "imapsql.db"),
+		store.extStore(), imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Back.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	corrupted, err := store.VerifyIntegrity("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 0 {
+		t.Errorf("unexpected corrupted objects: %v", corrupted)
+	}
+
+	referenced, err := store.referencedBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	var key string
+	for key = range referenced {
+		for _, name := range []string{key, key + checksumSuffix} {
+			if err := os.Chtimes(filepath.Join(blobDir, name), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Checksums of referenced objects are not orphaned.
+	removed, err := store.FsstoreGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("expected no orphaned blobs, got %d", removed)
+	}
+
+	f, err := os.OpenFile(filepath.Join(blobDir, key), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("x"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	corrupted, err = store.VerifyIntegrity("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != key {
+		t.Errorf("expected %s to be reported, got %v", key, corrupted)
+	}
+
+	if _, err := store.VerifyIntegrity("nonexistent@example.org"); err == nil {
+		t.Error("expected an error for non-existent account")
+	}
+}
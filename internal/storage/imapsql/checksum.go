@@ -0,0 +1,210 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// checksumSuffix is appended to the object key to get the key of the object
+// containing its SHA-256 checksum.
+const checksumSuffix = ".sha256"
+
+// checksumStore is imapsql.ExternalStore that stores the SHA-256 checksum of
+// each created object in the blob store next to it.
+//
+// Checksums are computed over the bytes stored in the blob store, i.e. after
+// compression and encryption.
+type checksumStore struct {
+	Base  imapsql.ExternalStore
+	blobs module.BlobStore
+	log   *log.Logger
+}
+
+func (c checksumStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	obj, err := c.Base.Create(key, objSize)
+	if err != nil {
+		return nil, err
+	}
+	return &checksummingObj{
+		ExtStoreObj: obj,
+		store:       c,
+		key:         key,
+		h:           sha256.New(),
+	}, nil
+}
+
+func (c checksumStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	return c.Base.Open(key)
+}
+
+func (c checksumStore) Delete(keys []string) error {
+	if err := c.Base.Delete(keys); err != nil {
+		return err
+	}
+	sums := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sums = append(sums, key+checksumSuffix)
+	}
+	if err := c.blobs.Delete(context.TODO(), sums); err != nil {
+		c.log.Error("failed to delete checksums", err)
+	}
+	return nil
+}
+
+type checksummingObj struct {
+	imapsql.ExtStoreObj
+
+	store  checksumStore
+	key    string
+	h      hash.Hash
+	synced bool
+}
+
+func (o *checksummingObj) Write(p []byte) (int, error) {
+	n, err := o.ExtStoreObj.Write(p)
+	o.h.Write(p[:n])
+	return n, err
+}
+
+func (o *checksummingObj) Sync() error {
+	if err := o.ExtStoreObj.Sync(); err != nil {
+		return err
+	}
+	o.synced = true
+	return nil
+}
+
+// Close writes the checksum object. go-imap-sql may write remaining
+// compressed data after Sync, so it is not done there. Objects that were
+// not synced are being discarded and get no checksum.
+func (o *checksummingObj) Close() error {
+	if err := o.ExtStoreObj.Close(); err != nil {
+		return err
+	}
+	if !o.synced {
+		return nil
+	}
+
+	sum := hex.EncodeToString(o.h.Sum(nil))
+	blob, err := o.store.blobs.Create(context.TODO(), o.key+checksumSuffix, int64(len(sum)))
+	if err == nil {
+		_, err = io.WriteString(blob, sum)
+		if err == nil {
+			err = blob.Sync()
+		}
+		if closeErr := blob.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		o.store.log.Error("failed to store checksum", err, "key", o.key)
+	}
+	return nil
+}
+
+// VerifyIntegrity checks stored message bodies of the account against
+// checksums written when they were stored (store_checksums) and returns keys
+// of objects that are missing, can't be read or have a different checksum.
+//
+// Objects without a stored checksum are skipped.
+func (store *Storage) VerifyIntegrity(accountName string) ([]string, error) {
+	ctx := context.TODO()
+	db := store.Back.DB
+
+	var uid uint64
+	err := db.QueryRowContext(ctx, rebindQuery(store.driver, `SELECT id FROM users WHERE username = ?`),
+		strings.ToLower(accountName)).Scan(&uid)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, imapsql.ErrUserDoesntExists
+		}
+		return nil, fmt.Errorf("imapsql: query account: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, rebindQuery(store.driver, `SELECT id FROM extKeys WHERE uid = ?`), uid)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: query blob references: %w", err)
+	}
+
+	var corrupted []string
+	for _, key := range keys {
+		if err := store.verifyBlob(ctx, key); err != nil {
+			store.log.Msg("integrity check failed", "key", key, "username", store.logAddr(accountName), "reason", err.Error())
+			corrupted = append(corrupted, key)
+		}
+	}
+	return corrupted, nil
+}
+
+// verifyBlob compares the checksum of the stored object with the stored
+// one. nil is returned if there is no stored checksum.
+func (store *Storage) verifyBlob(ctx context.Context, key string) error {
+	sumBlob, err := store.blobStore.Open(ctx, key+checksumSuffix)
+	if err != nil {
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			return nil
+		}
+		return fmt.Errorf("open checksum: %w", err)
+	}
+	expected, err := io.ReadAll(io.LimitReader(sumBlob, sha256.Size*2+1))
+	sumBlob.Close()
+	if err != nil {
+		return fmt.Errorf("read checksum: %w", err)
+	}
+
+	blob, err := store.blobStore.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("open object: %w", err)
+	}
+	defer blob.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, blob); err != nil {
+		return fmt.Errorf("read object: %w", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != string(expected) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
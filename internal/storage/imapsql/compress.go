@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// gzipCompression implements imapsql.CompressionAlgo using compress/gzip.
+//
+// go-imap-sql ships only lz4 and zstd, gzip is registered by maddy.
+type gzipCompression struct{}
+
+func (gzipCompression) WrapCompress(w io.Writer, params string) (io.WriteCloser, error) {
+	level := gzip.DefaultCompression
+	if params != "" {
+		var err error
+		level, err = strconv.Atoi(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCompression) WrapDecompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// checkCompressionLevel checks whether the level is valid for the
+// algorithm. Only gzip levels are checked.
+func checkCompressionLevel(algo string, level int) error {
+	if algo == "gzip" && (level < gzip.HuffmanOnly || level > gzip.BestCompression) {
+		return fmt.Errorf("imapsql: gzip compression level should be in range %d..%d", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+// lz4Compression and zstdCompression are the same as implementations in
+// go-imap-sql, they are needed to wrap them in flushingCompression.
+type lz4Compression struct{}
+
+func (lz4Compression) WrapCompress(w io.Writer, params string) (io.WriteCloser, error) {
+	lz4w := lz4.NewWriter(w)
+	if params != "" {
+		var err error
+		lz4w.CompressionLevel, err = strconv.Atoi(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lz4w, nil
+}
+
+func (lz4Compression) WrapDecompress(r io.Reader) (io.Reader, error) {
+	return lz4.NewReader(r), nil
+}
+
+type zstdCompression struct{}
+
+func (zstdCompression) WrapCompress(w io.Writer, params string) (io.WriteCloser, error) {
+	encoderLvl := zstd.SpeedDefault
+	if params != "" {
+		zstdLevel, err := strconv.Atoi(params)
+		if err != nil {
+			return nil, err
+		}
+		encoderLvl = zstd.EncoderLevelFromZstd(zstdLevel)
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLvl))
+}
+
+func (zstdCompression) WrapDecompress(r io.Reader) (io.Reader, error) {
+	return zstd.NewReader(r)
+}
+
+// flushingCompression wraps the compression algorithm so the compressor is
+// closed by Sync of the object it writes to, see flushingStore.
+type flushingCompression struct {
+	imapsql.CompressionAlgo
+}
+
+func (c flushingCompression) WrapCompress(w io.Writer, params string) (io.WriteCloser, error) {
+	cw, err := c.CompressionAlgo.WrapCompress(w, params)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := w.(*flushingObj)
+	if !ok {
+		return cw, nil
+	}
+	compressor := &onceCloser{WriteCloser: cw}
+	obj.compressor = compressor
+	return compressor, nil
+}
+
+// onceCloser makes Close of the compressor idempotent, go-imap-sql closes
+// it again after Sync.
+type onceCloser struct {
+	io.WriteCloser
+	closed bool
+	err    error
+}
+
+func (c *onceCloser) Close() error {
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+	c.err = c.WriteCloser.Close()
+	return c.err
+}
+
+// flushingStore is imapsql.ExternalStore that closes the compression writer
+// in Sync of the created object.
+//
+// go-imap-sql calls ExtStoreObj.Sync before it closes the compression
+// writer and discards the Close error. Remaining compressed data would be
+// written after Sync and write errors would be lost, so the delivery could
+// be committed with a truncated object.
+type flushingStore struct {
+	imapsql.ExternalStore
+}
+
+func (s flushingStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	obj, err := s.ExternalStore.Create(key, objSize)
+	if err != nil {
+		return nil, err
+	}
+	return &flushingObj{ExtStoreObj: obj}, nil
+}
+
+type flushingObj struct {
+	imapsql.ExtStoreObj
+
+	// Set by flushingCompression if the object is written via a compressor.
+	compressor io.Closer
+}
+
+func (o *flushingObj) Sync() error {
+	if o.compressor != nil {
+		if err := o.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return o.ExtStoreObj.Sync()
+}
+
+func init() {
+	imapsql.RegisterCompressionAlgo("gzip", flushingCompression{gzipCompression{}})
+	imapsql.RegisterCompressionAlgo("lz4", flushingCompression{lz4Compression{}})
+	imapsql.RegisterCompressionAlgo("zstd", flushingCompression{zstdCompression{}})
+}
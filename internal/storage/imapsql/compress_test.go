@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGzipCompression(t *testing.T) {
+	for _, params := range []string{"", "1", "9"} {
+		var compressed bytes.Buffer
+		w, err := gzipCompression{}.WrapCompress(&compressed, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := strings.Repeat("Hello, world!\r\n", 100)
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := gzipCompression{}.WrapDecompress(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decompressed) != data {
+			t.Errorf("round-trip mismatch for params %q", params)
+		}
+	}
+
+	if _, err := (gzipCompression{}).WrapCompress(io.Discard, "not-a-number"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
+
+func TestCheckCompressionLevel(t *testing.T) {
+	for _, level := range []int{-2, 0, 9} {
+		if err := checkCompressionLevel("gzip", level); err != nil {
+			t.Errorf("unexpected error for gzip level %d: %v", level, err)
+		}
+	}
+	for _, level := range []int{-3, 10, 22} {
+		if err := checkCompressionLevel("gzip", level); err == nil {
+			t.Errorf("expected error for gzip level %d", level)
+		}
+	}
+	if err := checkCompressionLevel("zstd", 22); err != nil {
+		t.Errorf("unexpected error for zstd: %v", err)
+	}
+}
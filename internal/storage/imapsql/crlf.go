@@ -0,0 +1,114 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// crlfReader converts bare LF line endings to CRLF.
+type crlfReader struct {
+	io.Closer
+	br *bufio.Reader
+
+	prevCR    bool
+	pendingLF bool
+}
+
+func (cr *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if cr.pendingLF {
+			p[n] = '\n'
+			n++
+			cr.pendingLF = false
+			cr.prevCR = false
+			continue
+		}
+
+		b, err := cr.br.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b == '\n' && !cr.prevCR {
+			p[n] = '\r'
+			n++
+			cr.pendingLF = true
+			continue
+		}
+		p[n] = b
+		n++
+		cr.prevCR = b == '\r'
+	}
+	return n, nil
+}
+
+// crlfBuffer is a buffer.Buffer that returns the underlying buffer contents
+// with bare LF line endings converted to CRLF.
+type crlfBuffer struct {
+	buffer.Buffer
+	length int
+}
+
+func (cb crlfBuffer) Open() (io.ReadCloser, error) {
+	r, err := cb.Buffer.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &crlfReader{Closer: r, br: bufio.NewReader(r)}, nil
+}
+
+func (cb crlfBuffer) Len() int {
+	return cb.length
+}
+
+// normalizeCRLF returns the buffer with bare LF line endings converted to
+// CRLF. The body is returned as is if it does not contain bare LFs.
+func normalizeCRLF(body buffer.Buffer) (buffer.Buffer, error) {
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	bareLFs := 0
+	prevCR := false
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b == '\n' && !prevCR {
+			bareLFs++
+		}
+		prevCR = b == '\r'
+	}
+	if bareLFs == 0 {
+		return body, nil
+	}
+
+	return crlfBuffer{Buffer: body, length: body.Len() + bareLFs}, nil
+}
@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+func TestNormalizeCRLF(t *testing.T) {
+	for in, expected := range map[string]string{
+		"":                  "",
+		"foo\r\nbar\r\n":    "foo\r\nbar\r\n",
+		"foo\nbar\n":        "foo\r\nbar\r\n",
+		"foo\r\nbar\n\n":    "foo\r\nbar\r\n\r\n",
+		"\n":                "\r\n",
+		"foo\rbar\n":        "foo\rbar\r\n",
+		"foo\r\r\nbar\nbaz": "foo\r\r\nbar\r\nbaz",
+	} {
+		body, err := normalizeCRLF(buffer.MemoryBuffer{Slice: []byte(in)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Len() != len(expected) {
+			t.Errorf("%q: expected length %d, got %d", in, len(expected), body.Len())
+		}
+
+		r, err := body.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("%q: expected %q, got %q", in, expected, out)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
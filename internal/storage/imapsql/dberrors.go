@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// isConnError reports whether err is caused by the database server being
+// unreachable rather than by the request itself.
+func isConnError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1053, // ER_SERVER_SHUTDOWN
+			1927, // ER_CONNECTION_KILLED
+			2006, // CR_SERVER_GONE_ERROR
+			2013: // CR_SERVER_LOST
+			return true
+		}
+	}
+	// Reported as a plain error by some proxies and older servers.
+	if msg := strings.ToLower(err.Error()); strings.Contains(msg, "server has gone away") ||
+		strings.Contains(msg, "lost connection to mysql server") {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 - Connection Exception.
+		// 57P01 - admin_shutdown, 57P02 - crash_shutdown,
+		// 57P03 - cannot_connect_now.
+		switch {
+		case pqErr.Code.Class() == "08":
+			return true
+		case pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03":
+			return true
+		}
+	}
+	return false
+}
+
+// wrapConnError converts database connection failures into a temporary SMTP
+// error so the message is retried later instead of being bounced.
+//
+// Other errors (including ones that are already SMTP errors) are returned
+// as is.
+func wrapConnError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		return err
+	}
+	if !isConnError(err) {
+		return err
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Storage is temporarily unavailable, try again later",
+		TargetName:   "imapsql",
+		Err:          err,
+	}
+}
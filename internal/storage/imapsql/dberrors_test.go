@@ -0,0 +1,138 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestWrapConnError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		conn bool
+	}{
+		{err: fmt.Errorf("AddRcpt: %w", driver.ErrBadConn), conn: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, conn: true},
+		{err: fmt.Errorf("Commit: %w", syscall.ECONNRESET), conn: true},
+		{err: &pq.Error{Code: "08006"}, conn: true},
+		{err: &pq.Error{Code: "57P01"}, conn: true},
+		{err: &pq.Error{Code: "23505"}},
+		{err: fmt.Errorf("Commit: %w", &mysql.MySQLError{Number: 2006, Message: "MySQL server has gone away"}), conn: true},
+		{err: &mysql.MySQLError{Number: 1927, Message: "Connection was killed"}, conn: true},
+		{err: errors.New("Error 2006: MySQL server has gone away"), conn: true},
+		{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}},
+		{err: errors.New("something else")},
+	} {
+		wrapped := wrapConnError(c.err)
+		var smtpErr *exterrors.SMTPError
+		isSMTP := errors.As(wrapped, &smtpErr)
+		if c.conn {
+			if !isSMTP || smtpErr.Code != 451 {
+				t.Errorf("%v: expected 451 error, got %v", c.err, wrapped)
+			}
+			if !errors.Is(wrapped, c.err) {
+				t.Errorf("%v: original error is not wrapped", c.err)
+			}
+		} else if wrapped != c.err {
+			t.Errorf("%v: error should not be changed, got %v", c.err, wrapped)
+		}
+	}
+
+	// Errors with explicit SMTP codes are kept as is.
+	smtpErr := &exterrors.SMTPError{Code: 550, Err: driver.ErrBadConn}
+	if wrapConnError(smtpErr) != smtpErr {
+		t.Error("SMTP error should not be changed")
+	}
+	if wrapConnError(nil) != nil {
+		t.Error("nil error should stay nil")
+	}
+}
+
+// killableStore simulates the database connection being closed by the
+// server in the middle of the delivery.
+type killableStore struct {
+	imapsql.ExternalStore
+	killed bool
+}
+
+func (s *killableStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	if s.killed {
+		return nil, fmt.Errorf("create: %w", &mysql.MySQLError{Number: 2006, Message: "MySQL server has gone away"})
+	}
+	return s.ExternalStore.Create(key, objSize)
+}
+
+func TestDelivery_KilledConnection(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	ext := &killableStore{ExternalStore: &imapsql.FSStore{Root: filepath.Join(dir, "messages")}}
+	db, err := imapsql.New(sqliteprovider.MapDriverName("sqlite3"), filepath.Join(dir, "imapsql.db"), ext, imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	store := &Storage{
+		Back:     db,
+		instName: "test",
+		log:      testutils.Logger(t, "imapsql"),
+		junkMbox: "Junk",
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	ext.killed = true
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected 451 error, got %v", err)
+	}
+
+	// The message is accepted on retry once the connection is restored.
+	ext.killed = false
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+}
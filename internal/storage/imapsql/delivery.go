@@ -19,68 +19,394 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"runtime/trace"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-smtp"
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tracing"
 )
 
 type addedRcpt struct {
 	rcptTo string
+
+	// Value of the Delivered-To field.
+	deliveredTo string
+
+	// Mailbox to deliver the message to if the recipient is
+	// a shared mailbox.
+	sharedMbox string
+
+	// Subaddress (detail) of the recipient address if plus_addressing is
+	// enabled.
+	detail string
 }
+
+// delivery tracks accepted and rejected recipients separately.
+//
+// Only accepted recipients are passed to the go-imap-sql delivery object
+// so a failure for one recipient does not affect others and the message
+// source can report per-recipient status (e.g. 250 for valid recipients and
+// 550 for unknown ones). Body writes a single copy of the message that is
+// shared by all accepted recipients and Commit finalizes the delivery only for
+// them.
 type delivery struct {
 	store    *Storage
 	msgMeta  *module.MsgMetadata
 	d        imapsql.Delivery
 	mailFrom string
 
-	addedRcpts map[string]addedRcpt
+	addedRcpts    map[string]addedRcpt
+	rejectedRcpts map[string]error
+
+	msgSize int64
+
+	// Accounts for which deliveryLimiter slots were acquired.
+	limited []string
+
+	// Set if dsn_target is used.
+	dsnRcpts  []dsnRcpt
+	dsnHeader textproto.Header
+	bodyErr   error
+
+	// Set if mirror_to is used.
+	mirrorHeader textproto.Header
+	mirrorBody   buffer.Buffer
+
+	// Set if archive_raw is used and the always_bcc copy should be stored.
+	archiveBody buffer.Buffer
+
+	// Folders to create right before the message is stored, see
+	// createMailbox.
+	newMboxes []newMailbox
+
+	// Set if maildir_mirror is used. The copies are written after
+	// the delivery is committed.
+	maildirHeader textproto.Header
+	maildirBody   buffer.Buffer
+
+	// Set if idempotency is used. msgIDKey is the Message-Id of the
+	// message, duplicate is set if all recipients already got it.
+	msgIDKey  string
+	duplicate bool
+
+	// Mailbox label for each recipient, see mailboxLabel.
+	mboxLabels []string
+
+	// Set if delivery_timeout is used.
+	deadline context.Context
+	cancel   context.CancelFunc
+	// Closed when the timed out operation completes and the delivery is
+	// rolled back.
+	timedOut chan struct{}
+
+	// Set once the delivery is committed or aborted.
+	finished bool
 }
 
 func (d *delivery) String() string {
 	return d.store.Name() + ":" + d.store.InstanceName()
 }
 
-func userDoesNotExist(actual error) error {
+func (store *Storage) userDoesNotExist(actual error) error {
 	return &exterrors.SMTPError{
 		Code:         501,
 		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
-		Message:      "User does not exist",
+		Message:      store.errNoUser,
 		TargetName:   "imapsql",
 		Err:          actual,
 	}
 }
 
-func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
-	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
+func (store *Storage) invalidRcpt(actual error) error {
+	return &exterrors.SMTPError{
+		Code:         501,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      store.errInvalidRcpt,
+		TargetName:   "imapsql",
+		Err:          actual,
+	}
+}
+
+// audit writes the delivery event to the audit log, if it is enabled.
+func (d *delivery) audit(event string, rcpts []string, result error, flush bool) {
+	if d.store.auditLog == nil {
+		return
+	}
 
-	accountName, err := d.store.deliveryNormalize(ctx, rcptTo)
+	resultStr := "ok"
+	if result != nil {
+		resultStr = result.Error()
+	}
+	err := d.store.auditLog.Write(auditEntry{
+		Time:     time.Now(),
+		Event:    event,
+		MsgID:    d.msgMeta.ID,
+		MailFrom: d.mailFrom,
+		Rcpts:    rcpts,
+		Result:   resultStr,
+	}, flush)
 	if err != nil {
-		return userDoesNotExist(err)
+		d.store.log.Error("failed to write audit log entry", err, "msg_id", d.msgMeta.ID)
+	}
+}
+
+// withTimeout runs f, giving up if it does not complete before the
+// delivery_timeout deadline or ctx is cancelled.
+//
+// go-imap-sql does not allow to cancel running queries, so the operation
+// continues in the background and the delivery is rolled back once it
+// completes. All further operations on the delivery fail.
+//
+// Database connection failures returned by f are converted into temporary
+// errors.
+func (d *delivery) withTimeout(ctx context.Context, f func() error) error {
+	if d.deadline == nil {
+		return wrapConnError(f())
+	}
+	if d.timedOut != nil {
+		return d.timeoutErr(nil)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f()
+	}()
+
+	var ctxErr error
+	select {
+	case err := <-errCh:
+		return wrapConnError(err)
+	case <-d.deadline.Done():
+		ctxErr = d.deadline.Err()
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	}
+
+	d.timedOut = make(chan struct{})
+	go func() {
+		<-errCh
+		if err := d.d.Abort(); err != nil {
+			d.store.log.Error("failed to abort timed out delivery", err, "msg_id", d.msgMeta.ID)
+		}
+		d.releaseLimits()
+		close(d.timedOut)
+	}()
+	return d.timeoutErr(ctxErr)
+}
+
+func (d *delivery) timeoutErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Storage operation timed out, try again later",
+		TargetName:   "imapsql",
+		Err:          err,
+	}
+}
+
+func (d *delivery) acceptedRcpts() []string {
+	rcpts := make([]string, 0, len(d.addedRcpts))
+	for rcpt := range d.addedRcpts {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+	return rcpts
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
+	ctx, span := tracing.StartSpan(ctx, d.msgMeta, "imapsql.AddRcpt")
+
+	err := d.withTimeout(ctx, func() error {
+		return d.addRcptTo(ctx, rcptTo)
+	})
+	d.audit("rcpt", []string{rcptTo}, err, false)
+	d.trackDSN(rcptTo, opts, err)
+	if d.timedOut == nil {
+		span.SetAttr("maddy.rcpt_count", len(d.addedRcpts))
+	}
+	span.End(err)
+	return err
+}
+
+func (d *delivery) addRcptTo(ctx context.Context, rcptTo string) error {
+	if d.store.aliases != nil {
+		targets, err := d.store.aliases.expand(ctx, rcptTo)
+		if err != nil {
+			return err
+		}
+		if targets != nil {
+			return d.addAliasRcpt(ctx, rcptTo, targets)
+		}
+	}
+
+	var (
+		accountName string
+		sharedMbox  string
+		shared      bool
+		err         error
+	)
+	if d.store.sharedMailboxes != nil {
+		// Shared mailbox rules take precedence over regular accounts.
+		accountName, sharedMbox, shared, err = d.store.lookupSharedMailbox(ctx, rcptTo)
+		if err != nil {
+			return err
+		}
+	}
+	var (
+		detail    string
+		rewritten bool
+	)
+	if !shared {
+		baseAddr := rcptTo
+		// RFC 5321 requires postmaster to be accepted for all
+		// domains, it is mapped to a single account by default.
+		if account, ok := d.store.postmasterRcpt(ctx, rcptTo); ok {
+			baseAddr, rewritten = account, true
+		} else if account, ok := d.store.rewriteRcpt(rcptTo); ok {
+			baseAddr, rewritten = account, true
+		} else if d.store.plusAddressing {
+			baseAddr, detail = d.store.splitDetail(rcptTo)
+		}
+		accountName, err = d.store.deliveryNormalize(ctx, baseAddr)
+		if err != nil {
+			var smtpErr *exterrors.SMTPError
+			if errors.As(err, &smtpErr) {
+				return err
+			}
+			return d.store.invalidRcpt(err)
+		}
+	}
+
+	deliveredTo := accountName
+	if detail != "" || rewritten {
+		deliveredTo = rcptTo
+	}
+	return d.addAccount(accountName, rcptTo, deliveredTo, sharedMbox, detail)
+}
+
+// addAliasRcpt adds the accounts the alias recipient is expanded into.
+//
+// Failures for individual accounts are logged, the recipient is rejected
+// only if none of them was added.
+func (d *delivery) addAliasRcpt(ctx context.Context, rcptTo string, targets []string) error {
+	var lastErr error
+	added := false
+	for _, target := range targets {
+		accountName, err := d.store.deliveryNormalize(ctx, target)
+		if err != nil {
+			var smtpErr *exterrors.SMTPError
+			if !errors.As(err, &smtpErr) {
+				err = d.store.invalidRcpt(err)
+			}
+		} else {
+			err = d.addAccount(accountName, rcptTo, rcptTo, "", "")
+		}
+		if err != nil {
+			d.store.log.Error("failed to add alias target", err, "rcpt", d.store.logAddr(rcptTo), "target", d.store.logAddr(target), "msg_id", d.msgMeta.ID)
+			lastErr = err
+			continue
+		}
+		added = true
 	}
+	if !added {
+		return lastErr
+	}
+	return nil
+}
 
+// addAccount adds the account to the delivery and records it in addedRcpts.
+//
+// Each account gets a single copy of the message since go-imap-sql delivers
+// to a single mailbox per account. If several recipient addresses resolve to
+// the same account (e.g. a shared mailbox and the owner address, or two
+// subaddresses), the first one determines the mailbox and the Delivered-To
+// field, others are accepted without changes.
+func (d *delivery) addAccount(accountName, rcptTo, deliveredTo, sharedMbox, detail string) error {
 	if _, ok := d.addedRcpts[accountName]; ok {
 		return nil
 	}
+	if err, ok := d.rejectedRcpts[accountName]; ok {
+		return err
+	}
+	if d.store.maxRcpts > 0 && len(d.addedRcpts) >= d.store.maxRcpts {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients",
+			TargetName:   "imapsql",
+			Misc: map[string]interface{}{
+				"max_rcpts": d.store.maxRcpts,
+			},
+		}
+	}
+
+	if d.store.deliveryLimiter != nil {
+		if !d.store.deliveryLimiter.TryAcquire(accountName) {
+			return &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+				Message:      "Too many concurrent deliveries for the recipient, try again later",
+				TargetName:   "imapsql",
+			}
+		}
+	}
 
+	if err := d.addRcpt(accountName, deliveredTo); err != nil {
+		if d.store.deliveryLimiter != nil {
+			d.store.deliveryLimiter.Release(accountName)
+		}
+		// Temporary errors are not remembered so the client can retry
+		// the recipient.
+		if !exterrors.IsTemporary(err) {
+			d.rejectedRcpts[accountName] = err
+		}
+		return err
+	}
+
+	if d.store.deliveryLimiter != nil {
+		d.limited = append(d.limited, accountName)
+	}
+	d.addedRcpts[accountName] = addedRcpt{
+		rcptTo:      rcptTo,
+		deliveredTo: deliveredTo,
+		sharedMbox:  sharedMbox,
+		detail:      detail,
+	}
+	return nil
+}
+
+func (d *delivery) addRcpt(accountName, deliveredTo string) error {
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
 	userHeader := textproto.Header{}
-	userHeader.Add("Delivered-To", accountName)
+	userHeader.Add("Delivered-To", target.SanitizeForHeader(deliveredTo))
 
 	if err := d.d.AddRcpt(accountName, userHeader); err != nil {
 		if errors.Is(err, imapsql.ErrUserDoesntExists) || errors.Is(err, backend.ErrNoSuchMailbox) {
-			return userDoesNotExist(err)
+			return d.store.userDoesNotExist(err)
+		}
+		if isConnError(err) {
+			// Wrapped here so the recipient is not remembered as
+			// rejected.
+			return wrapConnError(err)
 		}
 		var serializationError imapsql.SerializationError
 		if errors.As(err, &serializationError) {
@@ -94,29 +420,245 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		}
 		return err
 	}
+	return nil
+}
 
-	d.addedRcpts[accountName] = addedRcpt{
-		rcptTo: rcptTo,
+// addArchiveRcpt adds the always_bcc account to the delivery.
+//
+// The account is not added to addedRcpts so it is not visible to the rest
+// of the delivery logic and failures are not reported to the message
+// source. It returns true if the account was added.
+func (d *delivery) addArchiveRcpt() bool {
+	if d.store.alwaysBcc == "" || len(d.addedRcpts) == 0 {
+		return false
 	}
-	return nil
+	if _, ok := d.addedRcpts[d.store.alwaysBcc]; ok {
+		return false
+	}
+	if err := d.addRcpt(d.store.alwaysBcc, d.store.alwaysBcc); err != nil {
+		d.store.log.Error("failed to add always_bcc recipient", err, "rcpt", d.store.logAddr(d.store.alwaysBcc), "msg_id", d.msgMeta.ID)
+		return false
+	}
+	return true
 }
 
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
+	ctx, span := tracing.StartSpan(ctx, d.msgMeta, "imapsql.Body")
+	if d.timedOut == nil {
+		span.SetAttr("maddy.rcpt_count", len(d.addedRcpts))
+	}
+	span.SetAttr("maddy.body_size", body.Len())
+
+	hostname, err := d.hostname(ctx)
+	if err != nil {
+		span.End(err)
+		return err
+	}
+
+	if d.store.dsnTarget != nil {
+		d.dsnHeader = header.Copy()
+	}
+	if d.store.mirrorTo != nil {
+		d.mirrorHeader = header.Copy()
+	}
+	err = d.withTimeout(ctx, func() error {
+		return d.body(ctx, header, body, hostname)
+	})
+	if err == nil && d.store.mirrorTo != nil {
+		d.mirrorBody = body
+	}
+	if err != nil && !exterrors.IsTemporaryOrUnspec(err) {
+		d.bodyErr = err
+	}
+	span.End(err)
+	return err
+}
+
+// receivedField returns the value of the Received field for the final
+// delivery step.
+func (d *delivery) receivedField(hostname string) string {
+	proto := "local"
+	if d.msgMeta.Conn != nil && strings.Contains(d.msgMeta.Conn.Proto, "LMTP") {
+		proto = "LMTP"
+	}
+	if encoded, err := dns.SelectIDNA(d.msgMeta.SMTPOpts.UTF8, hostname); err == nil {
+		hostname = encoded
+	}
+	return "by " + target.SanitizeForHeader(hostname) + " with " + proto + "; " +
+		time.Now().Format(time.RFC1123Z)
+}
+
+// hostname returns the hostname to use for generated header fields. If
+// hostname_map is set, it is looked up using the TLS server name the client
+// connected to. Otherwise, if hostname_from_meta is set, the hostname of
+// the endpoint that accepted the message is used.
+func (d *delivery) hostname(ctx context.Context) (string, error) {
+	fallback := d.store.hostname
+	if d.store.hostnameFromMeta && d.msgMeta.Conn != nil && d.msgMeta.Conn.EndpointHostname != "" {
+		fallback = d.msgMeta.Conn.EndpointHostname
+	}
+
+	if d.store.hostnameMap == nil || d.msgMeta.Conn == nil {
+		return fallback, nil
+	}
+	serverName := d.msgMeta.Conn.TLS.ServerName
+	if serverName == "" {
+		return fallback, nil
+	}
+	key, err := dns.ForLookup(serverName)
+	if err != nil {
+		return fallback, nil
+	}
+
+	mapped, ok, err := d.store.hostnameMap.Lookup(ctx, key)
+	if err != nil {
+		return "", &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+	if !ok {
+		return fallback, nil
+	}
+	return mapped, nil
+}
+
+func (d *delivery) body(ctx context.Context, header textproto.Header, body buffer.Buffer, hostname string) error {
+	if d.store.maxReceivedHops > 0 {
+		hops := 0
+		for field := header.FieldsByKey("Received"); field.Next(); {
+			hops++
+		}
+		if hops > d.store.maxReceivedHops {
+			return &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Too many hops, possible mail loop",
+				TargetName:   "imapsql",
+				Misc: map[string]interface{}{
+					"hops": hops,
+				},
+			}
+		}
+	}
+
+	if d.mailFrom == "" && d.store.nullSenderMax != 0 &&
+		int64(body.Len()) > d.store.nullSenderMax && !d.hasRoleRcpt() {
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message: fmt.Sprintf("Message from null sender is too big (%d bytes, at most %d bytes allowed)",
+				body.Len(), d.store.nullSenderMax),
+			TargetName: "imapsql",
+		}
+	}
+
+	if d.store.deliveryLog != nil {
+		store, err := d.dropDuplicates(ctx, header)
+		if err != nil {
+			return err
+		}
+		if !store {
+			d.duplicate = true
+			return nil
+		}
+	}
 
-	if !d.msgMeta.Quarantine && d.store.filters != nil {
-		for rcpt, rcptData := range d.addedRcpts {
-			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
+	if d.store.normalizeCRLF {
+		var err error
+		body, err = normalizeCRLF(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// With archive_raw, the always_bcc copy is stored separately after
+	// the delivery is committed, see storeRawArchive.
+	rawArchive := d.store.archiveRaw && d.msgMeta.OriginalHeader != nil
+	if !rawArchive && d.addArchiveRcpt() && !d.msgMeta.Quarantine && d.store.archiveByDate != "" {
+		folder := d.archiveFolder(header)
+		d.createMailbox(d.store.alwaysBcc, folder)
+		d.d.UserMailbox(d.store.alwaysBcc, folder, nil)
+	}
+
+	for rcpt, rcptData := range d.addedRcpts {
+		if rcptData.sharedMbox != "" && !d.msgMeta.Quarantine {
+			d.d.UserMailbox(rcpt, d.store.backendMailbox(rcptData.sharedMbox), d.deliveryFlags())
+			d.mboxLabels = append(d.mboxLabels, "other")
+			continue
+		}
+
+		// Quarantined messages always go to the Junk or quarantine
+		// mailbox, folder overrides are not applied to them.
+		//
+		// create is set if the selected folder should be created if it
+		// does not exist. It is scheduled only once all overrides are
+		// applied, so folders that are not used are not created.
+		var (
+			folder string
+			create bool
+		)
+		if !d.msgMeta.Quarantine {
+			folder, create = d.detailFolder(rcptData.detail)
+		}
+		if !d.msgMeta.Quarantine && rcpt == d.store.alwaysBcc && d.store.archiveByDate != "" {
+			folder, create = d.archiveFolder(header), true
+		}
+		if folder == "" && !d.msgMeta.Quarantine && d.store.inboxSplit != nil {
+			folder = d.inboxShard(ctx, rcpt)
+			create = folder != ""
+		}
+		if folder == "" && !d.msgMeta.Quarantine && d.mailFrom == "" && d.store.nullSenderMbox != "" &&
+			!isRoleAddress(rcptData.rcptTo) {
+			folder, create = d.store.backendMailbox(d.store.nullSenderMbox), true
+		}
+		if !d.msgMeta.Quarantine && d.store.sieveLite != nil {
+			if sieveFolder := d.sieveFolder(rcpt, header, body.Len()); sieveFolder != "" {
+				folder, create = sieveFolder, true
+			}
+		}
+		flags := d.deliveryFlags()
+		if !d.msgMeta.Quarantine && d.store.filters != nil {
+			filterFolder, filterFlags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
 			if err != nil {
-				d.store.log.Error("IMAPFilter failed", err, "rcpt", rcpt)
-				continue
+				d.store.log.Error("IMAPFilter failed", err, "rcpt", d.store.logAddr(rcpt))
+			} else {
+				// Explicit filter decision takes precedence. Folders
+				// selected by filters are not created.
+				if filterFolder != "" {
+					folder, create = d.store.backendMailbox(filterFolder), false
+				}
+				flags = append(flags, filterFlags...)
 			}
+		}
+		if create {
+			d.createMailbox(rcpt, folder)
+		}
+		if folder != "" || flags != nil {
 			d.d.UserMailbox(rcpt, folder, flags)
 		}
+		d.mboxLabels = append(d.mboxLabels, d.mailboxLabel(folder))
 	}
 
 	if d.msgMeta.Quarantine {
-		if err := d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
+		// SpecialMailbox creates the mailbox with \Junk attribute if the
+		// recipient does not have one yet.
+		var err error
+		junkMbox, quarantineMbox := d.store.specialMailboxes()
+		if quarantineMbox != "" {
+			// Not a special-use mailbox so clients do not show it as
+			// Junk.
+			err = d.d.Mailbox(d.store.backendMailbox(quarantineMbox))
+		} else if d.store.createSpecialMboxes {
+			err = d.d.SpecialMailbox(imap.JunkAttr, d.store.backendMailbox(junkMbox))
+		} else {
+			err = d.d.Mailbox(d.store.backendMailbox(junkMbox))
+		}
+		if err != nil {
 			var serializationError imapsql.SerializationError
 			if errors.As(err, &serializationError) {
 				return &exterrors.SMTPError{
@@ -131,8 +673,80 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 		}
 	}
 
+	if d.store.validateMIME {
+		if err := validateMIME(header, body); err != nil {
+			d.store.log.Msg("malformed MIME structure", "reason", err.Error(), "msg_id", d.msgMeta.ID)
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+				Message:      "Malformed MIME structure",
+				TargetName:   "imapsql",
+				Err:          err,
+			}
+		}
+	}
+
 	header = header.Copy()
+	for _, field := range d.store.stripHeaders {
+		header.Del(field)
+	}
+	// Only for messages submitted by our users, incoming messages are
+	// stored as is.
+	if d.store.generateMsgID && !header.Has("Message-Id") &&
+		d.msgMeta.Conn != nil && d.msgMeta.Conn.AuthUser != "" {
+		id, err := module.GenerateMsgID()
+		if err != nil {
+			return err
+		}
+		header.Add("Message-Id", "<"+id+"@"+target.SanitizeForHeader(hostname)+">")
+	}
+	if d.store.addReceived {
+		// Add prepends the field, so it ends up above Received fields added
+		// by previous hops.
+		header.Add("Received", d.receivedField(hostname))
+	}
 	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+	if d.store.authHeader {
+		// Never keep the value set by the message originator.
+		header.Del("X-Authenticated-User")
+		if d.msgMeta.Conn != nil && d.msgMeta.Conn.AuthUser != "" {
+			header.Add("X-Authenticated-User", target.SanitizeForHeader(d.msgMeta.Conn.AuthUser))
+		}
+	}
+
+	if d.store.origFromHdr {
+		// Same as for X-Authenticated-User, the field is present only if
+		// the From field was actually rewritten by us.
+		header.Del("X-Original-From")
+		if d.msgMeta.OriginalFromHeader != "" {
+			header.Add("X-Original-From", target.SanitizeForHeader(d.msgMeta.OriginalFromHeader))
+		}
+	}
+
+	if d.store.storeAuthResults && len(d.msgMeta.AuthResults) != 0 &&
+		!hasAuthResults(header, hostname) {
+		header.Add("Authentication-Results",
+			target.SanitizeForHeader(authres.Format(hostname, d.msgMeta.AuthResults)))
+	}
+
+	if d.store.usageTracking || d.store.maxHeaderSize != 0 {
+		var hdrBuf bytes.Buffer
+		if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+			return err
+		}
+		if d.store.maxHeaderSize != 0 && int64(hdrBuf.Len()) > d.store.maxHeaderSize {
+			return &exterrors.SMTPError{
+				Code:         552,
+				EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+				Message: fmt.Sprintf("Message header is too big (%d bytes, at most %d bytes allowed)",
+					hdrBuf.Len(), d.store.maxHeaderSize),
+				TargetName: "imapsql",
+			}
+		}
+		d.msgSize = int64(hdrBuf.Len() + body.Len())
+	}
+
+	d.createMailboxes()
 	err := d.d.BodyParsed(header, body.Len(), body)
 	var serializationError imapsql.SerializationError
 	if errors.As(err, &serializationError) {
@@ -144,29 +758,215 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 			Err:          err,
 		}
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	if rawArchive && d.store.alwaysBcc != "" && len(d.addedRcpts) != 0 {
+		if _, ok := d.addedRcpts[d.store.alwaysBcc]; !ok {
+			d.archiveBody = body
+		}
+	}
+
+	if d.store.maildirMirror != "" {
+		d.maildirHeader = header.Copy()
+		d.maildirBody = body
+	}
+	return nil
+}
+
+// hasAuthResults checks whether the header contains Authentication-Results
+// field with the specified authserv-id.
+func hasAuthResults(header textproto.Header, authServID string) bool {
+	for field := header.FieldsByKey("Authentication-Results"); field.Next(); {
+		id, _, err := authres.Parse(field.Value())
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(id, authServID) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendMailbox converts the mailbox name using folder_separator as the
+// hierarchy separator into the form used by go-imap-sql.
+func (store *Storage) backendMailbox(name string) string {
+	if store.folderSeparator == "" || store.folderSeparator == imapsql.MailboxPathSep {
+		return name
+	}
+	return strings.ReplaceAll(name, store.folderSeparator, imapsql.MailboxPathSep)
+}
+
+// releaseLimits releases deliveryLimiter slots held by the delivery.
+func (d *delivery) releaseLimits() {
+	for _, acct := range d.limited {
+		d.store.deliveryLimiter.Release(acct)
+	}
+	d.limited = nil
+}
+
+// finish marks the delivery as no longer active.
+func (d *delivery) finish() {
+	if d.finished {
+		return
+	}
+	d.finished = true
+	d.store.activeDeliveries.Add(-1)
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
+	defer d.finish()
+
+	if d.cancel != nil {
+		defer d.cancel()
+	}
+	if d.timedOut != nil {
+		// Rolled back by withTimeout. The timed out operation might be
+		// still running, so the delivery state can't be accessed.
+		d.audit("abort", nil, nil, true)
+		return nil
+	}
+	defer d.releaseLimits()
 
-	return d.d.Abort()
+	err := d.d.Abort()
+	d.countMailboxes(false)
+	d.audit("abort", d.acceptedRcpts(), err, true)
+	d.reportDSN(false)
+	return err
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
+	ctx, span := tracing.StartSpan(ctx, d.msgMeta, "imapsql.Commit")
+	// If an operation timed out, it might be still running and the
+	// delivery state can't be accessed.
+	if d.timedOut == nil {
+		span.SetAttr("maddy.rcpt_count", len(d.addedRcpts))
+		span.SetAttr("maddy.duplicate", d.duplicate)
+	}
+
+	err := d.commit(ctx)
+	span.End(err)
+	return err
+}
+
+func (d *delivery) commit(ctx context.Context) error {
+	defer d.finish()
+
+	if d.cancel != nil {
+		defer d.cancel()
+	}
+
+	if d.duplicate && d.timedOut == nil {
+		// The message is not stored, but the success is reported so the
+		// upstream server stops retrying.
+		defer d.releaseLimits()
+		if err := d.d.Abort(); err != nil {
+			d.store.log.Error("failed to abort delivery", err, "msg_id", d.msgMeta.ID)
+		}
+		d.audit("commit", nil, nil, true)
+		return nil
+	}
 
-	return d.d.Commit()
+	if d.store.mirrorTo != nil && d.store.mirrorRequired && d.timedOut == nil {
+		// The message is stored in the mirror first so nothing is
+		// committed if it fails. If our commit fails afterwards, the
+		// client retries and the mirror gets a duplicate.
+		if err := d.mirror(ctx); err != nil {
+			d.store.log.Error("mirror delivery failed", err, "msg_id", d.msgMeta.ID)
+			err = d.mirrorErr(err)
+			defer d.releaseLimits()
+			if abortErr := d.d.Abort(); abortErr != nil {
+				d.store.log.Error("failed to abort delivery", abortErr, "msg_id", d.msgMeta.ID)
+			}
+			d.countMailboxes(false)
+			d.audit("commit", d.acceptedRcpts(), err, true)
+			return err
+		}
+	}
+
+	err := d.withTimeout(ctx, d.d.Commit)
+	if d.timedOut != nil {
+		d.audit("commit", nil, err, true)
+		return err
+	}
+	defer d.releaseLimits()
+	d.countMailboxes(err == nil)
+	if err != nil {
+		d.audit("commit", d.acceptedRcpts(), err, true)
+		return err
+	}
+	d.audit("commit", d.acceptedRcpts(), nil, true)
+	d.reportDSN(true)
+
+	if d.store.deliveryLog != nil {
+		d.recordDelivered(ctx)
+	}
+
+	if d.archiveBody != nil {
+		d.storeRawArchive()
+	}
+
+	if d.maildirBody != nil {
+		for rcpt := range d.addedRcpts {
+			if err := mirrorToMaildir(d.store.maildirMirror, rcpt, d.maildirHeader, d.maildirBody); err != nil {
+				d.store.log.Error("failed to write Maildir copy", err, "rcpt", d.store.logAddr(rcpt), "msg_id", d.msgMeta.ID)
+			}
+		}
+	}
+
+	if d.store.mirrorTo != nil && !d.store.mirrorRequired {
+		if err := d.mirror(ctx); err != nil {
+			d.store.log.Error("mirror delivery failed", err, "msg_id", d.msgMeta.ID)
+		}
+	}
+
+	if d.store.usageTracking && d.store.usageSink != nil {
+		for rcpt := range d.addedRcpts {
+			if err := d.store.usageSink.RecordUsage(ctx, rcpt, 1, d.msgSize); err != nil {
+				d.store.log.Error("failed to record usage", err, "rcpt", d.store.logAddr(rcpt), "msg_id", d.msgMeta.ID)
+			}
+		}
+	}
+	return nil
 }
 
 func (store *Storage) StartDelivery(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
 	defer trace.StartRegion(ctx, "sql/StartDelivery").End()
+	ctx, span := tracing.StartSpan(ctx, msgMeta, "imapsql.StartDelivery")
 
-	return &delivery{
-		store:      store,
-		msgMeta:    msgMeta,
-		mailFrom:   mailFrom,
-		d:          store.Back.NewDelivery(),
-		addedRcpts: map[string]addedRcpt{},
-	}, nil
+	if store.validateConns {
+		// Ping makes database/sql discard pooled connections that were
+		// closed by the server.
+		if err := store.Back.DB.PingContext(ctx); err != nil {
+			err = &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Storage is temporarily unavailable, try again later",
+				TargetName:   "imapsql",
+				Err:          err,
+			}
+			span.End(err)
+			return nil, err
+		}
+	}
+
+	d := &delivery{
+		store:         store,
+		msgMeta:       msgMeta,
+		mailFrom:      mailFrom,
+		d:             store.Back.NewDelivery(),
+		addedRcpts:    map[string]addedRcpt{},
+		rejectedRcpts: map[string]error{},
+	}
+	if store.deliveryTimeout != 0 {
+		d.deadline, d.cancel = context.WithTimeout(context.Background(), store.deliveryTimeout)
+	}
+	store.activeDeliveries.Add(1)
+	d.audit("start", nil, nil, false)
+	span.End(nil)
+	return d, nil
 }
@@ -0,0 +1,2229 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return newTestStorageExt(t, &imapsql.FSStore{Root: filepath.Join(dir, "messages")}, imapsql.Opts{})
+}
+
+// newTestStorageExt is newTestStorage that uses the specified external store
+// for message bodies.
+func newTestStorageExt(t *testing.T, ext imapsql.ExternalStore, opts imapsql.Opts) *Storage {
+	t.Helper()
+
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	db, err := imapsql.New(sqliteprovider.MapDriverName("sqlite3"), filepath.Join(t.TempDir(), "imapsql.db"),
+		ext, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &Storage{
+		Back:                db,
+		instName:            "test",
+		log:                 testutils.Logger(t, "imapsql"),
+		junkMbox:            "Junk",
+		createSpecialMboxes: true,
+		errNoUser:           "User does not exist",
+		errInvalidRcpt:      "User does not exist",
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+}
+
+func TestDelivery_QuarantineCreatesJunk(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, mbox := range mboxes {
+		if mbox.Name != "Junk" {
+			continue
+		}
+		found = true
+
+		hasAttr := false
+		for _, attr := range mbox.Attributes {
+			if attr == imap.JunkAttr {
+				hasAttr = true
+			}
+		}
+		if !hasAttr {
+			t.Errorf("Junk mailbox is missing %s attribute: %v", imap.JunkAttr, mbox.Attributes)
+		}
+	}
+	if !found {
+		t.Fatal("Junk mailbox was not created")
+	}
+
+	status, err := u.(*imapsql.User).Status("Junk", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in Junk, got %d", status.Messages)
+	}
+}
+
+func TestDelivery_QuarantineMailbox(t *testing.T) {
+	store := newTestStorage(t)
+	store.quarantineMbox = "Quarantine"
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mbox := range mboxes {
+		if mbox.Name == "Junk" {
+			t.Error("Junk mailbox should not be created")
+		}
+		if mbox.Name != "Quarantine" {
+			continue
+		}
+		found = true
+		for _, attr := range mbox.Attributes {
+			if attr == imap.JunkAttr {
+				t.Errorf("Quarantine mailbox should not have %s attribute", imap.JunkAttr)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Quarantine mailbox was not created")
+	}
+
+	status, err := u.(*imapsql.User).Status("Quarantine", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in Quarantine, got %d", status.Messages)
+	}
+}
+
+func TestDelivery_PartialRcptFailure(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := dlv.AddRcpt(context.Background(), "nonexistent@example.org", smtp.RcptOptions{})
+		if err == nil {
+			t.Fatal("expected AddRcpt to fail for non-existent user")
+		}
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 501 || smtpErr.Message != store.errNoUser {
+			t.Errorf("unexpected error for non-existent user: %v", err)
+		}
+	}
+	if added := dlv.(*delivery).addedRcpts; len(added) != 1 {
+		t.Errorf("expected 1 accepted recipient, got %v", added)
+	}
+
+	hdr, body := testutils.BodyFromStr(t, "From: <sender@example.org>\r\n\r\nHello!\r\n")
+	if err := dlv.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in INBOX, got %d", status.Messages)
+	}
+}
+
+func TestDelivery_CustomErrorMessages(t *testing.T) {
+	store := newTestStorage(t)
+	store.errNoUser = "Recipient rejected"
+	store.errInvalidRcpt = "Bad recipient"
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) {
+		if s == "invalid" {
+			return "", errors.New("normalization failed")
+		}
+		return s, nil
+	}
+
+	delivery, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivery.Abort(context.Background())
+
+	for rcpt, expected := range map[string]string{
+		"nonexistent@example.org": "Recipient rejected",
+		"invalid":                 "Bad recipient",
+	} {
+		err := delivery.AddRcpt(context.Background(), rcpt, smtp.RcptOptions{})
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) {
+			t.Fatalf("expected SMTPError for %s, got %v", rcpt, err)
+		}
+		if smtpErr.Message != expected {
+			t.Errorf("wrong message for %s: want %q, got %q", rcpt, expected, smtpErr.Message)
+		}
+		if smtpErr.Code != 501 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 1, 1}) {
+			t.Errorf("wrong code for %s: %d %v", rcpt, smtpErr.Code, smtpErr.EnhancedCode)
+		}
+	}
+}
+
+type failingUsageSink struct{}
+
+func (failingUsageSink) RecordUsage(context.Context, string, int, int64) error {
+	return errors.New("sink failure")
+}
+
+func TestDelivery_UsageTracking(t *testing.T) {
+	store := newTestStorage(t)
+	store.usageTracking = true
+	store.driver = sqliteprovider.MapDriverName("sqlite3")
+	sink, err := newSQLUsageSink(store.Back.DB, store.driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.usageSink = sink
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	var (
+		messages int
+		bytes    int64
+	)
+	err = store.Back.DB.QueryRow(`SELECT messages, bytes FROM maddy_usage WHERE account = ?`, "test@example.org").
+		Scan(&messages, &bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages != 2 {
+		t.Errorf("expected 2 messages, got %d", messages)
+	}
+	if bytes == 0 {
+		t.Error("expected non-zero byte count")
+	}
+
+	// Sink errors should not fail the delivery.
+	store.usageSink = failingUsageSink{}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+}
+
+func TestDelivery_MaildirMirror(t *testing.T) {
+	store := newTestStorage(t)
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	files, err := os.ReadDir(filepath.Join(store.maildirMirror, "test@example.org", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 message in Maildir, got %d", len(files))
+	}
+	blob, err := os.ReadFile(filepath.Join(store.maildirMirror, "test@example.org", "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(blob), "Return-Path: <sender@example.org>") {
+		t.Errorf("Return-Path is missing in the Maildir copy:\n%s", blob)
+	}
+
+	tmpFiles, err := os.ReadDir(filepath.Join(store.maildirMirror, "test@example.org", "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("tmp is not empty: %v", tmpFiles)
+	}
+
+	// Aborted delivery should not leave a copy.
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := testutils.BodyFromStr(t, "From: <sender@example.org>\r\n\r\nHello!\r\n")
+	if err := dlv.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	files, err = os.ReadDir(filepath.Join(store.maildirMirror, "test@example.org", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected 1 message in Maildir after abort, got %d", len(files))
+	}
+}
+
+func TestDelivery_StripHeaders(t *testing.T) {
+	store := newTestStorage(t)
+	store.stripHeaders = []string{"x-spam-score", "Return-Path"}
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := testutils.BodyFromStr(t, "From: <sender@example.org>\r\n"+
+		"X-Spam-Score: 10\r\n"+
+		"Return-Path: <forged@example.org>\r\n"+
+		"\r\n"+
+		"Hello!\r\n")
+	if err := dlv.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !hdr.Has("X-Spam-Score") {
+		t.Error("original header should not be modified")
+	}
+
+	dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(files))
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(blob)
+	if strings.Contains(msg, "X-Spam-Score") {
+		t.Error("X-Spam-Score should be removed")
+	}
+	if strings.Contains(msg, "forged@example.org") {
+		t.Error("original Return-Path should be removed")
+	}
+	if !strings.Contains(msg, "Return-Path: <sender@example.org>") {
+		t.Error("Return-Path should be added")
+	}
+}
+
+func TestDelivery_AuthHeader(t *testing.T) {
+	store := newTestStorage(t)
+	store.authHeader = true
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	readLast := func() string {
+		t.Helper()
+		dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := os.ReadFile(filepath.Join(dir, files[len(files)-1].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, files[len(files)-1].Name())); err != nil {
+			t.Fatal(err)
+		}
+		return string(blob)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Conn: &module.ConnState{AuthUser: "user\r\nX-Injected: 1"}})
+	msg := readLast()
+	if !strings.Contains(msg, "X-Authenticated-User: user") {
+		t.Errorf("X-Authenticated-User is missing:\n%s", msg)
+	}
+	if strings.Contains(msg, "\r\nX-Injected") {
+		t.Errorf("header injection is possible:\n%s", msg)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Conn: &module.ConnState{}})
+	if msg := readLast(); strings.Contains(msg, "X-Authenticated-User") {
+		t.Errorf("X-Authenticated-User should not be added for unauthenticated sessions:\n%s", msg)
+	}
+}
+
+func TestDelivery_OriginalFromHeader(t *testing.T) {
+	store := newTestStorage(t)
+	store.origFromHdr = true
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{OriginalFromHeader: "Sender <sender@old.example.org>"})
+
+	dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(files))
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(blob), "X-Original-From: Sender <sender@old.example.org>") {
+		t.Errorf("X-Original-From is missing:\n%s", blob)
+	}
+}
+
+func TestDelivery_AuditLog(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	store.auditLog, err = openAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org", "nonexistent@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if err := store.auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(blob)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, entry.Event+":"+strings.Join(entry.Rcpts, ",")+":"+strings.SplitN(entry.Result, " ", 2)[0])
+	}
+	expected := []string{
+		"start::ok",
+		"rcpt:test@example.org:ok",
+		"rcpt:nonexistent@example.org:imap:",
+		"abort:test@example.org:ok",
+		"start::ok",
+		"rcpt:test@example.org:ok",
+		"commit:test@example.org:ok",
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wrong audit log entries\nwant: %v\ngot:  %v", expected, events)
+	}
+}
+
+func TestAuditLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.Write(auditEntry{Event: "start", MsgID: "test"}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// All rotations happen within the same second, rotated files should not
+	// replace each other.
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Errorf("expected at least 3 files, got %v", files)
+	}
+	entries := 0
+	for _, p := range files {
+		blob, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blob) > 200 {
+			t.Errorf("%s is bigger than the limit: %d", p, len(blob))
+		}
+		entries += strings.Count(string(blob), "\n")
+	}
+	if entries != 10 {
+		t.Errorf("expected 10 entries in all files, got %d", entries)
+	}
+}
+
+func TestDelivery_MaxHeaderSize(t *testing.T) {
+	store := newTestStorage(t)
+	store.maxHeaderSize = 100
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlv.Abort(context.Background())
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := testutils.BodyFromStr(t, "From: <sender@example.org>\r\n"+
+		"Subject: "+strings.Repeat("A", 100)+"\r\n"+
+		"\r\n"+
+		"Hello!\r\n")
+	err = dlv.Body(context.Background(), hdr, body)
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatalf("expected 552 error, got %v", err)
+	}
+}
+
+func TestDelivery_SharedMailboxes(t *testing.T) {
+	store := newTestStorage(t)
+	store.sharedMailboxes = testutils.Table{M: map[string]string{
+		"team@example.org":   "test@example.org/Team",
+		"broken@example.org": "test@example.org",
+	}}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Team"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"team@example.org"})
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"team@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+
+	for mbox, expected := range map[string]uint32{"Team": 1, "INBOX": 0, "Junk": 1} {
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, status.Messages)
+		}
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"broken@example.org"}); err == nil {
+		t.Error("expected error for malformed shared_mailboxes value")
+	}
+}
+
+// Recipient addresses resolving to the same account share a single copy
+// stored in the mailbox for the first recipient.
+func TestDelivery_SameAccountRcpts(t *testing.T) {
+	store := newTestStorage(t)
+	store.plusAddressing = true
+	store.detailSeparator = "+"
+	store.sharedMailboxes = testutils.Table{M: map[string]string{
+		"team@example.org": "test@example.org/Team",
+	}}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mbox := range []string{"Team", "lists", "other"} {
+		if err := u.CreateMailbox(mbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"team@example.org", "test@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org", "team@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+lists@example.org", "test+other@example.org"})
+
+	for mbox, expected := range map[string]uint32{"Team": 1, "INBOX": 1, "lists": 1, "other": 0} {
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, status.Messages)
+		}
+	}
+}
+
+func TestDelivery_FolderSeparator(t *testing.T) {
+	store := newTestStorage(t)
+	store.folderSeparator = "/"
+	store.plusAddressing = true
+	store.detailSeparator = "+"
+	store.sharedMailboxes = testutils.Table{M: map[string]string{
+		"announce@example.org": "test@example.org/Lists/announce",
+	}}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Lists.announce"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"announce@example.org"})
+	// Subaddresses can't refer to nested folders.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+Lists/announce@example.org"})
+
+	for mbox, expected := range map[string]uint32{"Lists.announce": 1, "INBOX": 1} {
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, status.Messages)
+		}
+	}
+}
+
+func TestDelivery_GenerateMessageID(t *testing.T) {
+	store := newTestStorage(t)
+	store.generateMsgID = true
+	store.hostname = "mx.example.org"
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("test2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	readMsg := func(account string) string {
+		t.Helper()
+		dir := filepath.Join(store.maildirMirror, account, "new")
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(files))
+		}
+		blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, files[0].Name())); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(blob), "\r\n") {
+			if strings.HasPrefix(line, "Message-Id: ") {
+				return strings.TrimPrefix(line, "Message-Id: ")
+			}
+		}
+		return ""
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org", "test2@example.org"},
+		&module.MsgMetadata{Conn: &module.ConnState{AuthUser: "sender@example.org"}})
+	id1, id2 := readMsg("test@example.org"), readMsg("test2@example.org")
+	if !strings.HasSuffix(id1, "@mx.example.org>") {
+		t.Errorf("wrong Message-Id: %q", id1)
+	}
+	if id1 != id2 {
+		t.Errorf("Message-Id differs between recipients: %q, %q", id1, id2)
+	}
+
+	// Incoming messages are not changed.
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Conn: &module.ConnState{}})
+	if id := readMsg("test@example.org"); id != "" {
+		t.Errorf("Message-Id should not be added for incoming messages, got %q", id)
+	}
+}
+
+func TestDelivery_AlwaysBcc(t *testing.T) {
+	store := newTestStorage(t)
+	store.alwaysBcc = "archive@example.org"
+	for _, acct := range []string{"test@example.org", "test2@example.org", "archive@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countMsgs := func(acct string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org", "test2@example.org"})
+	if n := countMsgs("archive@example.org"); n != 1 {
+		t.Errorf("expected 1 message in archive account, got %d", n)
+	}
+	if n := countMsgs("test@example.org"); n != 1 {
+		t.Errorf("expected 1 message for recipient, got %d", n)
+	}
+
+	// The archive account is also an explicit recipient, a single copy
+	// should be stored.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"archive@example.org"})
+	if n := countMsgs("archive@example.org"); n != 2 {
+		t.Errorf("expected 2 messages in archive account, got %d", n)
+	}
+
+	// Failure to deliver the archive copy should not affect the delivery.
+	store.alwaysBcc = "nonexistent@example.org"
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if n := countMsgs("test@example.org"); n != 2 {
+		t.Errorf("expected 2 messages for recipient, got %d", n)
+	}
+}
+
+func TestDelivery_ArchiveByDate(t *testing.T) {
+	store := newTestStorage(t)
+	store.alwaysBcc = "archive@example.org"
+	store.archiveByDate = "Archive/%Y/%m"
+	store.folderSeparator = "/"
+	for _, acct := range []string{"test@example.org", "archive@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver := func(date string, quarantine bool) {
+		t.Helper()
+
+		dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test", Quarantine: quarantine}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Date", date)
+		if err := dlv.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver("Tue, 04 Jun 2024 10:00:00 +0000", false)
+	deliver("Sat, 01 Jun 2024 01:00:00 +0300", false)
+	deliver("not a date", false)
+	deliver("Tue, 04 Jun 2024 10:00:00 +0000", true)
+
+	countMsgs := func(acct, mbox string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+
+	now := time.Now().UTC()
+	for mbox, expected := range map[string]uint32{
+		"Archive.2024.06":                         1,
+		"Archive.2024.05":                         1,
+		formatArchiveFolder("Archive.%Y.%m", now): 1,
+		"INBOX": 0,
+		"Junk":  1,
+	} {
+		if n := countMsgs("archive@example.org", mbox); n != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, n)
+		}
+	}
+	if n := countMsgs("test@example.org", "INBOX"); n != 3 {
+		t.Errorf("expected 3 messages for recipient, got %d", n)
+	}
+
+	for _, tmpl := range []string{"Archive/%Y/%", "Archive/%q"} {
+		if err := checkArchiveTemplate(tmpl); err == nil {
+			t.Errorf("expected an error for %s", tmpl)
+		}
+	}
+}
+
+func TestDelivery_InboxSplit(t *testing.T) {
+	store := newTestStorage(t)
+	store.inboxSplit = testutils.Table{M: map[string]string{
+		"big@example.org":     "monthly",
+		"unknown@example.org": "hourly",
+	}}
+	for _, acct := range []string{"big@example.org", "small@example.org", "unknown@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countMsgs := func(acct, mbox string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatalf("%s: %v", mbox, err)
+		}
+		return status.Messages
+	}
+
+	now := time.Now().UTC()
+	testutils.DoTestDelivery(t, store, "sender@example.org",
+		[]string{"big@example.org", "small@example.org", "unknown@example.org"})
+	shard := fmt.Sprintf("INBOX-%04d-%02d", now.Year(), int(now.Month()))
+	if n := countMsgs("big@example.org", shard); n != 1 {
+		t.Errorf("expected 1 message in %s, got %d", shard, n)
+	}
+	if n := countMsgs("big@example.org", "INBOX"); n != 0 {
+		t.Errorf("expected no messages in INBOX, got %d", n)
+	}
+	for _, acct := range []string{"small@example.org", "unknown@example.org"} {
+		if n := countMsgs(acct, "INBOX"); n != 1 {
+			t.Errorf("%s: expected 1 message in INBOX, got %d", acct, n)
+		}
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"big@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+	if n := countMsgs("big@example.org", shard); n != 1 {
+		t.Errorf("expected 1 message in %s, got %d", shard, n)
+	}
+	if n := countMsgs("big@example.org", "Junk"); n != 1 {
+		t.Errorf("expected 1 message in Junk, got %d", n)
+	}
+}
+
+func TestDelivery_NullSender(t *testing.T) {
+	store := newTestStorage(t)
+	store.nullSenderMbox = "Bounces"
+	for _, acct := range []string{"test@example.org", "postmaster@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countMsgs := func(acct, mbox string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatalf("%s: %v", mbox, err)
+		}
+		return status.Messages
+	}
+
+	testutils.DoTestDelivery(t, store, "", []string{"test@example.org", "postmaster@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if n := countMsgs("test@example.org", "Bounces"); n != 1 {
+		t.Errorf("expected 1 message in Bounces, got %d", n)
+	}
+	if n := countMsgs("test@example.org", "INBOX"); n != 1 {
+		t.Errorf("expected 1 message in INBOX, got %d", n)
+	}
+	if n := countMsgs("postmaster@example.org", "INBOX"); n != 1 {
+		t.Errorf("expected 1 message in postmaster INBOX, got %d", n)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "", []string{"test@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+	if n := countMsgs("test@example.org", "Bounces"); n != 1 {
+		t.Errorf("expected 1 message in Bounces, got %d", n)
+	}
+	if n := countMsgs("test@example.org", "Junk"); n != 1 {
+		t.Errorf("expected 1 message in Junk, got %d", n)
+	}
+
+	store.nullSenderMax = 4
+	_, err := testutils.DoTestDeliveryErr(t, store, "", []string{"test@example.org"})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatalf("expected 552 error, got %v", err)
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	// Not applied if the message is addressed to postmaster.
+	if _, err := testutils.DoTestDeliveryErr(t, store, "", []string{"test@example.org", "postmaster@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_SaveToSent(t *testing.T) {
+	store := newTestStorage(t)
+	store.saveToSent = true
+	store.authNormalize = func(_ context.Context, s string) (string, error) {
+		return strings.ToLower(s), nil
+	}
+	if err := store.CreateIMAPAcct("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(msgMeta *module.MsgMetadata, commit bool) {
+		t.Helper()
+		state, err := store.ModStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer state.Close()
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "test")
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if commit {
+			if err := state.(module.ModifierCommitHook).OnCommit(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	submit(&module.MsgMetadata{ID: "test"}, true)
+	// Not stored if the message is rejected.
+	submit(&module.MsgMetadata{ID: "test", Conn: &module.ConnState{AuthUser: "sender@example.org"}}, false)
+	// Recipients are not known to the storage.
+	submit(&module.MsgMetadata{ID: "test", Conn: &module.ConnState{AuthUser: "Sender@example.org"}}, true)
+	// Not stored if the storage delivers the message.
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"sender@example.org"},
+		&module.MsgMetadata{Conn: &module.ConnState{AuthUser: "sender@example.org"}})
+
+	u, err := store.GetIMAPAcct("sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.(*imapsql.User).Status("Sent", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in Sent, got %d", status.Messages)
+	}
+	_, mbox, err := u.GetMailbox("Sent", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	seq, _ := imap.ParseSeqSet("*")
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-ch; msg == nil || !slices.Contains(msg.Flags, imap.SeenFlag) {
+		t.Errorf("sent copy should be marked as seen: %v", msg)
+	}
+
+	store.saveToSent = false
+	submit(&module.MsgMetadata{ID: "test", Conn: &module.ConnState{AuthUser: "sender@example.org"}}, true)
+	status, err = u.(*imapsql.User).Status("Sent", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("save_to_sent is disabled, but a copy is stored")
+	}
+}
+
+func TestDelivery_ArchiveRaw(t *testing.T) {
+	store := newTestStorage(t)
+	store.alwaysBcc = "archive@example.org"
+	store.archiveRaw = true
+	for _, acct := range []string{"test@example.org", "archive@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastHeader := func(acct string) string {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mbox, err := u.GetMailbox("INBOX", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := new(imap.SeqSet)
+		seq.AddNum(status.Messages)
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Header}, ch); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-ch
+		var hdr []byte
+		for _, literal := range msg.Body {
+			hdr, err = io.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return string(hdr)
+	}
+
+	origHdr := textproto.Header{}
+	origHdr.Add("X-Unsigned", "1")
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{OriginalHeader: &origHdr})
+
+	if hdr := lastHeader("test@example.org"); strings.Contains(hdr, "X-Unsigned") || !strings.Contains(hdr, "B: 2") {
+		t.Errorf("recipient should get the modified header:\n%s", hdr)
+	}
+	hdr := lastHeader("archive@example.org")
+	if !strings.Contains(hdr, "X-Unsigned: 1") || strings.Contains(hdr, "B: 2") {
+		t.Errorf("archive account should get the original header:\n%s", hdr)
+	}
+	if !strings.Contains(hdr, "Delivered-To: archive@example.org") {
+		t.Errorf("Delivered-To is missing:\n%s", hdr)
+	}
+
+	// No original header, e.g. the message was not passed via pipeline.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if hdr := lastHeader("archive@example.org"); !strings.Contains(hdr, "B: 2") {
+		t.Errorf("archive account should get the message as is:\n%s", hdr)
+	}
+}
+
+func TestDelivery_Timeout(t *testing.T) {
+	store := newTestStorage(t)
+	store.deliveryTimeout = 50 * time.Millisecond
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operations completing in time are not affected.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	mdlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlv := mdlv.(*delivery)
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	err = dlv.withTimeout(context.Background(), func() error {
+		<-release
+		return nil
+	})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{4, 3, 0}) {
+		t.Fatalf("expected 451 4.3.0 error, got %v", err)
+	}
+	if err := dlv.Commit(context.Background()); err == nil {
+		t.Error("Commit should fail after timeout")
+	}
+
+	close(release)
+	select {
+	case <-dlv.timedOut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not rolled back")
+	}
+	if err := dlv.Abort(context.Background()); err != nil {
+		t.Error("Abort after timeout failed:", err)
+	}
+}
+
+func TestDelivery_MaxConcurrentPerUser(t *testing.T) {
+	store := newTestStorage(t)
+	store.deliveryLimiter = newDeliveryLimiter(1)
+	for _, acct := range []string{"test@example.org", "test2@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := func() *delivery {
+		t.Helper()
+		mdlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mdlv.(*delivery)
+	}
+
+	first := start()
+	if err := first.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := start()
+	err := second.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{4, 3, 2}) {
+		t.Fatalf("expected 451 4.3.2 error, got %v", err)
+	}
+	// Other accounts are not affected.
+	if err := second.AddRcpt(context.Background(), "test2@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.deliveryLimiter.active) != 0 {
+		t.Errorf("counters for idle accounts are not removed: %v", store.deliveryLimiter.active)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+}
+
+func TestDelivery_PlusAddressing(t *testing.T) {
+	store := newTestStorage(t)
+	store.plusAddressing = true
+	store.detailSeparator = "+"
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("lists"); err != nil {
+		t.Fatal(err)
+	}
+
+	countMsgs := func(mbox string) uint32 {
+		t.Helper()
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+lists@example.org"})
+	if n := countMsgs("lists"); n != 1 {
+		t.Errorf("expected 1 message in lists, got %d", n)
+	}
+
+	_, mbox, err := u.GetMailbox("lists", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Header}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-ch
+	var hdr []byte
+	for _, literal := range msg.Body {
+		hdr, err = io.ReadAll(literal)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(string(hdr), "Delivered-To: test+lists@example.org") {
+		t.Errorf("Delivered-To should contain the full address:\n%s", hdr)
+	}
+
+	// Non-existent folder, message goes to INBOX.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+other@example.org"})
+	if n := countMsgs("INBOX"); n != 1 {
+		t.Errorf("expected 1 message in INBOX, got %d", n)
+	}
+
+	store.plusCreateFolder = true
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+other@example.org"})
+	if n := countMsgs("other"); n != 1 {
+		t.Errorf("expected 1 message in created folder, got %d", n)
+	}
+
+	// Nested folders can't be created.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+a.b@example.org"})
+	if n := countMsgs("INBOX"); n != 2 {
+		t.Errorf("expected 2 messages in INBOX, got %d", n)
+	}
+
+	// Quarantine takes precedence.
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test+lists@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+	if n := countMsgs("lists"); n != 1 {
+		t.Errorf("expected 1 message in lists, got %d", n)
+	}
+	if n := countMsgs("Junk"); n != 1 {
+		t.Errorf("expected 1 message in Junk, got %d", n)
+	}
+
+	// Folder is not created if the message is rejected.
+	store.validateMIME = true
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.AddRcpt(context.Background(), "test+rejected@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr2 := textproto.Header{}
+	hdr2.Add("Content-Type", "multipart/mixed; boundary=b")
+	if err := dlv.Body(context.Background(), hdr2, buffer.MemoryBuffer{Slice: []byte("--b\r\n\r\nunterminated\r\n")}); err == nil {
+		t.Fatal("expected an error for malformed message")
+	}
+	if err := dlv.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := u.GetMailbox("rejected", true, nil); !errors.Is(err, backend.ErrNoSuchMailbox) {
+		t.Errorf("folder should not be created for rejected message, got %v", err)
+	}
+}
+
+func TestDelivery_ValidateMIME(t *testing.T) {
+	store := newTestStorage(t)
+	store.validateMIME = true
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	mdlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mdlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Content-Type", "multipart/mixed; boundary=b")
+	err = mdlv.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("--b\r\n\r\nunterminated\r\n")})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 6, 0}) {
+		t.Fatalf("expected 550 5.6.0 error, got %v", err)
+	}
+	if err := mdlv.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+}
+
+func TestDelivery_StoreAuthResults(t *testing.T) {
+	store := newTestStorage(t)
+	store.storeAuthResults = true
+	store.hostname = "mx.example.org"
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{AuthResults: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultPass, From: "example.com"},
+			&authres.DKIMResult{Value: authres.ResultFail, Domain: "example.com", Reason: "bad\r\nX-Injected: 1"},
+		}})
+
+	dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(blob)
+	if !strings.HasPrefix(msg, "Authentication-Results: mx.example.org;") || !strings.Contains(msg, "spf=pass") {
+		t.Errorf("Authentication-Results is missing:\n%s", msg)
+	}
+	if strings.Contains(msg, "\r\nX-Injected") {
+		t.Errorf("header injection is possible:\n%s", msg)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Authentication-Results", "other.example.org; spf=pass")
+	if hasAuthResults(hdr, "mx.example.org") {
+		t.Error("Authentication-Results for other authserv-id is considered ours")
+	}
+	hdr.Add("Authentication-Results", "MX.example.org; spf=pass")
+	if !hasAuthResults(hdr, "mx.example.org") {
+		t.Error("existing Authentication-Results is not detected")
+	}
+}
+
+func TestDelivery_HostnameMap(t *testing.T) {
+	store := newTestStorage(t)
+	store.storeAuthResults = true
+	store.hostname = "mx.example.org"
+	store.hostnameMap = testutils.Table{M: map[string]string{
+		"mail.example.com": "mx.example.com",
+	}}
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(serverName, authServID string) {
+		t.Helper()
+
+		testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+			&module.MsgMetadata{
+				Conn:        &module.ConnState{TLS: tls.ConnectionState{ServerName: serverName}},
+				AuthResults: []authres.Result{&authres.SPFResult{Value: authres.ResultPass, From: "example.com"}},
+			})
+
+		dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			blob, err := os.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(blob), "Authentication-Results: "+authServID+";") {
+				t.Errorf("wrong authserv-id for server name %q, want %s:\n%s", serverName, authServID, blob)
+			}
+		}
+	}
+
+	check("MAIL.example.com", "mx.example.com")
+	check("other.example.com", "mx.example.org")
+	check("", "mx.example.org")
+}
+
+func TestDelivery_AddReceived(t *testing.T) {
+	store := newTestStorage(t)
+	store.addReceived = true
+	store.hostname = "mx.example.org"
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{
+		ID:   "test",
+		Conn: &module.ConnState{Proto: "LMTP"},
+	}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := testutils.BodyFromStr(t, "Received: from mx.example.com by mx.example.org\r\n"+
+		"From: <sender@example.org>\r\n"+
+		"\r\n"+
+		"Hello!\r\n")
+	if err := dlv.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlv.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 message in mirror, got %d", len(files))
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(blob)
+	ours := strings.Index(msg, "Received: by mx.example.org with LMTP; ")
+	theirs := strings.Index(msg, "Received: from mx.example.com")
+	if ours == -1 || theirs == -1 || ours > theirs {
+		t.Errorf("Received field is missing or not above existing ones:\n%s", msg)
+	}
+}
+
+func TestDelivery_HostnameFromMeta(t *testing.T) {
+	store := newTestStorage(t)
+	store.addReceived = true
+	store.hostnameFromMeta = true
+	store.hostname = "mx.example.org"
+	store.maildirMirror = t.TempDir()
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(conn *module.ConnState, hostname string) {
+		t.Helper()
+
+		testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+			&module.MsgMetadata{Conn: conn})
+
+		dir := filepath.Join(store.maildirMirror, "test@example.org", "new")
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected 1 message in mirror, got %d", len(files))
+		}
+		blob, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, files[0].Name())); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(blob), "\nReceived: by "+hostname+" with ") {
+			t.Errorf("wrong hostname in Received, want %s:\n%s", hostname, blob)
+		}
+	}
+
+	check(&module.ConnState{Proto: "LMTP", EndpointHostname: "mx2.example.org"}, "mx2.example.org")
+	check(&module.ConnState{Proto: "LMTP"}, "mx.example.org")
+	check(nil, "mx.example.org")
+
+	store.hostnameFromMeta = false
+	check(&module.ConnState{Proto: "LMTP", EndpointHostname: "mx2.example.org"}, "mx.example.org")
+}
+
+func TestDelivery_Idempotency(t *testing.T) {
+	store := newTestStorage(t)
+	var err error
+	store.deliveryLog, err = newDeliveryLog(store.Back.DB, "sqlite3", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, acct := range []string{"a@example.org", "b@example.org", "c@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver := func(msgID string, rcpts ...string) {
+		t.Helper()
+		dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rcpt := range rcpts {
+			if err := dlv.AddRcpt(context.Background(), rcpt, smtp.RcptOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hdr, body := testutils.BodyFromStr(t, "Message-Id: "+msgID+"\r\n"+
+			"From: <sender@example.org>\r\n"+
+			"\r\n"+
+			"Hello!\r\n")
+		if err := dlv.Body(context.Background(), hdr, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countMsgs := func(acct string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+	check := func(expected map[string]uint32) {
+		t.Helper()
+		for acct, n := range expected {
+			if actual := countMsgs(acct); actual != n {
+				t.Errorf("%s: expected %d messages, got %d", acct, n, actual)
+			}
+		}
+	}
+
+	deliver("<1@example.org>", "a@example.org", "b@example.org")
+	check(map[string]uint32{"a@example.org": 1, "b@example.org": 1, "c@example.org": 0})
+
+	// Retried delivery is accepted but not stored.
+	deliver("<1@example.org>", "a@example.org", "b@example.org")
+	check(map[string]uint32{"a@example.org": 1, "b@example.org": 1, "c@example.org": 0})
+
+	// Only the new recipient gets the message.
+	deliver("<1@example.org>", "a@example.org", "c@example.org")
+	check(map[string]uint32{"a@example.org": 1, "b@example.org": 1, "c@example.org": 1})
+
+	deliver("<2@example.org>", "a@example.org")
+	check(map[string]uint32{"a@example.org": 2})
+
+	// Keys expire after the window.
+	store.deliveryLog.window = time.Nanosecond
+	deliver("<1@example.org>", "a@example.org")
+	check(map[string]uint32{"a@example.org": 3})
+}
+
+func TestDelivery_DSN(t *testing.T) {
+	store := newTestStorage(t)
+	dsnTarget := &testutils.Target{}
+	store.dsnTarget = dsnTarget
+	store.dsnNotify = []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}
+	store.hostname = "mx.example.org"
+	store.autogenMsgDomain = "example.org"
+	for _, acct := range []string{"test@example.org", "quiet@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver := func(msgMeta *module.MsgMetadata, notify []smtp.DSNNotify) {
+		t.Helper()
+		dlv, err := store.StartDelivery(context.Background(), msgMeta, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{Notify: notify}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "quiet@example.org", smtp.RcptOptions{
+			Notify: []smtp.DSNNotify{smtp.DSNNotifyNever},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "missing@example.org", smtp.RcptOptions{}); err == nil {
+			t.Fatal("expected an error for non-existent account")
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "test")
+		if err := dlv.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		store.dsnWg.Wait()
+	}
+
+	// dsn_notify is not used for unauthenticated senders.
+	deliver(&module.MsgMetadata{ID: "test"}, nil)
+	if len(dsnTarget.Messages) != 0 {
+		t.Fatalf("DSN sent for unauthenticated sender: %d", len(dsnTarget.Messages))
+	}
+
+	deliver(&module.MsgMetadata{ID: "test", Conn: &module.ConnState{AuthUser: "sender@example.org"}}, nil)
+	deliver(&module.MsgMetadata{ID: "test"}, []smtp.DSNNotify{smtp.DSNNotifySuccess})
+	if len(dsnTarget.Messages) != 2 {
+		t.Fatalf("wrong amount of DSNs sent: %d", len(dsnTarget.Messages))
+	}
+	for _, msg := range dsnTarget.Messages {
+		if msg.MailFrom != "" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "sender@example.org" {
+			t.Errorf("wrong DSN envelope: %s -> %v", msg.MailFrom, msg.RcptTo)
+		}
+		body := string(msg.Body)
+		if !strings.Contains(body, "Status: 2.0.0\r\nAction: delivered\r\nFinal-Recipient: rfc822; test@example.org") {
+			t.Errorf("missing delivered status:\n%s", body)
+		}
+		if strings.Contains(body, "missing@example.org") {
+			t.Errorf("recipient rejected at RCPT TO is reported:\n%s", body)
+		}
+		if strings.Contains(body, "quiet@example.org") {
+			t.Errorf("NOTIFY=NEVER is not respected:\n%s", body)
+		}
+	}
+}
+
+func TestDelivery_MaxRcpts(t *testing.T) {
+	store := newTestStorage(t)
+	store.maxRcpts = 2
+	for _, acct := range []string{"test1@example.org", "test2@example.org", "test3@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlv.Abort(context.Background())
+	for _, rcpt := range []string{"test1@example.org", "test2@example.org", "test1@example.org"} {
+		if err := dlv.AddRcpt(context.Background(), rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = dlv.AddRcpt(context.Background(), "test3@example.org", smtp.RcptOptions{})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 452 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{4, 5, 3}) {
+		t.Fatalf("expected 452 4.5.3 error, got %v", err)
+	}
+}
+
+func TestDelivery_MaxReceivedHops(t *testing.T) {
+	store := newTestStorage(t)
+	store.maxReceivedHops = 2
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(hops int) error {
+		t.Helper()
+
+		dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dlv.Abort(context.Background())
+		if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		hdr, body := testutils.BodyFromStr(t, strings.Repeat("Received: from mx.example.org\r\n", hops)+
+			"From: <sender@example.org>\r\n"+
+			"\r\n"+
+			"Hello!\r\n")
+		return dlv.Body(context.Background(), hdr, body)
+	}
+
+	if err := deliver(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := deliver(3)
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 4, 6}) {
+		t.Fatalf("expected 554 5.4.6 error, got %v", err)
+	}
+}
+
+func TestDelivery_RewriteRules(t *testing.T) {
+	store := newTestStorage(t)
+	rules, err := parseRewriteRules(nil, config.Node{
+		Name: "rewrite_rules",
+		Children: []config.Node{
+			{Name: "sales-*@example.org", Args: []string{"sales@example.org"}},
+			{Name: `regexp:^(support|help)\+.*@example\.org$`, Args: []string{"support@example.org"}},
+			{Name: "*@example.org", Args: []string{"catchall@example.org"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.rewriteRules = rules.([]rewriteRule)
+	for _, acct := range []string{"sales@example.org", "support@example.org", "catchall@example.org", "test@example.com"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(rcpt, account string) {
+		t.Helper()
+
+		testutils.DoTestDelivery(t, store, "sender@example.org", []string{rcpt})
+
+		u, err := store.GetIMAPAcct(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mbox, err := u.GetMailbox("INBOX", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mbox.Close()
+		seq, _ := imap.ParseSeqSet("*")
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Header}, ch); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-ch
+		if msg == nil {
+			t.Fatalf("no message delivered to %s", account)
+		}
+		var hdr []byte
+		for _, literal := range msg.Body {
+			hdr, err = io.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.Contains(string(hdr), "Delivered-To: "+rcpt+"\r\n") {
+			t.Errorf("Delivered-To does not contain the original recipient:\n%s", hdr)
+		}
+	}
+
+	check("sales-eu@example.org", "sales@example.org")
+	check("HELP+urgent@example.org", "support@example.org")
+	// First matching rule wins.
+	check("sales@example.org", "catchall@example.org")
+	// No rules matched - regular resolution.
+	check("test@example.com", "test@example.com")
+
+	if _, err := parseRewriteRules(nil, config.Node{
+		Children: []config.Node{{Name: "regexp:(", Args: []string{"a@example.org"}}},
+	}); err == nil {
+		t.Error("expected an error for malformed regexp")
+	}
+}
+
+func TestDelivery_Postmaster(t *testing.T) {
+	store := newTestStorage(t)
+	store.postmasterAcct = "postmaster"
+	if err := store.CreateIMAPAcct("postmaster@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	countMsgs := func(acct string) uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+
+	// postmaster account does not exist, regular resolution is used.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"postmaster@example.com"})
+	if n := countMsgs("postmaster@example.com"); n != 1 {
+		t.Errorf("expected 1 message for postmaster@example.com, got %d", n)
+	}
+
+	// The account is created on the first delivery.
+	store.createPostmaster = true
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"postmaster", "Postmaster@example.org"})
+	if n := countMsgs("postmaster"); n != 1 {
+		t.Errorf("expected 1 message for postmaster, got %d", n)
+	}
+
+	store.perDomain = true
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"postmaster@example.com"})
+	if n := countMsgs("postmaster@example.com"); n != 2 {
+		t.Errorf("expected 2 messages for postmaster@example.com, got %d", n)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"postmaster"})
+	if n := countMsgs("postmaster"); n != 2 {
+		t.Errorf("expected 2 messages for postmaster, got %d", n)
+	}
+
+	// Special-case is disabled, regular account lookup is used.
+	store.postmasterAcct = ""
+	store.perDomain = false
+	_, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"postmaster@example.org"})
+	if err == nil {
+		t.Error("expected an error for non-existent account")
+	}
+}
+
+func TestDelivery_Aliases(t *testing.T) {
+	store := newTestStorage(t)
+	table := testutils.Table{M: map[string]string{
+		"info@example.org":   "alice@example.org, team@example.org",
+		"team@example.org":   "bob@example.org,alice@example.org",
+		"loop1@example.org":  "loop2@example.org",
+		"loop2@example.org":  "loop1@example.org",
+		"broken@example.org": "nonexistent@example.org",
+	}}
+	store.aliases = newAliasResolver(table, 5, time.Minute)
+	for _, acct := range []string{"alice@example.org", "bob@example.org"} {
+		if err := store.CreateIMAPAcct(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastHeader := func(acct string) string {
+		t.Helper()
+		u, err := store.GetIMAPAcct(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mbox, err := u.GetMailbox("INBOX", true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mbox.Close()
+		seq, _ := imap.ParseSeqSet("*")
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchRFC822Header}, ch); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-ch
+		if msg == nil {
+			t.Fatalf("no message delivered to %s", acct)
+		}
+		var hdr []byte
+		for _, literal := range msg.Body {
+			hdr, err = io.ReadAll(literal)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return string(hdr)
+	}
+
+	// Chained alias, alice is listed twice but gets a single copy.
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"INFO@example.org"})
+	for _, acct := range []string{"alice@example.org", "bob@example.org"} {
+		if hdr := lastHeader(acct); !strings.Contains(hdr, "Delivered-To: INFO@example.org\r\n") {
+			t.Errorf("Delivered-To does not contain the original recipient:\n%s", hdr)
+		}
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"loop1@example.org"})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 4, 6}) {
+		t.Errorf("expected 5.4.6 for alias loop, got %v", err)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"broken@example.org"})
+	if err == nil {
+		t.Error("expected an error for alias without valid targets")
+	}
+
+	store.aliases = newAliasResolver(table, 1, 0)
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"info@example.org"})
+	if !errors.As(err, &smtpErr) || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 3, 5}) {
+		t.Errorf("expected 5.3.5 for too deep alias, got %v", err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"team@example.org"})
+}
+
+// staticFilter is module.IMAPFilter that selects the same folder for all
+// messages.
+type staticFilter struct {
+	folder string
+}
+
+func (f staticFilter) IMAPFilter(string, string, *module.MsgMetadata, textproto.Header, buffer.Buffer) (string, []string, error) {
+	return f.folder, nil, nil
+}
+
+// Folders selected by null_sender_mailbox or plus_addressing are not created
+// if the message is delivered elsewhere due to imap_filter.
+func TestDelivery_CreateOnlyFinalFolder(t *testing.T) {
+	store := newTestStorage(t)
+	store.nullSenderMbox = "Bounces"
+	store.plusAddressing = true
+	store.plusCreateFolder = true
+	store.detailSeparator = "+"
+	store.filters = staticFilter{folder: "Filtered"}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Filtered"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "", []string{"test@example.org"})
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test+lists@example.org"})
+
+	status, err := u.(*imapsql.User).Status("Filtered", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 2 {
+		t.Errorf("expected 2 messages in Filtered, got %d", status.Messages)
+	}
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mbox := range mboxes {
+		if mbox.Name == "Bounces" || mbox.Name == "lists" {
+			t.Errorf("unused folder %s was created", mbox.Name)
+		}
+	}
+}
+
+func TestDelivery_SieveLite(t *testing.T) {
+	store := newTestStorage(t)
+	store.folderSeparator = "/"
+	store.junkMbox = "Junk"
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	rules := `# Test rules
+header Subject contains "[list]" fileinto Lists/Test
+header From is boss@example.org fileinto Important
+size over 1K fileinto Large
+`
+	if err := os.WriteFile(filepath.Join(dir, "test@example.org.rules"), []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store.sieveLite = newSieveLite(dir)
+
+	deliver := func(quarantine bool, subject, from string, body []byte) {
+		t.Helper()
+
+		dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test", Quarantine: quarantine}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", subject)
+		hdr.Add("From", from)
+		if err := dlv.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver(false, "Hello [LIST] members", "someone@example.org", []byte("foobar\r\n"))
+	deliver(false, "Report", "Boss@Example.org", []byte("foobar\r\n"))
+	deliver(false, "Photos", "someone@example.org", make([]byte, 2048))
+	deliver(false, "Hello", "someone@example.org", []byte("foobar\r\n"))
+	deliver(true, "[list] spam", "someone@example.org", []byte("foobar\r\n"))
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mbox, expected := range map[string]uint32{
+		"Lists.Test": 1,
+		"Important":  1,
+		"Large":      1,
+		"INBOX":      1,
+		"Junk":       1,
+	} {
+		status, err := u.(*imapsql.User).Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(mbox, err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, status.Messages)
+		}
+	}
+
+	for _, line := range []string{
+		`header Subject contains foo`,
+		`header Subject matches foo fileinto Test`,
+		`size over abc fileinto Test`,
+		`size between 1K fileinto Test`,
+		`body contains foo fileinto Test`,
+		`header Subject contains "foo fileinto Test`,
+		`fileinto Test`,
+	} {
+		words, err := splitRuleLine(line)
+		if err != nil {
+			continue
+		}
+		if _, err := parseSieveRule(words); err == nil {
+			t.Errorf("expected an error for %s", line)
+		}
+	}
+}
+
+func TestDelivery_InitialFlags(t *testing.T) {
+	store := newTestStorage(t)
+	var err error
+	store.initialFlags, err = checkFlags([]string{"\\seen", "$Imported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.quarantineFlags, err = checkFlags([]string{"$Junk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(mboxName string, expected []string) {
+		t.Helper()
+
+		_, mbox, err := u.GetMailbox(mboxName, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mbox.Close()
+		seq, _ := imap.ParseSeqSet("*")
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-ch
+		if msg == nil {
+			t.Fatalf("no message delivered to %s", mboxName)
+		}
+		var flags []string
+		for _, f := range msg.Flags {
+			if f != imap.RecentFlag {
+				flags = append(flags, f)
+			}
+		}
+		sort.Strings(flags)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(flags, expected) {
+			t.Errorf("wrong flags in %s: want %v, got %v", mboxName, expected, flags)
+		}
+	}
+	check("INBOX", []string{imap.SeenFlag, "$Imported"})
+	check("Junk", []string{imap.SeenFlag, "$Imported", "$Junk"})
+
+	for _, flags := range [][]string{
+		{imap.RecentFlag},
+		{"\\Unknown"},
+		{"foo bar"},
+		{""},
+	} {
+		if _, err := checkFlags(flags); err == nil {
+			t.Errorf("expected an error for %q", flags)
+		}
+	}
+}
+
+func TestDelivery_Mirror(t *testing.T) {
+	store := newTestStorage(t)
+	mirror := &testutils.Target{}
+	store.mirrorTo = mirror
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if len(mirror.Messages) != 1 {
+		t.Fatalf("wrong amount of messages mirrored: %d", len(mirror.Messages))
+	}
+	testutils.CheckTestMessage(t, mirror, 0, "sender@example.org", []string{"test@example.org"})
+
+	countInbox := func() uint32 {
+		t.Helper()
+		u, err := store.GetIMAPAcct("test@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.Messages
+	}
+
+	// Mirror failures are not reported by default.
+	mirror.CommitErr = errors.New("mirror failure")
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+	if n := countInbox(); n != 2 {
+		t.Errorf("expected 2 messages in INBOX, got %d", n)
+	}
+
+	store.mirrorRequired = true
+	_, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("expected a temporary error, got %v", err)
+	}
+	if n := countInbox(); n != 2 {
+		t.Errorf("message should not be stored if mirror fails, got %d messages", n)
+	}
+}
+
+func TestDelivery_MailboxMetrics(t *testing.T) {
+	store := newTestStorage(t)
+	store.instName = "test_metrics"
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(result string) float64 {
+		return testutil.ToFloat64(deliveredToMailbox.WithLabelValues("test_metrics", "INBOX", result))
+	}
+	deliver := func(commit bool) {
+		t.Helper()
+		dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dlv.AddRcpt(context.Background(), "test@example.org", smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		success, failure := count("success"), count("failure")
+		hdr, body := testutils.BodyFromStr(t, "From: <sender@example.org>\r\n\r\nHello!\r\n")
+		if err := dlv.Body(context.Background(), hdr, body); err != nil {
+			t.Fatal(err)
+		}
+		if count("success") != success || count("failure") != failure {
+			t.Error("the delivery is counted before it is finished")
+		}
+		if commit {
+			err = dlv.Commit(context.Background())
+		} else {
+			err = dlv.Abort(context.Background())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver(false)
+	if count("failure") != 1 {
+		t.Errorf("aborted delivery should be counted as failure")
+	}
+	deliver(true)
+	if count("success") != 1 {
+		t.Errorf("committed delivery should be counted as success")
+	}
+}
@@ -0,0 +1,428 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// dbTLSConfig contains the contents of the tls block used to configure
+// the connection to the database server.
+type dbTLSConfig struct {
+	caCert     string
+	clientCert string
+	clientKey  string
+	serverName string
+}
+
+func dbTLSBlock(_ *config.Map, node config.Node) (interface{}, error) {
+	cfg := &dbTLSConfig{}
+
+	childM := config.NewMap(nil, node)
+	childM.String("ca_cert", false, false, "", &cfg.caCert)
+	childM.String("client_cert", false, false, "", &cfg.clientCert)
+	childM.String("client_key", false, false, "", &cfg.clientKey)
+	childM.String("server_name", false, false, "", &cfg.serverName)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if (cfg.clientCert == "") != (cfg.clientKey == "") {
+		return nil, errors.New("imapsql: tls: both client_cert and client_key should be specified")
+	}
+	for _, path := range []string{cfg.caCert, cfg.clientCert, cfg.clientKey} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("imapsql: tls: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// tlsConfig builds a crypto/tls configuration object from the paths
+// specified in the block.
+func (cfg *dbTLSConfig) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName: cfg.serverName,
+	}
+
+	if cfg.caCert != "" {
+		blob, err := os.ReadFile(cfg.caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("no certificates was loaded from %s", cfg.caCert)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.clientCert != "" {
+		keypair, err := tls.LoadX509KeyPair(cfg.clientCert, cfg.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{keypair}
+	}
+
+	return tlsCfg, nil
+}
+
+// pqQuote quotes the value for use in key-value form of PostgreSQL
+// connection string.
+func pqQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// applyDBTLS modifies the DSN to use the TLS configuration from the tls block.
+//
+// For MySQL, the crypto/tls configuration object is registered with the
+// driver under the name derived from the instance name.  For PostgreSQL, the
+// corresponding connection parameters are added to the DSN.  SQLite does not
+// use network connections so DSN is returned unchanged.
+func (store *Storage) applyDBTLS(driver, dsn string, cfg *dbTLSConfig) (string, error) {
+	switch driver {
+	case "mysql":
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			return "", fmt.Errorf("imapsql: tls: %w", err)
+		}
+
+		mysqlCfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", fmt.Errorf("imapsql: malformed DSN: %w", err)
+		}
+		name := "maddy-imapsql-" + store.instName
+		if err := mysql.RegisterTLSConfig(name, tlsCfg); err != nil {
+			return "", fmt.Errorf("imapsql: tls: %w", err)
+		}
+		mysqlCfg.TLSConfig = name
+		return mysqlCfg.FormatDSN(), nil
+	case "postgres":
+		if cfg.serverName != "" {
+			return "", errors.New("imapsql: tls: server_name is not supported for postgres")
+		}
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			dsn, err = pq.ParseURL(dsn)
+			if err != nil {
+				return "", fmt.Errorf("imapsql: malformed DSN: %w", err)
+			}
+		}
+
+		params := []string{"sslmode=verify-full"}
+		if cfg.caCert != "" {
+			params = append(params, "sslrootcert="+pqQuote(cfg.caCert))
+		}
+		if cfg.clientCert != "" {
+			params = append(params,
+				"sslcert="+pqQuote(cfg.clientCert),
+				"sslkey="+pqQuote(cfg.clientKey))
+		}
+		return dsn + " " + strings.Join(params, " "), nil
+	case "sqlite3", "sqlite":
+		store.log.Msg("tls block is ignored for SQLite")
+		return dsn, nil
+	default:
+		return "", fmt.Errorf("imapsql: tls is not supported for driver %s", driver)
+	}
+}
+
+// checkApplicationName checks that the application name can be safely used in
+// a DSN.
+func checkApplicationName(name string) error {
+	if name == "" {
+		return errors.New("imapsql: application_name can't be empty")
+	}
+	for _, ch := range name {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '.', ch == '_', ch == '-', ch == '/':
+		default:
+			return fmt.Errorf("imapsql: application_name contains forbidden character: %q", ch)
+		}
+	}
+	return nil
+}
+
+// defaultApplicationName derives the application name from the module
+// instance name, replacing characters not allowed by checkApplicationName.
+func defaultApplicationName(instName string) string {
+	if instName == "" {
+		return "maddy"
+	}
+	name := []rune("maddy-" + instName)
+	for i, ch := range name {
+		if checkApplicationName(string(ch)) != nil {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// applyApplicationName adds the connection label to the DSN, unless it
+// already specifies one.
+func applyApplicationName(driver, dsn, name string) (string, error) {
+	switch driver {
+	case "postgres":
+		dsn, opts, err := pqParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := opts["application_name"]; ok {
+			return dsn, nil
+		}
+		return dsn + " application_name=" + pqQuote(name), nil
+	case "mysql":
+		mysqlCfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", fmt.Errorf("imapsql: malformed DSN: %w", err)
+		}
+		for _, attr := range strings.Split(mysqlCfg.ConnectionAttributes, ",") {
+			if strings.HasPrefix(attr, "program_name:") {
+				return dsn, nil
+			}
+		}
+		// FormatDSN does not serialize connectionAttributes, so the parameter
+		// is edited in the original string.
+		attrs := "program_name:" + name
+		if mysqlCfg.ConnectionAttributes != "" {
+			attrs = mysqlCfg.ConnectionAttributes + "," + attrs
+		}
+		base, query, _ := strings.Cut(dsn, "?")
+		params := make([]string, 0, 1)
+		for _, param := range strings.Split(query, "&") {
+			if param == "" || strings.HasPrefix(param, "connectionAttributes=") {
+				continue
+			}
+			params = append(params, param)
+		}
+		params = append(params, "connectionAttributes="+url.QueryEscape(attrs))
+		return base + "?" + strings.Join(params, "&"), nil
+	default:
+		return dsn, nil
+	}
+}
+
+// applyStatementTimeout adds the server-side limit on the query execution
+// time to the DSN, unless it already specifies one.
+//
+// For PostgreSQL, statement_timeout is passed as a run-time parameter, for
+// MySQL, max_execution_time system variable is set on connection.
+func applyStatementTimeout(driver, dsn string, timeout time.Duration) (string, error) {
+	ms := strconv.FormatInt(timeout.Milliseconds(), 10)
+
+	switch driver {
+	case "postgres":
+		dsn, opts, err := pqParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := opts["statement_timeout"]; ok {
+			return dsn, nil
+		}
+		return dsn + " statement_timeout=" + ms, nil
+	case "mysql":
+		mysqlCfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", fmt.Errorf("imapsql: malformed DSN: %w", err)
+		}
+		if _, ok := mysqlCfg.Params["max_execution_time"]; ok {
+			return dsn, nil
+		}
+		if strings.Contains(dsn, "?") {
+			return dsn + "&max_execution_time=" + ms, nil
+		}
+		return dsn + "?max_execution_time=" + ms, nil
+	default:
+		return dsn, nil
+	}
+}
+
+// pqParseDSN converts the URL form of PostgreSQL connection string to the
+// key-value form and parses it.
+func pqParseDSN(dsn string) (string, map[string]string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return "", nil, fmt.Errorf("imapsql: malformed DSN: %w", err)
+		}
+	}
+	opts, err := pqParseOpts(dsn)
+	if err != nil {
+		return "", nil, fmt.Errorf("imapsql: malformed DSN: %w", err)
+	}
+	return dsn, opts, nil
+}
+
+// pqParseOpts parses the key-value form of PostgreSQL connection string.
+// It follows the same rules as lib/pq does.
+func pqParseOpts(dsn string) (map[string]string, error) {
+	opts := make(map[string]string)
+	runes := []rune(dsn)
+	i := 0
+	skipSpaces := func() {
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpaces()
+		if i >= len(runes) {
+			return opts, nil
+		}
+
+		keyStart := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '=' {
+			i++
+		}
+		key := string(runes[keyStart:i])
+		skipSpaces()
+		if i >= len(runes) || runes[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q", key)
+		}
+		i++
+		skipSpaces()
+
+		var val []rune
+		if i < len(runes) && runes[i] == '\'' {
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated quoted value for %q", key)
+				}
+				r := runes[i]
+				i++
+				if r == '\'' {
+					break
+				}
+				if r == '\\' {
+					if i >= len(runes) {
+						return nil, errors.New("missing character after backslash")
+					}
+					r = runes[i]
+					i++
+				}
+				val = append(val, r)
+			}
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				r := runes[i]
+				i++
+				if r == '\\' {
+					if i >= len(runes) {
+						return nil, errors.New("missing character after backslash")
+					}
+					r = runes[i]
+					i++
+				}
+				val = append(val, r)
+			}
+		}
+		opts[key] = string(val)
+	}
+}
+
+// sqlitePath extracts the database file path from the SQLite DSN.
+// Empty string is returned for in-memory databases.
+func sqlitePath(dsn string) string {
+	if strings.HasPrefix(dsn, "file:") {
+		dsn = strings.TrimPrefix(dsn, "file:")
+		var query string
+		dsn, query, _ = strings.Cut(dsn, "?")
+		if strings.Contains(query, "mode=memory") {
+			return ""
+		}
+		if unescaped, err := url.PathUnescape(dsn); err == nil {
+			dsn = unescaped
+		}
+	}
+	if dsn == "" || dsn == ":memory:" || strings.HasPrefix(dsn, ":memory:") {
+		return ""
+	}
+	return dsn
+}
+
+// validateDSN checks the DSN for the common mistakes so they are reported
+// as configuration errors instead of obscure failures during
+// initialization.
+func validateDSN(driver, dsn string) error {
+	switch driver {
+	case "mysql":
+		if _, err := mysql.ParseDSN(dsn); err != nil {
+			return fmt.Errorf("imapsql: dsn: %w", err)
+		}
+	case "postgres":
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			dsn, err = pq.ParseURL(dsn)
+			if err != nil {
+				return fmt.Errorf("imapsql: dsn: %w", err)
+			}
+		}
+		opts, err := pqParseOpts(dsn)
+		if err != nil {
+			return fmt.Errorf("imapsql: dsn: %w", err)
+		}
+		if mode, ok := opts["sslmode"]; ok {
+			switch mode {
+			case "disable", "require", "verify-ca", "verify-full":
+			default:
+				return fmt.Errorf("imapsql: dsn: unknown sslmode value %q", mode)
+			}
+		}
+	case "sqlite3", "sqlite":
+		path := sqlitePath(dsn)
+		if path == "" {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		info, err := os.Stat(dir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("imapsql: dsn: directory %s does not exist", dir)
+			}
+			return fmt.Errorf("imapsql: dsn: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("imapsql: dsn: %s is not a directory", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/go-sql-driver/mysql"
+)
+
+func writeTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "db.example.org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certBlob, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlob, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBlob}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBlob}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func parseTestTLSBlock(t *testing.T, children ...config.Node) (*dbTLSConfig, error) {
+	t.Helper()
+
+	cfg, err := dbTLSBlock(nil, config.Node{Name: "tls", Children: children})
+	if err != nil {
+		return nil, err
+	}
+	return cfg.(*dbTLSConfig), nil
+}
+
+func TestApplyDBTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCert(t, dir)
+
+	store := &Storage{instName: "test", log: testutils.Logger(t, "imapsql")}
+
+	tlsCfg, err := parseTestTLSBlock(t,
+		config.Node{Name: "ca_cert", Args: []string{certPath}},
+		config.Node{Name: "client_cert", Args: []string{certPath}},
+		config.Node{Name: "client_key", Args: []string{keyPath}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn, err := store.applyDBTLS("postgres", "host=db.example.org dbname=maddy", tlsCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "host=db.example.org dbname=maddy sslmode=verify-full sslrootcert='" + certPath +
+			"' sslcert='" + certPath + "' sslkey='" + keyPath + "'"
+		if dsn != expected {
+			t.Errorf("wrong DSN\nwant: %s\ngot:  %s", expected, dsn)
+		}
+	})
+	t.Run("postgres URL", func(t *testing.T) {
+		dsn, err := store.applyDBTLS("postgres", "postgres://db.example.org/maddy", tlsCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(dsn, "host='db.example.org'") || !strings.Contains(dsn, "sslmode=verify-full") {
+			t.Errorf("unexpected DSN: %s", dsn)
+		}
+	})
+	t.Run("mysql", func(t *testing.T) {
+		dsn, err := store.applyDBTLS("mysql", "maddy:secret@tcp(db.example.org)/maddy", tlsCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.TLSConfig != "maddy-imapsql-test" {
+			t.Errorf("wrong tls parameter: %s", parsed.TLSConfig)
+		}
+	})
+	t.Run("sqlite3", func(t *testing.T) {
+		dsn, err := store.applyDBTLS("sqlite3", "imapsql.db", tlsCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dsn != "imapsql.db" {
+			t.Errorf("DSN should not be changed for sqlite3, got %s", dsn)
+		}
+	})
+}
+
+func TestDBTLSBlock_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	certPath, _ := writeTestCert(t, dir)
+
+	if _, err := parseTestTLSBlock(t,
+		config.Node{Name: "ca_cert", Args: []string{filepath.Join(dir, "nonexistent.pem")}},
+	); err == nil {
+		t.Error("expected error for non-existent CA file")
+	}
+	if _, err := parseTestTLSBlock(t,
+		config.Node{Name: "client_cert", Args: []string{certPath}},
+	); err == nil {
+		t.Error("expected error for client_cert without client_key")
+	}
+}
+
+func TestValidateDSN(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, c := range []struct {
+		driver string
+		dsn    string
+		fail   bool
+	}{
+		{driver: "postgres", dsn: "host=localhost dbname=maddy sslmode=verify-full"},
+		{driver: "postgres", dsn: "host=localhost password='a b\\'c'"},
+		{driver: "postgres", dsn: "postgres://localhost/maddy?sslmode=disable"},
+		{driver: "postgres", dsn: "host=localhost sslmode=verify", fail: true},
+		{driver: "postgres", dsn: "postgres://localhost/maddy?sslmode=strict", fail: true},
+		{driver: "postgres", dsn: "host localhost", fail: true},
+		{driver: "postgres", dsn: "password='unterminated", fail: true},
+		{driver: "mysql", dsn: "maddy:secret@tcp(localhost)/maddy"},
+		{driver: "mysql", dsn: "maddy:secret@tcp(localhost/maddy", fail: true},
+		{driver: "sqlite3", dsn: filepath.Join(dir, "imapsql.db")},
+		{driver: "sqlite3", dsn: "file:" + filepath.Join(dir, "imapsql.db") + "?_journal=WAL"},
+		{driver: "sqlite3", dsn: ":memory:"},
+		{driver: "sqlite3", dsn: filepath.Join(dir, "nonexistent", "imapsql.db"), fail: true},
+	} {
+		err := validateDSN(c.driver, c.dsn)
+		if c.fail && err == nil {
+			t.Errorf("%s %s: expected an error", c.driver, c.dsn)
+		}
+		if !c.fail && err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.driver, c.dsn, err)
+		}
+	}
+}
+
+func TestApplyApplicationName(t *testing.T) {
+	for _, c := range []struct {
+		driver   string
+		dsn      string
+		expected string
+	}{
+		{
+			driver:   "postgres",
+			dsn:      "host=localhost dbname=maddy",
+			expected: "host=localhost dbname=maddy application_name='maddy-test'",
+		},
+		{
+			driver:   "postgres",
+			dsn:      "host=localhost application_name=custom",
+			expected: "host=localhost application_name=custom",
+		},
+		{
+			driver:   "postgres",
+			dsn:      "postgres://localhost/maddy",
+			expected: "dbname='maddy' host='localhost' application_name='maddy-test'",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy",
+			expected: "maddy:secret@tcp(localhost)/maddy?connectionAttributes=program_name%3Amaddy-test",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy?connectionAttributes=role:mx,program_name:custom",
+			expected: "maddy:secret@tcp(localhost)/maddy?connectionAttributes=role:mx,program_name:custom",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy?parseTime=true&connectionAttributes=role:mx",
+			expected: "maddy:secret@tcp(localhost)/maddy?parseTime=true&connectionAttributes=role%3Amx%2Cprogram_name%3Amaddy-test",
+		},
+		{
+			driver:   "sqlite3",
+			dsn:      "imapsql.db",
+			expected: "imapsql.db",
+		},
+	} {
+		dsn, err := applyApplicationName(c.driver, c.dsn, "maddy-test")
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.driver, c.dsn, err)
+			continue
+		}
+		if dsn != c.expected {
+			t.Errorf("%s %s: wrong DSN\nwant: %s\ngot:  %s", c.driver, c.dsn, c.expected, dsn)
+		}
+	}
+
+	for _, name := range []string{"", "a b", "a'b", "a,b", "a:b", "a&b"} {
+		if err := checkApplicationName(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+	if name := defaultApplicationName("local mailboxes:1"); name != "maddy-local_mailboxes_1" {
+		t.Errorf("wrong default application name: %s", name)
+	}
+}
+
+func TestApplyStatementTimeout(t *testing.T) {
+	for _, c := range []struct {
+		driver   string
+		dsn      string
+		expected string
+	}{
+		{
+			driver:   "postgres",
+			dsn:      "host=localhost dbname=maddy",
+			expected: "host=localhost dbname=maddy statement_timeout=30000",
+		},
+		{
+			driver:   "postgres",
+			dsn:      "host=localhost statement_timeout=1000",
+			expected: "host=localhost statement_timeout=1000",
+		},
+		{
+			driver:   "postgres",
+			dsn:      "postgres://localhost/maddy",
+			expected: "dbname='maddy' host='localhost' statement_timeout=30000",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy",
+			expected: "maddy:secret@tcp(localhost)/maddy?max_execution_time=30000",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy?parseTime=true",
+			expected: "maddy:secret@tcp(localhost)/maddy?parseTime=true&max_execution_time=30000",
+		},
+		{
+			driver:   "mysql",
+			dsn:      "maddy:secret@tcp(localhost)/maddy?max_execution_time=1000",
+			expected: "maddy:secret@tcp(localhost)/maddy?max_execution_time=1000",
+		},
+		{
+			driver:   "sqlite3",
+			dsn:      "imapsql.db",
+			expected: "imapsql.db",
+		},
+	} {
+		dsn, err := applyStatementTimeout(c.driver, c.dsn, 30*time.Second)
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.driver, c.dsn, err)
+			continue
+		}
+		if dsn != c.expected {
+			t.Errorf("%s %s: wrong DSN\nwant: %s\ngot:  %s", c.driver, c.dsn, c.expected, dsn)
+		}
+	}
+}
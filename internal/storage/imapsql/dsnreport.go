@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// dsnRcpt is a recipient to report the delivery status for if dsn_target
+// is set.
+type dsnRcpt struct {
+	rcptTo string
+	notify []smtp.DSNNotify
+}
+
+// wantsDSN checks whether the delivery status notification of the specified
+// kind should be generated for the recipient.
+//
+// NOTIFY parameter used by the client takes precedence over dsn_notify.
+// dsn_notify is used only for messages submitted by authenticated senders,
+// otherwise the server could be used to send notifications to forged
+// addresses.
+func (d *delivery) wantsDSN(notify []smtp.DSNNotify, kind smtp.DSNNotify) bool {
+	if len(notify) == 0 {
+		if d.msgMeta.Conn == nil || d.msgMeta.Conn.AuthUser == "" {
+			return false
+		}
+		notify = d.store.dsnNotify
+	}
+	for _, n := range notify {
+		if n == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// trackDSN remembers the accepted recipient for reporting once the delivery
+// is completed. Rejected recipients are not reported, the error is already
+// returned to the client.
+func (d *delivery) trackDSN(rcptTo string, opts smtp.RcptOptions, err error) {
+	if d.store.dsnTarget == nil || err != nil {
+		return
+	}
+	d.dsnRcpts = append(d.dsnRcpts, dsnRcpt{rcptTo: rcptTo, notify: opts.Notify})
+}
+
+// reportDSN sends the delivery status notification for tracked recipients.
+//
+// If committed is false, accepted recipients are reported only if the
+// message was rejected permanently.
+func (d *delivery) reportDSN(committed bool) {
+	if d.store.dsnTarget == nil || len(d.dsnRcpts) == 0 {
+		return
+	}
+	// Null return-path, used in DSNs.
+	if d.mailFrom == "" {
+		return
+	}
+
+	rcptsInfo := make([]dsn.RecipientInfo, 0, len(d.dsnRcpts))
+	for _, rcpt := range d.dsnRcpts {
+		var err error
+		if !committed {
+			if d.bodyErr == nil {
+				continue
+			}
+			err = d.bodyErr
+		}
+
+		finalRcpt := rcpt.rcptTo
+		if originalRcpt := d.msgMeta.OriginalRcpts[rcpt.rcptTo]; originalRcpt != "" {
+			finalRcpt = originalRcpt
+		}
+
+		if err == nil {
+			if !d.wantsDSN(rcpt.notify, smtp.DSNNotifySuccess) {
+				continue
+			}
+			rcptsInfo = append(rcptsInfo, dsn.RecipientInfo{
+				FinalRecipient: finalRcpt,
+				Action:         dsn.ActionDelivered,
+				Status:         smtp.EnhancedCode{2, 0, 0},
+			})
+			continue
+		}
+		if !d.wantsDSN(rcpt.notify, smtp.DSNNotifyFailure) {
+			continue
+		}
+		smtpErr := dsnError(err)
+		rcptsInfo = append(rcptsInfo, dsn.RecipientInfo{
+			FinalRecipient: finalRcpt,
+			Action:         dsn.ActionFailed,
+			Status:         smtpErr.EnhancedCode,
+			DiagnosticCode: smtpErr,
+		})
+	}
+	if len(rcptsInfo) == 0 {
+		return
+	}
+
+	d.store.dsnWg.Add(1)
+	go func() {
+		defer d.store.dsnWg.Done()
+		d.store.sendDSN(d.msgMeta, d.mailFrom, d.dsnHeader, rcptsInfo)
+	}()
+}
+
+// dsnError converts the permanent error returned to the client into the
+// form expected by the dsn package.
+func dsnError(err error) *smtp.SMTPError {
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		return &smtp.SMTPError{
+			Code:         smtpErr.Code,
+			EnhancedCode: smtp.EnhancedCode(smtpErr.EnhancedCode),
+			Message:      smtpErr.Message,
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "Internal server error",
+	}
+}
+
+func (store *Storage) sendDSN(msgMeta *module.MsgMetadata, mailFrom string, header textproto.Header, rcptsInfo []dsn.RecipientInfo) {
+	dl := target.DeliveryLogger(store.log, msgMeta)
+
+	dsnID, err := module.GenerateMsgID()
+	if err != nil {
+		dl.Error("rand.Rand error", err)
+		return
+	}
+
+	dsnEnvelope := dsn.Envelope{
+		MsgID: "<" + dsnID + "@" + store.autogenMsgDomain + ">",
+		From:  "MAILER-DAEMON@" + store.autogenMsgDomain,
+		To:    mailFrom,
+	}
+	now := time.Now()
+	mtaInfo := dsn.ReportingMTAInfo{
+		ReportingMTA:    store.hostname,
+		XSender:         mailFrom,
+		XMessageID:      msgMeta.ID,
+		ArrivalDate:     now,
+		LastAttemptDate: now,
+	}
+	if !msgMeta.DontTraceSender && msgMeta.Conn != nil {
+		mtaInfo.ReceivedFromMTA = msgMeta.Conn.Hostname
+	}
+
+	var dsnBodyBlob bytes.Buffer
+	dsnHeader, err := dsn.GenerateDSN(msgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptsInfo, header, &dsnBodyBlob)
+	if err != nil {
+		dl.Error("failed to generate DSN", err)
+		return
+	}
+	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
+
+	dsnMeta := &module.MsgMetadata{
+		ID: dsnID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8:       msgMeta.SMTPOpts.UTF8,
+			RequireTLS: msgMeta.SMTPOpts.RequireTLS,
+		},
+	}
+	dl.Msg("generated DSN", "dsn_id", dsnID)
+
+	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
+	defer msgTask.End()
+
+	dsnDelivery, err := store.dsnTarget.StartDelivery(msgCtx, dsnMeta, "")
+	if err != nil {
+		dl.Error("failed to send DSN", err, "dsn_id", dsnID)
+		return
+	}
+	defer func() {
+		if err != nil {
+			dl.Error("failed to send DSN", err, "dsn_id", dsnID)
+			if err := dsnDelivery.Abort(msgCtx); err != nil {
+				dl.Error("failed to abort DSN delivery", err, "dsn_id", dsnID)
+			}
+		}
+	}()
+
+	if err = dsnDelivery.AddRcpt(msgCtx, mailFrom, smtp.RcptOptions{}); err != nil {
+		return
+	}
+	if err = dsnDelivery.Body(msgCtx, dsnHeader, dsnBody); err != nil {
+		return
+	}
+	err = dsnDelivery.Commit(msgCtx)
+}
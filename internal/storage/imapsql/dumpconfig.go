@@ -0,0 +1,249 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/go-sql-driver/mysql"
+)
+
+// redactedValue replaces secrets in the dumped configuration.
+const redactedValue = "xxxxx"
+
+// DumpConfig returns the effective configuration of the storage after
+// defaults and inline arguments are applied. Keys match configuration
+// directive names. Passwords in DSNs are redacted.
+func (store *Storage) DumpConfig() map[string]interface{} {
+	junkMbox, quarantineMbox := store.specialMailboxes()
+	cfg := map[string]interface{}{
+		"driver":                   store.driver,
+		"dsn":                      redactDSN(store.driver, strings.Join(store.dsn, " ")),
+		"junk_mailbox":             junkMbox,
+		"quarantine_mailbox":       quarantineMbox,
+		"null_sender_mailbox":      store.nullSenderMbox,
+		"initial_flags":            store.initialFlags,
+		"quarantine_flags":         store.quarantineFlags,
+		"folder_separator":         store.folderSeparator,
+		"create_special_mailboxes": store.createSpecialMboxes,
+		"imap_extensions":          store.IMAPExtensions(),
+		"connect_retries":          store.connectRetries,
+		"connect_timeout":          store.connectTimeout.String(),
+		"conn_max_idle_time":       store.connMaxIdleTime.String(),
+		"validate_connections":     store.validateConns,
+		"usage_tracking":           store.usageTracking,
+		"maildir_mirror":           store.maildirMirror,
+		"strip_headers":            store.stripHeaders,
+		"max_header_size":          store.maxHeaderSize,
+		"null_sender_max_size":     store.nullSenderMax,
+		"validate_mime":            store.validateMIME,
+		"normalize_crlf":           store.normalizeCRLF,
+		"generate_message_id":      store.generateMsgID,
+		"add_received":             store.addReceived,
+		"hostname_from_meta":       store.hostnameFromMeta,
+		"save_to_sent":             store.saveToSent,
+		"auth_header":              store.authHeader,
+		"original_from_header":     store.origFromHdr,
+		"plus_addressing":          store.plusAddressing,
+		"always_bcc":               store.alwaysBcc,
+		"delivery_timeout":         store.deliveryTimeout.String(),
+		"audit_log":                store.auditLogPath,
+		"coalesce_updates":         store.coalesceUpdates.String(),
+		"redact_pii":               store.redactPII,
+		"store_checksums":          store.storeChecksums,
+		"idempotency":              store.idempotency,
+	}
+	if store.idempotency {
+		cfg["idempotency_window"] = store.idempotencyWindow.String()
+	}
+	if store.dsnSrv != "" {
+		cfg["dsn_srv"] = store.dsnSrv
+	}
+	if store.lookupDSN != nil {
+		cfg["lookup_dsn"] = redactDSN(store.driver, strings.Join(store.lookupDSN, " "))
+	}
+	if store.plusAddressing {
+		cfg["plus_addressing_separator"] = store.detailSeparator
+		cfg["plus_addressing_create_folder"] = store.plusCreateFolder
+	}
+	if store.encryption != nil {
+		cfg["encryption_current_key"] = store.encryption.currentKey
+		cfg["encryption_allow_unencrypted"] = store.encryption.allowUnencrypted
+	}
+	if store.sieveLite != nil {
+		cfg["sieve_lite"] = store.sieveLite.dir
+	}
+	if store.trashRetention != 0 {
+		cfg["trash_retention"] = store.trashRetention.String()
+		cfg["trash_retention_accounts"] = store.trashAccounts
+	}
+	if mod, ok := store.mirrorTo.(module.Module); ok {
+		cfg["mirror_to"] = mod.Name() + ":" + mod.InstanceName()
+		cfg["mirror_required"] = store.mirrorRequired
+	}
+	if store.alwaysBcc != "" {
+		cfg["archive_raw"] = store.archiveRaw
+	}
+	if store.postmasterAcct != "" {
+		cfg["postmaster_account"] = store.postmasterAcct
+		cfg["create_postmaster"] = store.createPostmaster
+		cfg["storage_perdomain"] = store.perDomainEnabled()
+	} else {
+		cfg["postmaster_account"] = "off"
+	}
+	if store.aliases != nil {
+		cfg["aliases_max_depth"] = store.aliases.maxDepth
+		cfg["aliases_cache_ttl"] = store.aliases.ttl.String()
+	}
+	if store.optimizeInterval != 0 {
+		cfg["optimize_interval"] = store.optimizeInterval.String()
+	}
+	if store.deliveryLimiter != nil {
+		cfg["max_concurrent_deliveries_per_user"] = store.deliveryLimiter.max
+	}
+
+	if store.opts != nil {
+		if limit := store.appendLimit(); limit != nil {
+			cfg["appendlimit"] = *limit
+		} else {
+			cfg["appendlimit"] = -1
+		}
+		compression := []string{"off"}
+		if store.opts.CompressAlgo != "" {
+			compression = []string{store.opts.CompressAlgo}
+			if store.opts.CompressAlgoParams != "" {
+				compression = append(compression, store.opts.CompressAlgoParams)
+			}
+		}
+		cfg["compression"] = compression
+		cfg["disable_recent"] = store.opts.DisableRecent
+		if store.driver == "sqlite3" {
+			cfg["sqlite3_cache_size"] = store.opts.CacheSize
+			cfg["sqlite3_busy_timeout"] = store.opts.BusyTimeout
+		}
+	}
+	if store.driver == "sqlite3" {
+		cfg["sqlite3_mmap_size"] = store.sqliteMmapSize
+		cfg["sqlite3_page_size"] = store.sqlitePageSize
+	}
+
+	if store.blobStore != nil {
+		msgStore := map[string]interface{}{}
+		if mod, ok := store.blobStore.(module.Module); ok {
+			msgStore["module"] = mod.Name()
+			msgStore["instance"] = mod.InstanceName()
+		}
+		if rooted, ok := store.blobStore.(interface{ Root() string }); ok {
+			msgStore["root"] = rooted.Root()
+		}
+		cfg["msg_store"] = msgStore
+	}
+
+	return cfg
+}
+
+// redactDSN replaces passwords in the DSN with a placeholder. If DSN
+// cannot be parsed, it is redacted completely.
+func redactDSN(driver, dsn string) string {
+	switch driver {
+	case "postgres":
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			u, err := url.Parse(dsn)
+			if err != nil {
+				return redactedValue
+			}
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redactedValue)
+			}
+			u.RawQuery = redactQuery(u.Query())
+			return u.String()
+		}
+		opts, err := pqParseOpts(dsn)
+		if err != nil {
+			return redactedValue
+		}
+		keys := make([]string, 0, len(opts))
+		for k := range opts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			v := opts[k]
+			if isSecretParam(k) {
+				v = redactedValue
+			}
+			parts = append(parts, k+"="+pqQuote(v))
+		}
+		return strings.Join(parts, " ")
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return redactedValue
+		}
+		if cfg.Passwd != "" {
+			userPass := cfg.User + ":" + cfg.Passwd + "@"
+			if !strings.Contains(dsn, userPass) {
+				return redactedValue
+			}
+			dsn = strings.Replace(dsn, userPass, cfg.User+":"+redactedValue+"@", 1)
+		}
+		base, query, ok := strings.Cut(dsn, "?")
+		if !ok {
+			return dsn
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return redactedValue
+		}
+		return base + "?" + redactQuery(values)
+	default:
+		// SQLite DSN is a file path, optionally with URI parameters
+		// (including _auth_pass).
+		base, query, ok := strings.Cut(dsn, "?")
+		if !ok {
+			return dsn
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return redactedValue
+		}
+		return base + "?" + redactQuery(values)
+	}
+}
+
+func redactQuery(values url.Values) string {
+	for k := range values {
+		if isSecretParam(k) {
+			values[k] = []string{redactedValue}
+		}
+	}
+	return values.Encode()
+}
+
+func isSecretParam(key string) bool {
+	switch strings.ToLower(key) {
+	case "password", "sslpassword", "passwd", "_auth_pass":
+		return true
+	}
+	return false
+}
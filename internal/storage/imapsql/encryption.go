@@ -0,0 +1,406 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// Encrypted object format:
+//
+//	magic (4 bytes) | version (1 byte) | key ID length (1 byte) | key ID |
+//	nonce prefix (8 bytes) | chunks...
+//
+// Plaintext is split into encChunkSize chunks, each one is sealed using
+// AES-256-GCM with nonce = nonce prefix | chunk index (4 bytes, big-endian).
+// Additional data is a single byte set to 1 for the last chunk and to 0
+// for others, it prevents truncation of the object at the chunk boundary.
+// The last chunk can be empty.
+const (
+	encMagic       = "MDYE"
+	encVersion     = 1
+	encNoncePrefix = 8
+	encChunkSize   = 64 * 1024
+	encTagSize     = 16
+)
+
+// encryptionConfig is the parsed encryption block.
+type encryptionConfig struct {
+	keys       map[string]cipher.AEAD
+	currentKey string
+	// If true, objects without the encryption header are returned as is.
+	allowUnencrypted bool
+}
+
+func parseEncryptionKey(value string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key should be 32 bytes long (64 hex digits), got %d bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseEncryption(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	cfg := &encryptionConfig{
+		keys:             make(map[string]cipher.AEAD),
+		allowUnencrypted: true,
+	}
+	for _, child := range node.Children {
+		switch child.Name {
+		case "key", "key_file":
+			if len(child.Args) != 2 {
+				return nil, config.NodeErr(child, "key ID and value required")
+			}
+			id, value := child.Args[0], child.Args[1]
+			if len(id) == 0 || len(id) > 255 {
+				return nil, config.NodeErr(child, "key ID should be 1-255 bytes long")
+			}
+			if _, ok := cfg.keys[id]; ok {
+				return nil, config.NodeErr(child, "duplicate key ID: %s", id)
+			}
+			if child.Name == "key_file" {
+				blob, err := os.ReadFile(value)
+				if err != nil {
+					return nil, config.NodeErr(child, "%v", err)
+				}
+				value = string(blob)
+			}
+			aead, err := parseEncryptionKey(value)
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			cfg.keys[id] = aead
+			if cfg.currentKey == "" {
+				cfg.currentKey = id
+			}
+		case "current_key":
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "exactly one key ID required")
+			}
+			cfg.currentKey = child.Args[0]
+		case "allow_unencrypted":
+			if len(child.Args) != 1 || (child.Args[0] != "yes" && child.Args[0] != "no") {
+				return nil, config.NodeErr(child, "yes or no expected")
+			}
+			cfg.allowUnencrypted = child.Args[0] == "yes"
+		default:
+			return nil, config.NodeErr(child, "unknown directive: %s", child.Name)
+		}
+	}
+
+	if len(cfg.keys) == 0 {
+		return nil, config.NodeErr(node, "at least one key is required")
+	}
+	if _, ok := cfg.keys[cfg.currentKey]; !ok {
+		return nil, config.NodeErr(node, "unknown current_key: %s", cfg.currentKey)
+	}
+	return cfg, nil
+}
+
+// encryptedSize returns the size of the encrypted object for the plaintext
+// of the specified size. Non-positive sizes mean that the size is unknown
+// and are returned as is.
+func encryptedSize(keyID string, size int64) int64 {
+	if size <= 0 {
+		return size
+	}
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	return int64(len(encMagic)+2+len(keyID)+encNoncePrefix) + size + chunks*encTagSize
+}
+
+func chunkNonce(prefix []byte, idx uint32) []byte {
+	nonce := make([]byte, encNoncePrefix+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNoncePrefix:], idx)
+	return nonce
+}
+
+// encryptedStore is imapsql.ExternalStore that encrypts objects stored in
+// the underlying store.
+type encryptedStore struct {
+	Base imapsql.ExternalStore
+	cfg  *encryptionConfig
+}
+
+func (e encryptedStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	obj, err := e.Base.Create(key, encryptedSize(e.cfg.currentKey, objSize))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encNoncePrefix)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return &encryptingObj{
+		ExtStoreObj: obj,
+		key:         key,
+		keyID:       e.cfg.currentKey,
+		aead:        e.cfg.keys[e.cfg.currentKey],
+		prefix:      prefix,
+		buf:         make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (e encryptedStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	obj, err := e.Base.Open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(obj, encChunkSize+encTagSize)
+	magic, err := br.Peek(len(encMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		obj.Close()
+		return nil, err
+	}
+	if string(magic) != encMagic {
+		if !e.cfg.allowUnencrypted {
+			obj.Close()
+			return nil, imapsql.ExternalError{Key: key, Err: errors.New("imapsql: object is not encrypted")}
+		}
+		return &plainObj{ExtStoreObj: obj, r: br}, nil
+	}
+
+	hdr := make([]byte, len(encMagic)+2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		obj.Close()
+		return nil, imapsql.ExternalError{Key: key, Err: fmt.Errorf("imapsql: malformed encryption header: %w", err)}
+	}
+	if hdr[len(encMagic)] != encVersion {
+		obj.Close()
+		return nil, imapsql.ExternalError{Key: key, Err: fmt.Errorf("imapsql: unknown encryption format version: %d", hdr[len(encMagic)])}
+	}
+	rest := make([]byte, int(hdr[len(encMagic)+1])+encNoncePrefix)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		obj.Close()
+		return nil, imapsql.ExternalError{Key: key, Err: fmt.Errorf("imapsql: malformed encryption header: %w", err)}
+	}
+	keyID := string(rest[:len(rest)-encNoncePrefix])
+	aead, ok := e.cfg.keys[keyID]
+	if !ok {
+		obj.Close()
+		return nil, imapsql.ExternalError{Key: key, Err: fmt.Errorf("imapsql: object is encrypted using unknown key %s", keyID)}
+	}
+
+	return &decryptingObj{
+		ExtStoreObj: obj,
+		r:           br,
+		aead:        aead,
+		prefix:      rest[len(rest)-encNoncePrefix:],
+		chunk:       make([]byte, encChunkSize+encTagSize),
+	}, nil
+}
+
+func (e encryptedStore) Delete(keys []string) error {
+	return e.Base.Delete(keys)
+}
+
+type encryptingObj struct {
+	imapsql.ExtStoreObj
+
+	key    string
+	keyID  string
+	aead   cipher.AEAD
+	prefix []byte
+
+	hdrWritten bool
+	idx        uint32
+	buf        []byte
+	finished   bool
+}
+
+func (o *encryptingObj) writeHeader() error {
+	if o.hdrWritten {
+		return nil
+	}
+	hdr := make([]byte, 0, len(encMagic)+2+len(o.keyID)+encNoncePrefix)
+	hdr = append(hdr, encMagic...)
+	hdr = append(hdr, encVersion, byte(len(o.keyID)))
+	hdr = append(hdr, o.keyID...)
+	hdr = append(hdr, o.prefix...)
+	if _, err := o.ExtStoreObj.Write(hdr); err != nil {
+		return err
+	}
+	o.hdrWritten = true
+	return nil
+}
+
+func (o *encryptingObj) sealChunk(final bool) error {
+	if o.idx == ^uint32(0) {
+		return errors.New("imapsql: object is too big to be encrypted")
+	}
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	sealed := o.aead.Seal(nil, chunkNonce(o.prefix, o.idx), o.buf, ad)
+	o.idx++
+	o.buf = o.buf[:0]
+	_, err := o.ExtStoreObj.Write(sealed)
+	return err
+}
+
+func (o *encryptingObj) Write(p []byte) (int, error) {
+	if o.finished {
+		return 0, errors.New("imapsql: write to finished encrypted object")
+	}
+	if err := o.writeHeader(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// The full chunk is sealed only when more data is written, so the
+		// last chunk is always sealed as final in Sync.
+		if len(o.buf) == encChunkSize {
+			if err := o.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(o.buf[len(o.buf):encChunkSize], p)
+		o.buf = o.buf[:len(o.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Sync seals the last chunk and syncs the underlying object. No data can be
+// written after it.
+//
+// Objects not synced before Close are incomplete and are not readable.
+func (o *encryptingObj) Sync() error {
+	if o.finished {
+		return errors.New("imapsql: encrypted object is already synced")
+	}
+	o.finished = true
+
+	if err := o.writeHeader(); err != nil {
+		return err
+	}
+	if err := o.sealChunk(true); err != nil {
+		return err
+	}
+	return o.ExtStoreObj.Sync()
+}
+
+func (o *encryptingObj) Read([]byte) (int, error) {
+	return 0, errors.New("imapsql: read from object opened for writing")
+}
+
+type decryptingObj struct {
+	imapsql.ExtStoreObj
+
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+
+	idx     uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+	lastErr error
+}
+
+func (o *decryptingObj) readChunk() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	final := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := o.r.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < encTagSize {
+		return errors.New("imapsql: encrypted object is truncated")
+	}
+
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	plain, err := o.aead.Open(o.chunk[:0], chunkNonce(o.prefix, o.idx), o.chunk[:n], ad)
+	if err != nil {
+		return fmt.Errorf("imapsql: failed to decrypt object: %w", err)
+	}
+	o.idx++
+	o.plain = plain
+	o.done = final
+	return nil
+}
+
+func (o *decryptingObj) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.lastErr != nil {
+			return 0, o.lastErr
+		}
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.readChunk(); err != nil {
+			o.lastErr = err
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// plainObj is returned for objects stored before encryption was enabled.
+type plainObj struct {
+	imapsql.ExtStoreObj
+	r io.Reader
+}
+
+func (o *plainObj) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
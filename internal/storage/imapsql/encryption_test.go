@@ -0,0 +1,398 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memExtObj struct {
+	store *memExtStore
+	key   string
+	buf   bytes.Buffer
+}
+
+func (o *memExtObj) Sync() error {
+	o.store.objs[o.key] = append([]byte(nil), o.buf.Bytes()...)
+	return nil
+}
+
+func (o *memExtObj) Read(p []byte) (int, error)  { return o.buf.Read(p) }
+func (o *memExtObj) Write(p []byte) (int, error) { return o.buf.Write(p) }
+func (o *memExtObj) Close() error                { return nil }
+
+type memExtStore struct {
+	objs  map[string][]byte
+	sizes map[string]int64
+}
+
+func (s *memExtStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	s.sizes[key] = objSize
+	return &memExtObj{store: s, key: key}, nil
+}
+
+func (s *memExtStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	blob, ok := s.objs[key]
+	if !ok {
+		return nil, imapsql.ExternalError{Key: key, NonExistent: true}
+	}
+	o := &memExtObj{store: s, key: key}
+	o.buf.Write(blob)
+	return o, nil
+}
+
+func (s *memExtStore) Delete(keys []string) error {
+	for _, k := range keys {
+		delete(s.objs, k)
+	}
+	return nil
+}
+
+func testEncryptionConfig(t *testing.T, children ...config.Node) *encryptionConfig {
+	t.Helper()
+	cfg, err := parseEncryption(nil, config.Node{Name: "encryption", Children: children})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.(*encryptionConfig)
+}
+
+func testKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+func putObj(t *testing.T, s imapsql.ExternalStore, key string, body []byte) {
+	t.Helper()
+	obj, err := s.Create(key, int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getObj(s imapsql.ExternalStore, key string) ([]byte, error) {
+	obj, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	mem := &memExtStore{objs: map[string][]byte{}, sizes: map[string]int64{}}
+	cfg := testEncryptionConfig(t, config.Node{Name: "key", Args: []string{"k1", testKey(t)}})
+	s := encryptedStore{Base: mem, cfg: cfg}
+
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3 * encChunkSize} {
+		body := make([]byte, size)
+		if _, err := rand.Read(body); err != nil {
+			t.Fatal(err)
+		}
+		putObj(t, s, "obj", body)
+
+		stored := mem.objs["obj"]
+		// Short bodies can appear in the ciphertext by chance.
+		if size > 16 && bytes.Contains(stored, body) {
+			t.Errorf("%d: plaintext is stored", size)
+		}
+		if size > 0 && mem.sizes["obj"] != int64(len(stored)) {
+			t.Errorf("%d: wrong object size passed to the store: %d, actual %d", size, mem.sizes["obj"], len(stored))
+		}
+
+		got, err := getObj(s, "obj")
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%d: body mismatch after round trip", size)
+		}
+	}
+}
+
+func TestEncryptedStore_Compressed(t *testing.T) {
+	mem := &memExtStore{objs: map[string][]byte{}, sizes: map[string]int64{}}
+	cfg := testEncryptionConfig(t, config.Node{Name: "key", Args: []string{"k1", testKey(t)}})
+	s := flushingStore{ExternalStore: encryptedStore{Base: mem, cfg: cfg}}
+
+	for _, algo := range []imapsql.CompressionAlgo{gzipCompression{}, lz4Compression{}, zstdCompression{}} {
+		for _, size := range []int{0, 100, 3 * encChunkSize} {
+			body := make([]byte, size)
+			if _, err := rand.Read(body); err != nil {
+				t.Fatal(err)
+			}
+
+			// Same order of calls as in go-imap-sql: the compression writer
+			// is closed again after Sync and the error is ignored.
+			obj, err := s.Create("obj", -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := flushingCompression{algo}.WrapCompress(obj, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(body); err != nil {
+				t.Fatal(err)
+			}
+			if err := obj.Sync(); err != nil {
+				t.Fatalf("%T %d: %v", algo, size, err)
+			}
+			w.Close()
+			obj.Close()
+
+			rObj, err := s.Open("obj")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := algo.WrapDecompress(rObj)
+			if err != nil {
+				t.Fatalf("%T %d: %v", algo, size, err)
+			}
+			got, err := io.ReadAll(r)
+			rObj.Close()
+			if err != nil {
+				t.Fatalf("%T %d: %v", algo, size, err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("%T %d: body mismatch after round trip", algo, size)
+			}
+		}
+	}
+}
+
+// failingExtStore is memExtStore that fails the specified Write call or
+// Sync of created objects.
+type failingExtStore struct {
+	*memExtStore
+	failWrite int
+	failSync  bool
+}
+
+type failingExtObj struct {
+	imapsql.ExtStoreObj
+	store  *failingExtStore
+	writes int
+}
+
+func (s *failingExtStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	obj, err := s.memExtStore.Create(key, objSize)
+	if err != nil {
+		return nil, err
+	}
+	return &failingExtObj{ExtStoreObj: obj, store: s}, nil
+}
+
+func (o *failingExtObj) Write(p []byte) (int, error) {
+	o.writes++
+	if o.writes == o.store.failWrite {
+		return 0, errors.New("write failed")
+	}
+	return o.ExtStoreObj.Write(p)
+}
+
+func (o *failingExtObj) Sync() error {
+	if o.store.failSync {
+		return errors.New("sync failed")
+	}
+	return o.ExtStoreObj.Sync()
+}
+
+func TestEncryptedStore_FailingBase(t *testing.T) {
+	cfg := testEncryptionConfig(t, config.Node{Name: "key", Args: []string{"k1", testKey(t)}})
+
+	for _, test := range []struct {
+		name      string
+		failWrite int
+		failSync  bool
+	}{
+		// The header is written by the first Write, the only chunk is sealed
+		// by Sync.
+		{name: "last write", failWrite: 2},
+		{name: "sync", failSync: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			base := &failingExtStore{
+				memExtStore: &memExtStore{objs: map[string][]byte{}, sizes: map[string]int64{}},
+				failWrite:   test.failWrite,
+				failSync:    test.failSync,
+			}
+			s := flushingStore{ExternalStore: encryptedStore{Base: base, cfg: cfg}}
+
+			obj, err := s.Create("obj", -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := flushingCompression{gzipCompression{}}.WrapCompress(obj, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := obj.Sync(); err == nil {
+				t.Error("expected Sync to fail")
+			}
+			if _, err := obj.Write([]byte("more")); err == nil {
+				t.Error("expected Write after Sync to fail")
+			}
+			obj.Close()
+
+			// Delivery should fail as well instead of committing the message
+			// with a broken body.
+			store := newTestStorageExt(t, s, imapsql.Opts{CompressAlgo: "gzip"})
+			if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"test@example.org"}); err == nil {
+				t.Fatal("expected delivery to fail")
+			}
+
+			u, err := store.GetIMAPAcct("test@example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Messages != 0 {
+				t.Errorf("expected no messages in INBOX, got %d", status.Messages)
+			}
+		})
+	}
+}
+
+func TestEncryptedStore_Truncated(t *testing.T) {
+	mem := &memExtStore{objs: map[string][]byte{}, sizes: map[string]int64{}}
+	cfg := testEncryptionConfig(t, config.Node{Name: "key", Args: []string{"k1", testKey(t)}})
+	s := encryptedStore{Base: mem, cfg: cfg}
+
+	putObj(t, s, "obj", bytes.Repeat([]byte{'A'}, 2*encChunkSize+10))
+	hdrLen := len(encMagic) + 2 + len("k1") + encNoncePrefix
+
+	// Drop the last chunk, leaving only complete non-final chunks.
+	mem.objs["obj"] = mem.objs["obj"][:hdrLen+2*(encChunkSize+encTagSize)]
+	if _, err := getObj(s, "obj"); err == nil {
+		t.Error("expected an error for truncated object")
+	}
+
+	putObj(t, s, "obj", []byte("hello"))
+	mem.objs["obj"][len(mem.objs["obj"])-1] ^= 1
+	if _, err := getObj(s, "obj"); err == nil {
+		t.Error("expected an error for modified object")
+	}
+}
+
+func TestEncryptedStore_Rotation(t *testing.T) {
+	mem := &memExtStore{objs: map[string][]byte{}, sizes: map[string]int64{}}
+	dir := t.TempDir()
+	oldKey, newKey := testKey(t), testKey(t)
+	keyPath := filepath.Join(dir, "new.key")
+	if err := os.WriteFile(keyPath, []byte(newKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore := encryptedStore{Base: mem, cfg: testEncryptionConfig(t,
+		config.Node{Name: "key", Args: []string{"old", oldKey}},
+	)}
+	putObj(t, oldStore, "a", []byte("old message"))
+
+	newStore := encryptedStore{Base: mem, cfg: testEncryptionConfig(t,
+		config.Node{Name: "key", Args: []string{"old", oldKey}},
+		config.Node{Name: "key_file", Args: []string{"new", keyPath}},
+		config.Node{Name: "current_key", Args: []string{"new"}},
+	)}
+	putObj(t, newStore, "b", []byte("new message"))
+
+	for key, expected := range map[string]string{"a": "old message", "b": "new message"} {
+		got, err := getObj(newStore, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Errorf("%s: wrong body: %q", key, got)
+		}
+	}
+
+	if _, err := getObj(oldStore, "b"); err == nil {
+		t.Error("expected an error for object encrypted using unknown key")
+	}
+}
+
+func TestEncryptedStore_Unencrypted(t *testing.T) {
+	mem := &memExtStore{objs: map[string][]byte{"plain": []byte("plain message")}, sizes: map[string]int64{}}
+	key := config.Node{Name: "key", Args: []string{"k1", testKey(t)}}
+
+	s := encryptedStore{Base: mem, cfg: testEncryptionConfig(t, key)}
+	got, err := getObj(s, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "plain message" {
+		t.Errorf("wrong body: %q", got)
+	}
+
+	s = encryptedStore{Base: mem, cfg: testEncryptionConfig(t, key,
+		config.Node{Name: "allow_unencrypted", Args: []string{"no"}},
+	)}
+	if _, err := getObj(s, "plain"); err == nil {
+		t.Error("expected an error for unencrypted object")
+	}
+}
+
+func TestParseEncryption_Invalid(t *testing.T) {
+	for _, children := range [][]config.Node{
+		nil,
+		{{Name: "key", Args: []string{"k1", "abcd"}}},
+		{{Name: "key", Args: []string{"k1", "zz"}}},
+		{{Name: "key", Args: []string{"k1", testKey(t)}}, {Name: "current_key", Args: []string{"k2"}}},
+		{{Name: "key", Args: []string{"k1", testKey(t)}}, {Name: "key", Args: []string{"k1", testKey(t)}}},
+		{{Name: "key_file", Args: []string{"k1", filepath.Join(t.TempDir(), "nonexistent")}}},
+	} {
+		if _, err := parseEncryption(nil, config.Node{Name: "encryption", Children: children}); err == nil {
+			t.Errorf("expected an error for %v", children)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// checkFlags validates and canonicalizes the list of flags specified in the
+// configuration.
+//
+// Only system flags that can be set by clients are allowed, \Recent is
+// managed by the server. Keywords should be valid IMAP atoms.
+func checkFlags(flags []string) ([]string, error) {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if strings.HasPrefix(f, "\\") {
+			switch canon := imap.CanonicalFlag(f); canon {
+			case imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag:
+				res = append(res, canon)
+				continue
+			}
+			return nil, fmt.Errorf("unsupported system flag: %s", f)
+		}
+		if f == "" || strings.ContainsAny(f, "(){ %*\"]\\") {
+			return nil, fmt.Errorf("malformed keyword: %q", f)
+		}
+		for _, ch := range f {
+			if ch <= 0x1f || ch >= 0x7f {
+				return nil, fmt.Errorf("malformed keyword: %q", f)
+			}
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// deliveryFlags returns the flags to set on the message stored for the
+// recipient, before imap_filter flags are applied.
+func (d *delivery) deliveryFlags() []string {
+	var flags []string
+	flags = append(flags, d.store.initialFlags...)
+	if d.msgMeta.Quarantine {
+		flags = append(flags, d.store.quarantineFlags...)
+	}
+	return flags
+}
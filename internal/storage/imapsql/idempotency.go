@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// deliveryLog keeps idempotency keys of recently delivered messages in the
+// maddy_delivered table of the storage database so messages retried by
+// the upstream server are not stored twice.
+type deliveryLog struct {
+	db     *sql.DB
+	driver string
+	window time.Duration
+
+	cleanupLck  sync.Mutex
+	lastCleanup time.Time
+}
+
+func newDeliveryLog(db *sql.DB, driver string, window time.Duration) (*deliveryLog, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_delivered (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			delivered BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("create table maddy_delivered: %w", err)
+	}
+	return &deliveryLog{db: db, driver: driver, window: window}, nil
+}
+
+// idempotencyKey returns the key identifying the delivery of the message
+// with the specified Message-Id to the account.
+func idempotencyKey(msgID, accountName string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(msgID) + "\x00" + accountName))
+	return hex.EncodeToString(sum[:])
+}
+
+// Seen reports whether the key was recorded within the window.
+func (l *deliveryLog) Seen(ctx context.Context, key string) (bool, error) {
+	var delivered int64
+	err := l.db.QueryRowContext(ctx, rebindQuery(l.driver, `SELECT delivered FROM maddy_delivered WHERE id = ?`), key).Scan(&delivered)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return time.Since(time.Unix(delivered, 0)) < l.window, nil
+}
+
+// Record saves the key with the current time. Keys older than the window
+// are removed from time to time.
+func (l *deliveryLog) Record(ctx context.Context, key string) error {
+	now := time.Now()
+	update := rebindQuery(l.driver, `UPDATE maddy_delivered SET delivered = ? WHERE id = ?`)
+
+	// Insert may fail if the row was created concurrently, in this case
+	// the update is retried.
+	for i := 0; i < 2; i++ {
+		res, err := l.db.ExecContext(ctx, update, now.Unix(), key)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 0 {
+			break
+		}
+
+		_, err = l.db.ExecContext(ctx, rebindQuery(l.driver, `INSERT INTO maddy_delivered (id, delivered) VALUES (?, ?)`),
+			key, now.Unix())
+		if err == nil {
+			break
+		}
+		if i == 1 {
+			return err
+		}
+	}
+
+	l.cleanupLck.Lock()
+	defer l.cleanupLck.Unlock()
+	if now.Sub(l.lastCleanup) < l.window {
+		return nil
+	}
+	l.lastCleanup = now
+	_, err := l.db.ExecContext(ctx, rebindQuery(l.driver, `DELETE FROM maddy_delivered WHERE delivered < ?`),
+		now.Add(-l.window).Unix())
+	return err
+}
+
+// dropDuplicates removes recipients that already got the message with the
+// same Message-Id within idempotency_window. It returns false if no
+// recipients are left and the message should not be stored at all.
+//
+// Lookup errors are logged and the message is stored for the recipient.
+func (d *delivery) dropDuplicates(ctx context.Context, header textproto.Header) (bool, error) {
+	d.msgIDKey = header.Get("Message-Id")
+	if d.msgIDKey == "" {
+		return true, nil
+	}
+
+	var dups []string
+	for rcpt := range d.addedRcpts {
+		seen, err := d.store.deliveryLog.Seen(ctx, idempotencyKey(d.msgIDKey, rcpt))
+		if err != nil {
+			d.store.log.Error("idempotency key lookup failed", err, "rcpt", d.store.logAddr(rcpt), "msg_id", d.msgMeta.ID)
+			continue
+		}
+		if seen {
+			dups = append(dups, rcpt)
+		}
+	}
+	if len(dups) == 0 {
+		return true, nil
+	}
+	for _, rcpt := range dups {
+		d.store.log.Msg("duplicate message, not stored", "rcpt", d.store.logAddr(rcpt), "msg_id", d.msgMeta.ID)
+		delete(d.addedRcpts, rcpt)
+	}
+	if len(d.addedRcpts) == 0 {
+		return false, nil
+	}
+
+	// go-imap-sql does not allow to remove recipients, so the delivery is
+	// started over with the remaining ones.
+	if err := d.d.Abort(); err != nil {
+		return false, err
+	}
+	d.d = d.store.Back.NewDelivery()
+	for rcpt, rcptData := range d.addedRcpts {
+		if err := d.addRcpt(rcpt, rcptData.deliveredTo); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// recordDelivered saves idempotency keys for stored recipients. Errors are
+// logged.
+func (d *delivery) recordDelivered(ctx context.Context) {
+	if d.msgIDKey == "" {
+		return
+	}
+	for rcpt := range d.addedRcpts {
+		if err := d.store.deliveryLog.Record(ctx, idempotencyKey(d.msgIDKey, rcpt)); err != nil {
+			d.store.log.Error("failed to record idempotency key", err, "rcpt", d.store.logAddr(rcpt), "msg_id", d.msgMeta.ID)
+		}
+	}
+}
@@ -32,16 +32,23 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-smtp"
 	mess "github.com/foxcpp/go-imap-mess"
 	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/container"
@@ -50,6 +57,7 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/framework/module/modules"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/foxcpp/maddy/internal/updatepipe/pubsub"
@@ -65,27 +73,150 @@ type Storage struct {
 	instName string
 	log      *log.Logger
 
-	junkMbox string
+	junkMbox            string
+	quarantineMbox      string
+	nullSenderMbox      string
+	initialFlags        []string
+	quarantineFlags     []string
+	folderSeparator     string
+	createSpecialMboxes bool
+	imapExts            []string
 
-	driver    string
-	dsn       []string
-	blobStore module.BlobStore
-	opts      *imapsql.Opts
+	errNoUser      string
+	errInvalidRcpt string
+
+	driver string
+	dsn    []string
+	dsnSrv string
+
+	// Values of driver and dsn as specified in the configuration, used by
+	// Reconfigure to detect changes.
+	cfgDriver string
+	cfgDSN    []string
+
+	// reconfLck guards options changed by Reconfigure.
+	reconfLck sync.RWMutex
+
+	connectRetries  int
+	connectTimeout  time.Duration
+	connMaxIdleTime time.Duration
+	validateConns   bool
+	blobStore       module.BlobStore
+	opts            *imapsql.Opts
+
+	sqliteMmapSize int64
+	sqlitePageSize int
+	inMemory       bool
+
+	usageTracking bool
+	usageSink     UsageSink
+
+	idempotency       bool
+	idempotencyWindow time.Duration
+	deliveryLog       *deliveryLog
+
+	maildirMirror   string
+	coalesceUpdates time.Duration
+	stripHeaders    []string
+	maxHeaderSize   int64
+	nullSenderMax   int64
+	validateMIME    bool
+	normalizeCRLF   bool
+	encryption      *encryptionConfig
+	storeChecksums  bool
+	maxReceivedHops int
+
+	hostname      string
+	generateMsgID bool
+	authHeader    bool
+	origFromHdr   bool
+
+	storeAuthResults bool
+	addReceived      bool
+	hostnameFromMeta bool
+
+	dsnTarget        module.DeliveryTarget
+	dsnNotify        []smtp.DSNNotify
+	autogenMsgDomain string
+	dsnWg            sync.WaitGroup
+
+	mirrorTo       module.DeliveryTarget
+	mirrorRequired bool
+
+	plusAddressing   bool
+	detailSeparator  string
+	plusCreateFolder bool
+
+	rewriteRules []rewriteRule
+
+	maxRcpts         int
+	alwaysBcc        string
+	archiveByDate    string
+	archiveRaw       bool
+	saveToSent       bool
+	postmasterAcct   string
+	createPostmaster bool
+	perDomain        bool
+	deliveryLimiter  *deliveryLimiter
+	lookupDSN        []string
+	lookupReplica    *lookupReplica
+	provisioning     module.Table
+	rcptLookup       module.Table
+	rcptLookupRate   *limiters.Rate
+	deliveryTimeout  time.Duration
+
+	preload     []string
+	preloadStop chan struct{}
+	preloadDone chan struct{}
+
+	trashRetention time.Duration
+	trashAccounts  []string
+	trashStop      chan struct{}
+	trashDone      chan struct{}
+	trashLogLck    sync.Mutex
+	trashLog       *trashLog
+
+	optimizeInterval time.Duration
+	optimizeStop     chan struct{}
+	optimizeDone     chan struct{}
+
+	// Number of deliveries started and not yet committed or aborted.
+	activeDeliveries atomic.Int64
+
+	auditLogPath    string
+	auditLogMaxSize int64
+	auditLog        *auditLog
 
 	resolver dns.Resolver
 
+	redactPII bool
+
 	updPipe      updatepipe.P
 	updPushStop  chan struct{}
 	outboundUpds chan mess.Update
 
-	filters module.IMAPFilter
+	filters   module.IMAPFilter
+	sieveLite *sieveLite
 
 	deliveryMap       module.Table
+	sharedMailboxes   module.Table
+	aliases           *aliasResolver
+	hostnameMap       module.Table
+	inboxSplit        module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
 	authNormalize     func(context.Context, string) (string, error)
 }
 
+// logAddr returns the address or account name in the form suitable for
+// logging, see redact_pii.
+func (store *Storage) logAddr(addr string) string {
+	if store.redactPII {
+		return address.Redact(addr)
+	}
+	return addr
+}
+
 func (store *Storage) Name() string {
 	return modName
 }
@@ -118,25 +249,58 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 		dsn               []string
 		appendlimitVal    int64 = -1
 		compression       []string
+		compressionLevel  string
 		authNormalize     string
 		deliveryNormalize string
 
 		blobStore module.BlobStore
+		dbTLS     *dbTLSConfig
+
+		maxUserDeliveries int
+		aliasesTable      module.Table
+		aliasesMaxDepth   int
+		aliasesCacheTTL   time.Duration
+		applicationName   string
+		statementTimeout  time.Duration
+
+		dsnNotify    []string
+		sieveLiteDir string
+
+		rcptLookupRate []string
 	)
 
 	opts := &imapsql.Opts{}
 	cfg.String("driver", false, false, store.driver, &driver)
 	cfg.StringList("dsn", false, false, store.dsn, &dsn)
+	cfg.StringList("lookup_dsn", false, false, nil, &store.lookupDSN)
+	cfg.StringList("preload_accounts", false, false, nil, &store.preload)
+	cfg.Duration("trash_retention", false, false, 0, &store.trashRetention)
+	cfg.Duration("optimize_interval", false, false, 0, &store.optimizeInterval)
+	cfg.StringList("trash_retention_accounts", false, false, nil, &store.trashAccounts)
+	cfg.Bool("memory", false, false, &store.inMemory)
+	cfg.String("application_name", false, false, "", &applicationName)
+	cfg.Duration("statement_timeout", false, false, 0, &statementTimeout)
+	cfg.String("dsn_srv", false, false, "", &store.dsnSrv)
+	cfg.Int("connect_retries", false, false, 0, &store.connectRetries)
+	cfg.Duration("connect_timeout", false, false, 0, &store.connectTimeout)
+	cfg.Duration("conn_max_idle_time", false, false, 0, &store.connMaxIdleTime)
+	cfg.Bool("validate_connections", false, false, &store.validateConns)
+	cfg.Custom("tls", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, dbTLSBlock, &dbTLS)
+	cfg.Custom("encryption", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, parseEncryption, &store.encryption)
+	cfg.Bool("store_checksums", false, false, &store.storeChecksums)
 	cfg.Callback("fsstore", func(m *config.Map, node config.Node) error {
 		store.log.Msg("'fsstore' directive is deprecated, use 'msg_store fs' instead")
 		return modconfig.ModuleFromNode("storage.blob", append([]string{"fs"}, node.Args...),
 			node, m.Globals, &blobStore)
 	})
 	cfg.Custom("msg_store", false, false, func() (interface{}, error) {
-		var store module.BlobStore
-		err := modconfig.ModuleFromNode("storage.blob", []string{"fs", "messages"},
-			config.Node{}, nil, &store)
-		return store, err
+		// Default is initialized below since it depends on the memory
+		// directive.
+		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
 		var store module.BlobStore
 		err := modconfig.ModuleFromNode("storage.blob", node.Args,
@@ -144,12 +308,51 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 		return store, err
 	}, &blobStore)
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
+	cfg.String("compression_level", false, false, "", &compressionLevel)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.log.Debug)
+	cfg.Bool("redact_pii", false, true, &store.redactPII)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
+	cfg.DataSize("sqlite3_mmap_size", false, false, 0, &store.sqliteMmapSize)
+	cfg.Int("sqlite3_page_size", false, false, 0, &store.sqlitePageSize)
 	cfg.Bool("disable_recent", false, true, &opts.DisableRecent)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.String("quarantine_mailbox", false, false, "", &store.quarantineMbox)
+	cfg.String("null_sender_mailbox", false, false, "", &store.nullSenderMbox)
+	cfg.StringList("initial_flags", false, false, nil, &store.initialFlags)
+	cfg.StringList("quarantine_flags", false, false, nil, &store.quarantineFlags)
+	cfg.String("folder_separator", false, false, "/", &store.folderSeparator)
+	cfg.Bool("create_special_mailboxes", false, true, &store.createSpecialMboxes)
+	cfg.StringList("imap_extensions", false, false, nil, &store.imapExts)
+	cfg.Bool("usage_tracking", false, false, &store.usageTracking)
+	cfg.Bool("idempotency", false, false, &store.idempotency)
+	cfg.Duration("idempotency_window", false, false, 24*time.Hour, &store.idempotencyWindow)
+	cfg.String("maildir_mirror", false, false, "", &store.maildirMirror)
+	cfg.StringList("strip_headers", false, false, nil, &store.stripHeaders)
+	cfg.DataSize("max_header_size", false, false, 1024*1024, &store.maxHeaderSize)
+	cfg.DataSize("null_sender_max_size", false, false, 0, &store.nullSenderMax)
+	cfg.Int("max_received_hops", false, false, 30, &store.maxReceivedHops)
+	cfg.Bool("validate_mime", false, false, &store.validateMIME)
+	cfg.Bool("normalize_crlf", false, false, &store.normalizeCRLF)
+	cfg.String("hostname", true, false, "", &store.hostname)
+	cfg.Custom("hostname_map", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.hostnameMap)
+	cfg.Bool("hostname_from_meta", false, false, &store.hostnameFromMeta)
+	cfg.Bool("store_auth_results", false, false, &store.storeAuthResults)
+	cfg.Bool("add_received", false, false, &store.addReceived)
+	cfg.Custom("dsn_target", false, false, nil, modconfig.DeliveryDirective, &store.dsnTarget)
+	cfg.Custom("mirror_to", false, false, nil, modconfig.DeliveryDirective, &store.mirrorTo)
+	cfg.Bool("mirror_required", false, false, &store.mirrorRequired)
+	cfg.EnumList("dsn_notify", false, false, []string{"success", "failure"}, nil, &dsnNotify)
+	cfg.String("autogenerated_msg_domain", true, false, "", &store.autogenMsgDomain)
+	cfg.Bool("generate_message_id", false, false, &store.generateMsgID)
+	cfg.Bool("auth_header", false, false, &store.authHeader)
+	cfg.Bool("original_from_header", false, false, &store.origFromHdr)
+	cfg.Duration("coalesce_updates", false, false, 0, &store.coalesceUpdates)
+	cfg.String("audit_log", false, false, "", &store.auditLogPath)
+	cfg.DataSize("audit_log_max_size", false, false, 0, &store.auditLogMaxSize)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -157,6 +360,7 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 		err := modconfig.GroupFromNode("imap_filters", node.Args, node, m.Globals, &filter)
 		return filter, err
 	}, &store.filters)
+	cfg.String("sieve_lite", false, false, "", &sieveLiteDir)
 	cfg.Custom("auth_map", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, modconfig.TableDirective, &store.authMap)
@@ -165,12 +369,50 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Custom("shared_mailboxes", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.sharedMailboxes)
+	cfg.Custom("inbox_split", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.inboxSplit)
+	cfg.Custom("aliases_table", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &aliasesTable)
+	cfg.Int("aliases_max_depth", false, false, 5, &aliasesMaxDepth)
+	cfg.Duration("aliases_cache_ttl", false, false, time.Minute, &aliasesCacheTTL)
+	cfg.Custom("rewrite_rules", false, false, nil, parseRewriteRules, &store.rewriteRules)
+	cfg.Bool("plus_addressing", false, false, &store.plusAddressing)
+	cfg.String("plus_addressing_separator", false, false, "+", &store.detailSeparator)
+	cfg.Bool("plus_addressing_create_folder", false, false, &store.plusCreateFolder)
+	cfg.Int("max_rcpts_per_message", false, false, 1000, &store.maxRcpts)
+	cfg.String("always_bcc", false, false, "", &store.alwaysBcc)
+	cfg.String("archive_by_date", false, false, "", &store.archiveByDate)
+	cfg.Bool("archive_raw", false, false, &store.archiveRaw)
+	cfg.Bool("save_to_sent", false, false, &store.saveToSent)
+	cfg.String("postmaster_account", false, false, "postmaster", &store.postmasterAcct)
+	cfg.Bool("create_postmaster", false, false, &store.createPostmaster)
+	cfg.Bool("storage_perdomain", true, false, &store.perDomain)
+	cfg.Int("max_concurrent_deliveries_per_user", false, false, 0, &maxUserDeliveries)
+	cfg.Duration("delivery_timeout", false, false, 0, &store.deliveryTimeout)
+	cfg.Custom("provisioning_policy", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.provisioning)
+	cfg.Custom("recipient_lookup", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.TableDirective, &store.rcptLookup)
+	cfg.StringList("recipient_lookup_rate", false, false, []string{"20", "1s"}, &rcptLookupRate)
+	cfg.String("err_no_user", false, false, "User does not exist", &store.errNoUser)
+	cfg.String("err_invalid_rcpt", false, false, "User does not exist", &store.errInvalidRcpt)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	store.cfgDriver, store.cfgDSN = driver, dsn
 
-	if dsn == nil {
+	if len(dsn) == 1 && dsn[0] == ":memory:" {
+		store.inMemory = true
+	}
+	if dsn == nil && store.dsnSrv == "" && !store.inMemory {
 		return errors.New("imapsql: dsn is required")
 	}
 	if driver == "" {
@@ -188,6 +430,110 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 	}
 	driver = sqliteprovider.MapDriverName(driver)
 
+	if store.inMemory {
+		if !sqliteprovider.IsSqliteDriver(driver) {
+			return errors.New("imapsql: memory is supported only for SQLite")
+		}
+		if store.dsnSrv != "" || store.lookupDSN != nil {
+			return errors.New("imapsql: memory can't be used with dsn_srv or lookup_dsn")
+		}
+		dsn = []string{memoryDSN()}
+		opts.NoWAL = true
+	}
+	if blobStore == nil {
+		if store.inMemory {
+			blobStore = newMemBlobStore()
+		} else {
+			err := modconfig.ModuleFromNode("storage.blob", []string{"fs", "messages"},
+				config.Node{}, nil, &blobStore)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if sieveLiteDir != "" {
+		info, err := os.Stat(sieveLiteDir)
+		if err != nil {
+			return fmt.Errorf("imapsql: sieve_lite: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("imapsql: sieve_lite: %s is not a directory", sieveLiteDir)
+		}
+		store.sieveLite = newSieveLite(sieveLiteDir)
+	}
+	if store.maxRcpts < 0 {
+		return errors.New("imapsql: max_rcpts_per_message should not be negative")
+	}
+	if store.archiveRaw && store.alwaysBcc == "" {
+		return errors.New("imapsql: archive_raw requires always_bcc")
+	}
+	if store.archiveByDate != "" {
+		if store.alwaysBcc == "" {
+			return errors.New("imapsql: archive_by_date requires always_bcc")
+		}
+		if err := checkArchiveTemplate(store.archiveByDate); err != nil {
+			return err
+		}
+	}
+	if store.folderSeparator == "" {
+		return errors.New("imapsql: folder_separator should not be empty")
+	}
+	if len(store.imapExts) != 0 {
+		var unknown []string
+		store.imapExts, unknown = filterIMAPExtensions(store.imapExts)
+		for _, ext := range unknown {
+			store.log.Msg("unknown extension in imap_extensions, ignoring", "extension", ext)
+		}
+	} else {
+		store.imapExts = nil
+	}
+
+	var err error
+	store.initialFlags, err = checkFlags(store.initialFlags)
+	if err != nil {
+		return fmt.Errorf("imapsql: initial_flags: %w", err)
+	}
+	store.quarantineFlags, err = checkFlags(store.quarantineFlags)
+	if err != nil {
+		return fmt.Errorf("imapsql: quarantine_flags: %w", err)
+	}
+	if store.generateMsgID && store.hostname == "" {
+		return errors.New("imapsql: hostname is required for generate_message_id")
+	}
+	if store.storeAuthResults && store.hostname == "" {
+		return errors.New("imapsql: hostname is required for store_auth_results")
+	}
+	if store.addReceived && store.hostname == "" {
+		return errors.New("imapsql: hostname is required for add_received")
+	}
+	if mirror, ok := store.mirrorTo.(*Storage); ok && mirror == store {
+		return errors.New("imapsql: mirror_to can't refer to the storage itself")
+	}
+	if store.mirrorRequired && store.mirrorTo == nil {
+		return errors.New("imapsql: mirror_required requires mirror_to")
+	}
+	if store.dsnTarget != nil {
+		if store.hostname == "" || store.autogenMsgDomain == "" {
+			return errors.New("imapsql: hostname and autogenerated_msg_domain are required for dsn_target")
+		}
+		for _, n := range dsnNotify {
+			store.dsnNotify = append(store.dsnNotify, smtp.DSNNotify(strings.ToUpper(n)))
+		}
+	}
+
+	if store.sqliteMmapSize < 0 {
+		return errors.New("imapsql: sqlite3_mmap_size should not be negative")
+	}
+	if store.sqlitePageSize != 0 {
+		if err := checkSQLitePageSize(store.sqlitePageSize); err != nil {
+			return err
+		}
+	}
+	if store.sqliteMmapSize != 0 && driver == "sqlite3" {
+		store.log.Msg("sqlite3_mmap_size is supported only by transpiled SQLite (modernc.org/sqlite), ignoring")
+	}
+
 	deliveryNormFunc, ok := authz.NormalizeFuncs[deliveryNormalize]
 	if !ok {
 		return errors.New("imapsql: unknown normalization function: " + deliveryNormalize)
@@ -195,6 +541,42 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 	store.deliveryNormalize = func(ctx context.Context, s string) (string, error) {
 		return deliveryNormFunc(s)
 	}
+	if store.plusAddressing && store.detailSeparator == "" {
+		return errors.New("imapsql: plus_addressing_separator can't be empty")
+	}
+
+	if store.idempotency && store.idempotencyWindow <= 0 {
+		return errors.New("imapsql: idempotency_window should be positive")
+	}
+	if maxUserDeliveries < 0 {
+		return errors.New("imapsql: max_concurrent_deliveries_per_user should not be negative")
+	}
+	if aliasesTable != nil {
+		if aliasesMaxDepth < 1 {
+			return errors.New("imapsql: aliases_max_depth should be at least 1")
+		}
+		store.aliases = newAliasResolver(aliasesTable, aliasesMaxDepth, aliasesCacheTTL)
+	}
+	if maxUserDeliveries != 0 {
+		store.deliveryLimiter = newDeliveryLimiter(maxUserDeliveries)
+	}
+
+	if store.alwaysBcc != "" {
+		var err error
+		store.alwaysBcc, err = deliveryNormFunc(store.alwaysBcc)
+		if err != nil {
+			return fmt.Errorf("imapsql: malformed always_bcc account name: %w", err)
+		}
+	}
+	switch store.postmasterAcct {
+	case "off":
+		store.postmasterAcct = ""
+		if store.createPostmaster {
+			return errors.New("imapsql: create_postmaster can't be used with postmaster_account off")
+		}
+	case "":
+		return errors.New("imapsql: postmaster_account can't be empty")
+	}
 	if store.deliveryMap != nil {
 		store.deliveryNormalize = func(ctx context.Context, email string) (string, error) {
 			email, err := deliveryNormFunc(email)
@@ -203,11 +585,21 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 			}
 			mapped, ok, err := store.deliveryMap.Lookup(ctx, email)
 			if err != nil || !ok {
-				return "", userDoesNotExist(err)
+				return "", store.userDoesNotExist(err)
 			}
 			return mapped, nil
 		}
 	}
+	if store.rcptLookup != nil {
+		if store.deliveryMap != nil {
+			return errors.New("imapsql: recipient_lookup can't be used together with delivery_map")
+		}
+		store.rcptLookupRate, err = newRcptLookupRate(rcptLookupRate)
+		if err != nil {
+			return err
+		}
+		store.deliveryNormalize = store.lookupRcptAccount(deliveryNormFunc)
+	}
 
 	if authNormalize != "auto" {
 		store.log.Msg("auth_normalize in storage.imapsql is deprecated and will be removed in the next release, use storage_map in imap config instead")
@@ -228,7 +620,7 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 			}
 			mapped, ok, err := store.authMap.Lookup(ctx, username)
 			if err != nil || !ok {
-				return "", userDoesNotExist(err)
+				return "", store.userDoesNotExist(err)
 			}
 			return mapped, nil
 		}
@@ -236,35 +628,41 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 
 	opts.Log = store.log
 
-	if appendlimitVal == -1 {
-		opts.MaxMsgBytes = nil
-	} else {
-		// int is 32-bit on some platforms, so cut off values we can't actually
-		// use.
-		if int64(uint32(appendlimitVal)) != appendlimitVal {
-			return errors.New("imapsql: appendlimit value is too big")
-		}
-		opts.MaxMsgBytes = new(uint32)
-		*opts.MaxMsgBytes = uint32(appendlimitVal)
+	opts.MaxMsgBytes, err = parseAppendLimit(appendlimitVal)
+	if err != nil {
+		return err
 	}
 
 	if len(compression) != 0 {
 		switch compression[0] {
-		case "zstd", "lz4":
+		case "zstd", "lz4", "gzip":
 			opts.CompressAlgo = compression[0]
+			if len(compression) > 2 {
+				return errors.New("imapsql: expected at most 2 arguments")
+			}
 			if len(compression) == 2 {
-				opts.CompressAlgoParams = compression[1]
-				if _, err := strconv.Atoi(compression[1]); err != nil {
-					return errors.New("imapsql: first argument for lz4 and zstd is compression level")
+				if compressionLevel != "" {
+					return errors.New("imapsql: compression level is specified both in compression and compression_level")
 				}
+				compressionLevel = compression[1]
 			}
-			if len(compression) > 2 {
-				return errors.New("imapsql: expected at most 2 arguments")
+			if compressionLevel != "" {
+				level, err := strconv.Atoi(compressionLevel)
+				if err != nil {
+					return errors.New("imapsql: compression level should be an integer")
+				}
+				if err := checkCompressionLevel(compression[0], level); err != nil {
+					return err
+				}
+				opts.CompressAlgoParams = compressionLevel
 			}
-		case "off":
+		case "off", "none":
 			if len(compression) > 1 {
 				return errors.New("imapsql: expected at most 1 arguments")
 			}
+			if compressionLevel != "" {
+				store.log.Msg("compression_level is set but compression is disabled, ignoring")
+			}
 		default:
 			return errors.New("imapsql: unknown compression algorithm")
 		}
@@ -281,6 +679,76 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 		return fmt.Errorf("imapsql: unknown driver %q", driver)
 	}
 
+	if err := validateDSN(driver, strings.Join(dsn, " ")); err != nil {
+		return err
+	}
+	if store.lookupDSN != nil {
+		if sqliteprovider.IsSqliteDriver(driver) {
+			return errors.New("imapsql: lookup_dsn is not supported for SQLite")
+		}
+		if err := validateDSN(driver, strings.Join(store.lookupDSN, " ")); err != nil {
+			return fmt.Errorf("imapsql: lookup_dsn: %w", err)
+		}
+	}
+	if store.dsnSrv != "" && driver != "postgres" && driver != "mysql" {
+		return fmt.Errorf("imapsql: dsn_srv is not supported for driver %s", driver)
+	}
+
+	if dbTLS != nil {
+		dsnStr, err := store.applyDBTLS(driver, strings.Join(dsn, " "), dbTLS)
+		if err != nil {
+			return err
+		}
+		dsn = []string{dsnStr}
+
+		if store.lookupDSN != nil {
+			dsnStr, err := store.applyDBTLS(driver, strings.Join(store.lookupDSN, " "), dbTLS)
+			if err != nil {
+				return err
+			}
+			store.lookupDSN = []string{dsnStr}
+		}
+	}
+
+	if driver == "postgres" || driver == "mysql" {
+		if applicationName == "" {
+			applicationName = defaultApplicationName(store.instName)
+		}
+		if err := checkApplicationName(applicationName); err != nil {
+			return err
+		}
+		dsnStr, err := applyApplicationName(driver, strings.Join(dsn, " "), applicationName)
+		if err != nil {
+			return err
+		}
+		dsn = []string{dsnStr}
+		if store.lookupDSN != nil {
+			dsnStr, err := applyApplicationName(driver, strings.Join(store.lookupDSN, " "), applicationName)
+			if err != nil {
+				return err
+			}
+			store.lookupDSN = []string{dsnStr}
+		}
+	}
+
+	if statementTimeout != 0 && (driver == "postgres" || driver == "mysql") {
+		if statementTimeout < time.Millisecond {
+			return errors.New("imapsql: statement_timeout should be at least 1ms")
+		}
+		dsnStr, err := applyStatementTimeout(driver, strings.Join(dsn, " "), statementTimeout)
+		if err != nil {
+			return err
+		}
+		dsn = []string{dsnStr}
+		if store.lookupDSN != nil {
+			dsnStr, err := applyStatementTimeout(driver, strings.Join(store.lookupDSN, " "), statementTimeout)
+			if err != nil {
+				return err
+			}
+			store.lookupDSN = []string{dsnStr}
+		}
+	}
+
 	store.driver = driver
 	store.dsn = dsn
 	store.blobStore = blobStore
@@ -293,13 +761,139 @@ func (store *Storage) Configure(inlineArgs []string, cfg *config.Map) error {
 func (store *Storage) Start() error {
 	dsnStr := strings.Join(store.dsn, " ")
 	var err error
-	store.Back, err = imapsql.New(store.driver, dsnStr, ExtBlobStore{Base: store.blobStore}, *store.opts)
+	if sqliteprovider.IsSqliteDriver(store.driver) {
+		if err := store.initSQLitePageSize(dsnStr); err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		dsnStr = store.sqliteDSN(dsnStr)
+	}
+	dsns, err := store.candidateDSNs(context.Background(), dsnStr)
 	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	if err := store.connect(dsns); err != nil {
 		return fmt.Errorf("imapsql: %s", err)
 	}
+	if store.inMemory {
+		configureMemoryDB(store.Back.DB)
+	} else if store.connMaxIdleTime != 0 {
+		store.Back.DB.SetConnMaxIdleTime(store.connMaxIdleTime)
+	}
+
+	if store.lookupDSN != nil {
+		store.lookupReplica, err = openLookupReplica(store.driver, strings.Join(store.lookupDSN, " "))
+		if err != nil {
+			return err
+		}
+		if store.connMaxIdleTime != 0 {
+			store.lookupReplica.db.SetConnMaxIdleTime(store.connMaxIdleTime)
+		}
+	}
+
+	if store.auditLogPath != "" {
+		store.auditLog, err = openAuditLog(store.auditLogPath, store.auditLogMaxSize)
+		if err != nil {
+			return fmt.Errorf("imapsql: audit_log: %w", err)
+		}
+	}
+
+	if store.usageTracking && store.usageSink == nil {
+		store.usageSink, err = newSQLUsageSink(store.Back.DB, store.driver)
+		if err != nil {
+			return fmt.Errorf("imapsql: usage_tracking: %w", err)
+		}
+	}
+
+	if store.idempotency {
+		store.deliveryLog, err = newDeliveryLog(store.Back.DB, store.driver, store.idempotencyWindow)
+		if err != nil {
+			return fmt.Errorf("imapsql: idempotency: %w", err)
+		}
+	}
+
+	if len(store.preload) != 0 {
+		store.preloadStop = make(chan struct{})
+		store.preloadDone = make(chan struct{})
+		go store.preloadAccounts(store.preload)
+	}
+	if store.trashRetention != 0 {
+		store.trashStop = make(chan struct{})
+		store.trashDone = make(chan struct{})
+		go store.sweepTrash()
+	}
+	if store.optimizeInterval != 0 {
+		store.optimizeStop = make(chan struct{})
+		store.optimizeDone = make(chan struct{})
+		go store.optimizeLoop()
+	}
 	return nil
 }
 
+// connectRetryBase is the delay before the first connection retry, it is
+// doubled for each next attempt.
+var connectRetryBase = time.Second
+
+const connectRetryMax = 30 * time.Second
+
+// extStore returns the external store used for message bodies.
+func (store *Storage) extStore() imapsql.ExternalStore {
+	var ext imapsql.ExternalStore = ExtBlobStore{Base: store.blobStore}
+	if store.storeChecksums {
+		ext = checksumStore{Base: ext, blobs: store.blobStore, log: store.log}
+	}
+	if store.encryption != nil {
+		ext = encryptedStore{Base: ext, cfg: store.encryption}
+	}
+	return flushingStore{ExternalStore: ext}
+}
+
+// connect initializes the backend using the first DSN that works.
+// If connect_retries is set, the whole list is tried again with exponential
+// backoff.
+func (store *Storage) connect(dsns []string) error {
+	var (
+		err      error
+		deadline time.Time
+		delay    = connectRetryBase
+	)
+	if store.connectTimeout != 0 {
+		deadline = time.Now().Add(store.connectTimeout)
+	}
+
+	for attempt := 0; ; attempt++ {
+		for i, dsn := range dsns {
+			store.Back, err = imapsql.New(store.driver, dsn, store.extStore(), *store.opts)
+			if err == nil {
+				if store.dsnSrv != "" {
+					store.dsn = []string{dsn}
+				}
+				return nil
+			}
+			if i != len(dsns)-1 {
+				store.log.Error("failed to connect to the database, trying next server", err)
+			}
+		}
+
+		if attempt >= store.connectRetries {
+			return err
+		}
+		// Add up to 50% of jitter so multiple instances started at the same
+		// time do not retry in lockstep.
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("connect_timeout exceeded: %w", err)
+		}
+		store.log.Error("failed to connect to the database, retrying", err,
+			"attempt", attempt+1, "retries", store.connectRetries, "delay", wait.String())
+		time.Sleep(wait)
+
+		delay *= 2
+		if delay > connectRetryMax {
+			delay = connectRetryMax
+		}
+	}
+}
+
 func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 	if store.updPipe != nil {
 		return nil
@@ -369,6 +963,27 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			}
 		}()
 
+		var (
+			pending    []mess.Update
+			flushTimer <-chan time.Time
+		)
+		push := func(u mess.Update) {
+			store.log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
+			if err := store.updPipe.Push(u); err != nil {
+				store.log.Error("IMAP update pipe push failed", err)
+			}
+		}
+		flush := func() {
+			for _, u := range pending {
+				push(u)
+			}
+			pending = nil
+			flushTimer = nil
+		}
+		// Flush coalesced updates before the remaining ones are sent
+		// by the deferred function above.
+		defer flush()
+
 		for {
 			select {
 			case u := <-inbound:
@@ -378,10 +993,16 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 				if !ok {
 					return
 				}
-				store.log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
-				if err := store.updPipe.Push(u); err != nil {
-					store.log.Error("IMAP update pipe push failed", err)
+				if store.coalesceUpdates == 0 {
+					push(u)
+					continue
+				}
+				pending = coalesceUpdate(pending, u)
+				if flushTimer == nil {
+					flushTimer = time.After(store.coalesceUpdates)
 				}
+			case <-flushTimer:
+				flush()
 			}
 		}
 	}()
@@ -393,8 +1014,42 @@ func (store *Storage) I18NLevel() int {
 	return 1
 }
 
+// supportedIMAPExtensions is the list of IMAP extensions implemented by the
+// storage.
+var supportedIMAPExtensions = []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+
+// filterIMAPExtensions returns the supported extensions that are present in
+// the allowed list and the allowed entries that are not supported.
+func filterIMAPExtensions(allowed []string) (exts, unknown []string) {
+	exts = []string{}
+	for _, ext := range supportedIMAPExtensions {
+		for _, allowedExt := range allowed {
+			if strings.EqualFold(ext, allowedExt) {
+				exts = append(exts, ext)
+				break
+			}
+		}
+	}
+	for _, allowedExt := range allowed {
+		found := false
+		for _, ext := range supportedIMAPExtensions {
+			if strings.EqualFold(ext, allowedExt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, allowedExt)
+		}
+	}
+	return exts, unknown
+}
+
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	if store.imapExts != nil {
+		return store.imapExts
+	}
+	return supportedIMAPExtensions
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -407,7 +1062,36 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	// Existing accounts are returned without pinning them to the primary
+	// database, only account creation needs that.
+	usr, err := store.Back.GetUser(accountName)
+	if err == nil {
+		return usr, nil
+	}
+	if !errors.Is(err, imapsql.ErrUserDoesntExists) {
+		return nil, err
+	}
+
+	if store.provisioning != nil {
+		// GetOrCreateIMAPAcct is called only after the user is
+		// authenticated so the table is not exposed to anonymous clients.
+		_, allowed, err := store.provisioning.Lookup(context.TODO(), accountName)
+		if err != nil {
+			store.log.Error("provisioning policy check failed", err, "username", store.logAddr(accountName))
+			return nil, errors.New("internal server error")
+		}
+		if !allowed {
+			store.log.Msg("account creation denied by provisioning policy", "username", store.logAddr(accountName))
+			return nil, ErrProvisioningDenied
+		}
+	}
+
+	usr, err = store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	store.pinToPrimary(usr.Username())
+	return usr, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -416,6 +1100,14 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 		return "", false, nil
 	}
 
+	if store.lookupReplica != nil && !store.lookupReplica.IsPinned(strings.ToLower(accountName)) {
+		exists, err := store.lookupReplica.UserExists(ctx, strings.ToLower(accountName))
+		if err == nil {
+			return "", exists, nil
+		}
+		store.log.Error("lookup replica query failed, using primary", err, "username", store.logAddr(accountName))
+	}
+
 	usr, err := store.Back.GetUser(accountName)
 	if err != nil {
 		if errors.Is(err, imapsql.ErrUserDoesntExists) {
@@ -424,13 +1116,27 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 		return "", false, err
 	}
 	if err := usr.Logout(); err != nil {
-		store.log.Error("logout failed", err, "username", accountName)
+		store.log.Error("logout failed", err, "username", store.logAddr(accountName))
 	}
 
 	return "", true, nil
 }
 
 func (store *Storage) Stop() error {
+	if store.preloadStop != nil {
+		close(store.preloadStop)
+		<-store.preloadDone
+	}
+	if store.trashStop != nil {
+		close(store.trashStop)
+		<-store.trashDone
+	}
+	if store.optimizeStop != nil {
+		close(store.optimizeStop)
+		<-store.optimizeDone
+	}
+	store.dsnWg.Wait()
+
 	// Stop backend from generating new updates.
 	if err := store.Back.Close(); err != nil {
 		store.log.Error("close backend failed", err)
@@ -448,6 +1154,22 @@ func (store *Storage) Stop() error {
 		}
 	}
 
+	if store.rcptLookupRate != nil {
+		store.rcptLookupRate.Close()
+	}
+
+	if store.lookupReplica != nil {
+		if err := store.lookupReplica.Close(); err != nil {
+			store.log.Error("lookup replica close failed", err)
+		}
+	}
+
+	if store.auditLog != nil {
+		if err := store.auditLog.Close(); err != nil {
+			store.log.Error("audit log close failed", err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStorage_ConnectRetries(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	oldBase := connectRetryBase
+	connectRetryBase = 10 * time.Millisecond
+	t.Cleanup(func() { connectRetryBase = oldBase })
+
+	dir := filepath.Join(t.TempDir(), "db")
+	newStore := func() *Storage {
+		return &Storage{
+			driver: sqliteprovider.MapDriverName("sqlite3"),
+			log:    testutils.Logger(t, "imapsql"),
+			opts:   &imapsql.Opts{},
+		}
+	}
+
+	store := newStore()
+	if err := store.connect([]string{filepath.Join(dir, "imapsql.db")}); err == nil {
+		t.Fatal("expected connection to fail without retries")
+	}
+
+	store = newStore()
+	store.connectRetries = 5
+	store.connectTimeout = 10 * time.Second
+	go func() {
+		time.Sleep(15 * time.Millisecond)
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := store.connect([]string{filepath.Join(dir, "imapsql.db")}); err != nil {
+		t.Fatal(err)
+	}
+	store.Back.Close()
+
+	store = newStore()
+	store.connectRetries = 100
+	store.connectTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if err := store.connect([]string{filepath.Join(dir, "nonexistent", "imapsql.db")}); err == nil {
+		t.Fatal("expected connection to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("connect_timeout was not respected")
+	}
+}
+
+func TestFilterIMAPExtensions(t *testing.T) {
+	exts, unknown := filterIMAPExtensions([]string{"sort", "CONDSTORE", "APPENDLIMIT"})
+	if !reflect.DeepEqual(exts, []string{"APPENDLIMIT", "SORT"}) {
+		t.Errorf("wrong extensions: %v", exts)
+	}
+	if !reflect.DeepEqual(unknown, []string{"CONDSTORE"}) {
+		t.Errorf("wrong unknown extensions: %v", unknown)
+	}
+
+	exts, _ = filterIMAPExtensions([]string{"CONDSTORE"})
+	if exts == nil || len(exts) != 0 {
+		t.Errorf("expected empty non-nil list, got %v", exts)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// inboxShard returns the monthly INBOX shard for the account according to
+// inbox_split. Empty string is returned if the account does not use inbox
+// splitting.
+func (d *delivery) inboxShard(ctx context.Context, accountName string) string {
+	policy, ok, err := d.store.inboxSplit.Lookup(ctx, accountName)
+	if err != nil {
+		d.store.log.Error("inbox_split lookup failed", err, "rcpt", d.store.logAddr(accountName))
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+
+	now := time.Now().UTC()
+	var folder string
+	switch policy {
+	case "monthly":
+		folder = fmt.Sprintf("INBOX-%04d-%02d", now.Year(), int(now.Month()))
+	default:
+		d.store.log.Msg("unknown inbox_split policy, delivering to INBOX", "rcpt", d.store.logAddr(accountName), "policy", policy)
+		return ""
+	}
+	return folder
+}
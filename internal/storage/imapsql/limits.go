@@ -0,0 +1,65 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"sync"
+)
+
+// deliveryLimiter restricts the amount of simultaneous deliveries for each
+// account.
+//
+// Counters are removed once the account has no deliveries in progress so
+// the map does not grow with the amount of accounts.
+type deliveryLimiter struct {
+	max int
+
+	lck    sync.Mutex
+	active map[string]int
+}
+
+func newDeliveryLimiter(max int) *deliveryLimiter {
+	return &deliveryLimiter{
+		max:    max,
+		active: map[string]int{},
+	}
+}
+
+// TryAcquire returns false if the account already has the maximum allowed
+// amount of deliveries in progress.
+func (l *deliveryLimiter) TryAcquire(accountName string) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if l.active[accountName] >= l.max {
+		return false
+	}
+	l.active[accountName]++
+	return true
+}
+
+func (l *deliveryLimiter) Release(accountName string) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.active[accountName]--
+	if l.active[accountName] <= 0 {
+		delete(l.active, accountName)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+var maildirCounter uint64
+
+// maildirName generates an unique file name for the message as described in
+// https://cr.yp.to/proto/maildir.html.
+func maildirName() string {
+	now := time.Now()
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in Maildir file names.
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&maildirCounter, 1), hostname)
+}
+
+// mirrorToMaildir writes a copy of the message to the Maildir at
+// root/account.
+//
+// The message is written to tmp/ first and then moved to new/ so Maildir
+// readers never see a partially written message.
+func mirrorToMaildir(root, account string, header textproto.Header, body buffer.Buffer) error {
+	if account == "" || strings.ContainsAny(account, `/\`) || strings.HasPrefix(account, ".") {
+		return errors.New("account name can't be used as a directory name")
+	}
+
+	mdir := filepath.Join(root, account)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(mdir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	name := maildirName()
+	tmpPath := filepath.Join(mdir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(f, header, body); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(mdir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func writeMessage(f *os.File, header textproto.Header, body buffer.Buffer) error {
+	w := bufio.NewWriter(f)
+	if err := textproto.WriteHeader(w, header); err != nil {
+		return err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := w.ReadFrom(r); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
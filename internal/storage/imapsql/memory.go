@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var memoryDBCounter atomic.Int64
+
+// memoryDSN returns the DSN for a new shared-cache in-memory SQLite
+// database. Each call returns a different database so multiple storage
+// instances don't share data.
+func memoryDSN() string {
+	return "file:maddy-imapsql-" + strconv.FormatInt(memoryDBCounter.Add(1), 10) + "?mode=memory&cache=shared"
+}
+
+// configureMemoryDB makes sure all queries use the same connection.
+// In-memory database is deleted once the last connection to it is closed.
+func configureMemoryDB(db *sql.DB) {
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+}
+
+// memBlobStore is the module.BlobStore keeping message bodies in memory.
+// It is used for in-memory databases unless msg_store is specified
+// explicitly.
+type memBlobStore struct {
+	lck   sync.RWMutex
+	blobs map[string][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: map[string][]byte{}}
+}
+
+type memBlob struct {
+	store *memBlobStore
+	key   string
+	buf   bytes.Buffer
+}
+
+func (b *memBlob) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *memBlob) Sync() error {
+	b.store.lck.Lock()
+	defer b.store.lck.Unlock()
+	b.store.blobs[b.key] = bytes.Clone(b.buf.Bytes())
+	return nil
+}
+
+func (b *memBlob) Close() error {
+	return nil
+}
+
+func (s *memBlobStore) Create(_ context.Context, key string, _ int64) (module.Blob, error) {
+	return &memBlob{store: s, key: key}, nil
+}
+
+func (s *memBlobStore) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, module.ErrNoSuchBlob
+	}
+	return io.NopCloser(bytes.NewReader(blob)), nil
+}
+
+func (s *memBlobStore) Delete(_ context.Context, keys []string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for _, key := range keys {
+		delete(s.blobs, key)
+	}
+	return nil
+}
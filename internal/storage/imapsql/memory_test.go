@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"os"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/container"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStorage_Memory(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+
+	mod, err := New(container.New(), modName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.log = testutils.Logger(t, "imapsql")
+	if err := store.Configure([]string{"sqlite3", ":memory:"}, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	usr, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := usr.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in INBOX, got %d", status.Messages)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected file created: %s", entry.Name())
+	}
+}
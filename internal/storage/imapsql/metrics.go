@@ -0,0 +1,68 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deliveredToMailbox = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "sql",
+		Name:      "delivery_to_mailbox_total",
+		Help:      "Per-recipient message deliveries by target mailbox (INBOX, Junk, Quarantine or other) and result",
+	},
+	[]string{"module", "mailbox", "result"},
+)
+
+// mailboxLabel returns the mailbox label value for the delivery to the
+// backend folder. Only special mailboxes are labeled explicitly to keep
+// cardinality bounded.
+func (d *delivery) mailboxLabel(folder string) string {
+	junkMbox, quarantineMbox := d.store.specialMailboxes()
+	switch {
+	case folder == "" && d.msgMeta.Quarantine && quarantineMbox != "":
+		return "Quarantine"
+	case folder == "" && d.msgMeta.Quarantine, folder == d.store.backendMailbox(junkMbox):
+		return "Junk"
+	case folder == "", strings.EqualFold(folder, "INBOX"):
+		return "INBOX"
+	default:
+		return "other"
+	}
+}
+
+// countMailboxes records the result for mailboxes selected by Body. It is
+// called once the transaction is committed or aborted.
+func (d *delivery) countMailboxes(success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	for _, mbox := range d.mboxLabels {
+		deliveredToMailbox.WithLabelValues(d.store.instName, mbox, result).Inc()
+	}
+}
+
+func init() {
+	prometheus.MustRegister(deliveredToMailbox)
+}
@@ -0,0 +1,73 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// maxMIMEDepth is the maximum nesting level of multipart entities checked by
+// validateMIME. Deeper entities are not checked.
+const maxMIMEDepth = 50
+
+// validateMIME checks that the MIME structure of the message can be parsed.
+//
+// The check is lenient and fails only if the structure itself is broken
+// (e.g. unterminated multipart). Unknown charsets and transfer encodings as
+// well as malformed part bodies are accepted since the message is still
+// usable by most clients.
+func validateMIME(header textproto.Header, body buffer.Buffer) error {
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	ent, err := message.New(message.Header{Header: header}, r)
+	if err != nil && !message.IsUnknownEncoding(err) && !message.IsUnknownCharset(err) {
+		return err
+	}
+	return validateEntity(ent, 0)
+}
+
+func validateEntity(ent *message.Entity, depth int) error {
+	mr := ent.MultipartReader()
+	if mr == nil || depth >= maxMIMEDepth {
+		return nil
+	}
+
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil && !message.IsUnknownEncoding(err) && !message.IsUnknownCharset(err) {
+			return fmt.Errorf("part %d at level %d: %w", i+1, depth+1, err)
+		}
+		if err := validateEntity(part, depth+1); err != nil {
+			return err
+		}
+	}
+}
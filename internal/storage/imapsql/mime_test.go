@@ -0,0 +1,107 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+func TestValidateMIME(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msg  string
+		fail bool
+	}{
+		{
+			name: "plain",
+			msg:  "Content-Type: text/plain\r\n\r\nHello\r\n",
+		},
+		{
+			name: "no Content-Type",
+			msg:  "Subject: test\r\n\r\nHello\r\n",
+		},
+		{
+			name: "multipart",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n" +
+				"--b\r\nContent-Type: multipart/alternative; boundary=c\r\n\r\n" +
+				"--c\r\nContent-Type: text/plain\r\n\r\nNested\r\n--c--\r\n" +
+				"--b--\r\n",
+		},
+		{
+			name: "unknown charset and encoding",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=x-unknown\r\n" +
+				"Content-Transfer-Encoding: x-unknown\r\n\r\nHello\r\n" +
+				"--b--\r\n",
+		},
+		{
+			name: "malformed base64",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!\r\n" +
+				"--b--\r\n",
+		},
+		{
+			name: "unterminated multipart",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n",
+			fail: true,
+		},
+		{
+			name: "unterminated nested multipart",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: multipart/alternative; boundary=c\r\n\r\n" +
+				"--c\r\nContent-Type: text/plain\r\n\r\nNested\r\n" +
+				"--b--\r\n",
+			fail: true,
+		},
+		{
+			name: "malformed part header",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nmalformed header\r\n\r\nHello\r\n" +
+				"--b--\r\n",
+			fail: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(c.msg))
+			hdr, err := textproto.ReadHeader(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := buffer.BufferInMemory(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = validateMIME(hdr, body)
+			if c.fail && err == nil {
+				t.Error("expected an error")
+			}
+			if !c.fail && err != nil {
+				t.Error("unexpected error:", err)
+			}
+		})
+	}
+}
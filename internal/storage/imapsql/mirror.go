@@ -0,0 +1,75 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// mirror delivers the message to mirror_to for all accepted recipients.
+//
+// Recipients are passed in the form they were presented to the storage
+// so the mirror can resolve them on its own. The message is passed to
+// the mirror without fields added by the storage.
+func (d *delivery) mirror(ctx context.Context) error {
+	if len(d.addedRcpts) == 0 || d.mirrorBody == nil {
+		return nil
+	}
+
+	defer trace.StartRegion(ctx, "sql/mirror").End()
+
+	mirrorDelivery, err := d.store.mirrorTo.StartDelivery(ctx, d.msgMeta.DeepCopy(), d.mailFrom)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := mirrorDelivery.Abort(ctx); err != nil {
+				d.store.log.Error("failed to abort mirror delivery", err, "msg_id", d.msgMeta.ID)
+			}
+		}
+	}()
+
+	for _, rcpt := range d.acceptedRcpts() {
+		if err = mirrorDelivery.AddRcpt(ctx, d.addedRcpts[rcpt].rcptTo, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	if err = mirrorDelivery.Body(ctx, d.mirrorHeader, d.mirrorBody); err != nil {
+		return err
+	}
+	err = mirrorDelivery.Commit(ctx)
+	return err
+}
+
+// mirrorErr wraps the error returned by mirror_to so it is reported to the
+// client as a temporary failure if mirror_required is set.
+func (d *delivery) mirrorErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error, try again later",
+		TargetName:   "imapsql",
+		Err:          err,
+	}
+}
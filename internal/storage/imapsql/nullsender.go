@@ -0,0 +1,48 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// isRoleAddress reports whether rcptTo is the postmaster (RFC 5321) or abuse
+// (RFC 2142) address. Messages with the null sender are legitimately sent to
+// these addresses (e.g. bounces and feedback reports), so
+// null_sender_mailbox and null_sender_max_size are not applied to them.
+func isRoleAddress(rcptTo string) bool {
+	mbox, _, err := address.Split(rcptTo)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(mbox, "postmaster") || strings.EqualFold(mbox, "abuse")
+}
+
+// hasRoleRcpt reports whether any of the recipients of the delivery is
+// a role address.
+func (d *delivery) hasRoleRcpt() bool {
+	for _, rcptData := range d.addedRcpts {
+		if isRoleAddress(rcptData.rcptTo) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"fmt"
+	"time"
+)
+
+// Optimize compacts the database and updates query planner statistics.
+//
+// For SQLite, VACUUM and PRAGMA optimize are used, for MySQL - OPTIMIZE TABLE
+// for each table and for PostgreSQL - VACUUM ANALYZE. The database is
+// locked while the operation runs, so it should be done when there is
+// little traffic.
+func (store *Storage) Optimize() error {
+	db := store.Back.DB
+	start := time.Now()
+
+	switch store.driver {
+	case "sqlite3", "sqlite":
+		if _, err := db.Exec(`VACUUM`); err != nil {
+			return fmt.Errorf("imapsql: vacuum: %w", err)
+		}
+		if _, err := db.Exec(`PRAGMA optimize`); err != nil {
+			return fmt.Errorf("imapsql: optimize: %w", err)
+		}
+	case "mysql":
+		rows, err := db.Query(`SHOW TABLES`)
+		if err != nil {
+			return fmt.Errorf("imapsql: list tables: %w", err)
+		}
+		var tables []string
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); err != nil {
+				rows.Close()
+				return fmt.Errorf("imapsql: list tables: %w", err)
+			}
+			tables = append(tables, table)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("imapsql: list tables: %w", err)
+		}
+		for _, table := range tables {
+			// OPTIMIZE TABLE returns the status as a result set.
+			rows, err := db.Query("OPTIMIZE TABLE `" + table + "`")
+			if err != nil {
+				return fmt.Errorf("imapsql: optimize %s: %w", table, err)
+			}
+			rows.Close()
+		}
+	case "postgres":
+		if _, err := db.Exec(`VACUUM ANALYZE`); err != nil {
+			return fmt.Errorf("imapsql: vacuum: %w", err)
+		}
+	default:
+		return fmt.Errorf("imapsql: optimization is not supported for %s", store.driver)
+	}
+
+	store.log.Msg("database optimized", "driver", store.driver, "took", time.Since(start).String())
+	return nil
+}
+
+// optimizeLoop runs Optimize every optimize_interval until
+// store.optimizeStop is closed. Runs are skipped if there are deliveries in
+// progress.
+func (store *Storage) optimizeLoop() {
+	defer close(store.optimizeDone)
+
+	ticker := time.NewTicker(store.optimizeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.optimizeStop:
+			return
+		case <-ticker.C:
+		}
+
+		if n := store.activeDeliveries.Load(); n != 0 {
+			store.log.Msg("skipping scheduled optimization, deliveries in progress", "deliveries", n)
+			continue
+		}
+		if err := store.Optimize(); err != nil {
+			store.log.Error("scheduled optimization failed", err)
+		}
+	}
+}
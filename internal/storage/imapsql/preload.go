@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+)
+
+// preloadAccounts reads INBOX status of each account listed in
+// preload_accounts to populate database caches before clients connect.
+//
+// It is run in a separate goroutine started by Start and respects
+// store.preloadStop.
+func (store *Storage) preloadAccounts(accounts []string) {
+	defer close(store.preloadDone)
+
+	for _, name := range accounts {
+		select {
+		case <-store.preloadStop:
+			return
+		default:
+		}
+
+		accountName := name
+		if store.authNormalize != nil {
+			var err error
+			accountName, err = store.authNormalize(context.TODO(), name)
+			if err != nil {
+				store.log.Error("preload: malformed account name", err, "username", store.logAddr(name))
+				continue
+			}
+		}
+
+		usr, err := store.Back.GetUser(accountName)
+		if err != nil {
+			store.log.Error("preload: failed to get account", err, "username", store.logAddr(accountName))
+			continue
+		}
+		_, err = usr.Status(imap.InboxName, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUnseen})
+		if err != nil {
+			store.log.Error("preload: failed to read INBOX status", err, "username", store.logAddr(accountName))
+		}
+		if err := usr.Logout(); err != nil {
+			store.log.Error("preload: logout failed", err, "username", store.logAddr(accountName))
+		}
+	}
+	store.log.DebugMsg("accounts preloaded", "count", len(accounts))
+}
@@ -0,0 +1,48 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+)
+
+func TestPreloadAccounts(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.preloadStop = make(chan struct{})
+	store.preloadDone = make(chan struct{})
+	// Missing account should not stop preloading of the rest.
+	store.preloadAccounts([]string{"missing@example.org", "test@example.org"})
+
+	select {
+	case <-store.preloadDone:
+	default:
+		t.Fatal("preloadDone is not closed")
+	}
+
+	// Preloading should stop early if the storage is stopped.
+	store.preloadStop = make(chan struct{})
+	store.preloadDone = make(chan struct{})
+	close(store.preloadStop)
+	store.preloadAccounts([]string{"test@example.org"})
+	<-store.preloadDone
+}
@@ -0,0 +1,50 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStorage_ProvisioningPolicy(t *testing.T) {
+	store := newTestStorage(t)
+	store.authNormalize = store.deliveryNormalize
+	store.provisioning = testutils.Table{M: map[string]string{
+		"allowed@example.org": "",
+	}}
+
+	if _, err := store.GetOrCreateIMAPAcct("allowed@example.org"); err != nil {
+		t.Fatal("allowed account was not created:", err)
+	}
+	if _, err := store.GetOrCreateIMAPAcct("denied@example.org"); !errors.Is(err, ErrProvisioningDenied) {
+		t.Fatal("expected ErrProvisioningDenied, got", err)
+	}
+
+	// Existing accounts are not checked.
+	store.provisioning = testutils.Table{Err: errors.New("lookup failed")}
+	if _, err := store.GetOrCreateIMAPAcct("allowed@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetOrCreateIMAPAcct("error@example.org"); err == nil || errors.Is(err, ErrProvisioningDenied) {
+		t.Fatal("expected a policy error, got", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+// rcptLookupWait is the maximum time a delivery waits for the
+// recipient_lookup_rate limiter.
+const rcptLookupWait = 5 * time.Second
+
+// newRcptLookupRate creates the limiter for recipient_lookup_rate
+// directive arguments (burst size and optional period). It returns nil if
+// the burst size is 0.
+func newRcptLookupRate(args []string) (*limiters.Rate, error) {
+	period := time.Second
+	switch len(args) {
+	case 2:
+		var err error
+		period, err = time.ParseDuration(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: recipient_lookup_rate: %w", err)
+		}
+		if period <= 0 {
+			return nil, errors.New("imapsql: recipient_lookup_rate: period should be positive")
+		}
+	case 1:
+	default:
+		return nil, errors.New("imapsql: recipient_lookup_rate: expected burst size and optional period")
+	}
+
+	burst, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: recipient_lookup_rate: %w", err)
+	}
+	if burst < 0 {
+		return nil, errors.New("imapsql: recipient_lookup_rate: burst size should not be negative")
+	}
+	if burst == 0 {
+		return nil, nil
+	}
+	rate := limiters.NewRate(burst, period)
+	return &rate, nil
+}
+
+// lookupRcptAccount returns the deliveryNormalize function that uses
+// recipient_lookup to find the account for the normalized address.
+//
+// Lookups are triggered by unauthenticated senders so they are limited
+// using recipient_lookup_rate.
+func (store *Storage) lookupRcptAccount(normalize func(string) (string, error)) func(context.Context, string) (string, error) {
+	return func(ctx context.Context, email string) (string, error) {
+		email, err := normalize(email)
+		if err != nil {
+			return "", err
+		}
+
+		if store.rcptLookupRate != nil {
+			waitCtx, cancel := context.WithTimeout(ctx, rcptLookupWait)
+			err := store.rcptLookupRate.TakeContext(waitCtx)
+			cancel()
+			if err != nil {
+				store.log.Msg("recipient lookup rate limit exceeded", "rcpt", store.logAddr(email))
+				return "", &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+					Message:      "Too many recipient lookups, try again later",
+					TargetName:   "imapsql",
+					Err:          err,
+				}
+			}
+		}
+
+		account, ok, err := store.rcptLookup.Lookup(ctx, email)
+		if err == nil && ok && account == "" {
+			err = errors.New("imapsql: recipient lookup: empty account name")
+		}
+		if err != nil {
+			store.log.Error("recipient lookup failed", err, "rcpt", store.logAddr(email))
+			return "", &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+				Message:      "Internal server error, try again later",
+				TargetName:   "imapsql",
+				Err:          err,
+			}
+		}
+		if !ok {
+			return "", store.userDoesNotExist(nil)
+		}
+		return account, nil
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDelivery_RecipientLookup(t *testing.T) {
+	store := newTestStorage(t)
+	store.rcptLookup = testutils.Table{M: map[string]string{
+		"sales@example.org": "alice@example.org",
+		"empty@example.org": "",
+	}}
+	store.deliveryNormalize = store.lookupRcptAccount(func(s string) (string, error) {
+		return s, nil
+	})
+	if err := store.CreateIMAPAcct("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"sales@example.org"})
+	u, err := store.GetIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.(*imapsql.User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in alice's INBOX, got %d", status.Messages)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"unknown@example.org"})
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 1, 1}) {
+		t.Errorf("expected 550 for unknown address, got %v", err)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"empty@example.org"})
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("expected 451 for empty account name, got %v", err)
+	}
+
+	store.rcptLookup = testutils.Table{Err: errors.New("lookup failed")}
+	_, err = testutils.DoTestDeliveryErr(t, store, "sender@example.org", []string{"sales@example.org"})
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("expected 451 for lookup error, got %v", err)
+	}
+}
+
+func TestDelivery_RecipientLookupRate(t *testing.T) {
+	store := newTestStorage(t)
+	store.rcptLookup = testutils.Table{M: map[string]string{
+		"sales@example.org": "alice@example.org",
+	}}
+	rate, err := newRcptLookupRate([]string{"1", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rate.Close()
+	store.rcptLookupRate = rate
+	store.deliveryNormalize = store.lookupRcptAccount(func(s string) (string, error) {
+		return s, nil
+	})
+
+	if _, err := store.deliveryNormalize(context.Background(), "sales@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = store.deliveryNormalize(ctx, "sales@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.EnhancedCode != (exterrors.EnhancedCode{4, 7, 0}) {
+		t.Errorf("expected 451 4.7.0 when the rate is exceeded, got %v", err)
+	}
+
+	if rate, err := newRcptLookupRate([]string{"0"}); err != nil || rate != nil {
+		t.Errorf("expected no limiter for burst size 0, got %v, %v", rate, err)
+	}
+	for _, args := range [][]string{
+		{},
+		{"a"},
+		{"-1"},
+		{"1", "a"},
+		{"1", "0s"},
+		{"1", "1s", "1"},
+	} {
+		if _, err := newRcptLookupRate(args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
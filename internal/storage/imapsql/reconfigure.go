@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// ErrReopenRequired is returned by Reconfigure if the new configuration
+// can't be applied without opening the database again.
+var ErrReopenRequired = errors.New("imapsql: database configuration changed, storage should be recreated")
+
+// parseAppendLimit converts the appendlimit value to the form used by
+// imapsql.Opts. -1 means no limit.
+func parseAppendLimit(val int64) (*uint32, error) {
+	if val == -1 {
+		return nil, nil
+	}
+	// int is 32-bit on some platforms, so cut off values we can't actually
+	// use.
+	if int64(uint32(val)) != val {
+		return nil, errors.New("imapsql: appendlimit value is too big")
+	}
+	limit := uint32(val)
+	return &limit, nil
+}
+
+// Reconfigure applies the configuration block to the running storage.
+//
+// Only junk_mailbox, quarantine_mailbox, appendlimit and storage_perdomain
+// are applied, in place, without interrupting deliveries and IMAP sessions
+// in progress. Other directives are ignored. If driver or dsn changed,
+// ErrReopenRequired is returned and nothing is changed, the storage
+// should be stopped and created again in this case. The database is never
+// opened again by Reconfigure itself since the backend is used without
+// synchronization by IMAP sessions and deliveries.
+//
+// Server configuration reload (SIGUSR2) does not use Reconfigure, it
+// creates new module instances and each of them opens the database. The
+// method is meant for code that manages the Storage instance directly.
+func (store *Storage) Reconfigure(cfg *config.Map) error {
+	var (
+		driver         string
+		dsn            []string
+		junkMbox       string
+		quarantineMbox string
+		appendlimitVal int64
+		perDomain      bool
+	)
+	cfg.AllowUnknown()
+	cfg.String("driver", false, false, store.cfgDriver, &driver)
+	cfg.StringList("dsn", false, false, store.cfgDSN, &dsn)
+	cfg.String("junk_mailbox", false, false, "Junk", &junkMbox)
+	cfg.String("quarantine_mailbox", false, false, "", &quarantineMbox)
+	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
+	cfg.Bool("storage_perdomain", true, false, &perDomain)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if driver != store.cfgDriver || !slices.Equal(dsn, store.cfgDSN) {
+		return ErrReopenRequired
+	}
+	limit, err := parseAppendLimit(appendlimitVal)
+	if err != nil {
+		return err
+	}
+
+	store.reconfLck.Lock()
+	defer store.reconfLck.Unlock()
+	store.junkMbox = junkMbox
+	store.quarantineMbox = quarantineMbox
+	store.perDomain = perDomain
+	if store.opts != nil {
+		store.opts.MaxMsgBytes = limit
+	}
+	if store.Back != nil {
+		if err := store.Back.SetMessageLimit(limit); err != nil {
+			return err
+		}
+	}
+	store.log.Msg("configuration updated")
+	return nil
+}
+
+func (store *Storage) specialMailboxes() (junk, quarantine string) {
+	store.reconfLck.RLock()
+	defer store.reconfLck.RUnlock()
+	return store.junkMbox, store.quarantineMbox
+}
+
+func (store *Storage) perDomainEnabled() bool {
+	store.reconfLck.RLock()
+	defer store.reconfLck.RUnlock()
+	return store.perDomain
+}
+
+func (store *Storage) appendLimit() *uint32 {
+	store.reconfLck.RLock()
+	defer store.reconfLck.RUnlock()
+	if store.opts == nil {
+		return nil
+	}
+	return store.opts.MaxMsgBytes
+}
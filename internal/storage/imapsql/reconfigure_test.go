@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/container"
+	"github.com/foxcpp/maddy/framework/module"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestStorage_Reconfigure(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+
+	mod, err := New(container.New(), modName, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*Storage)
+	store.log = testutils.Logger(t, "imapsql")
+	if err := store.Configure([]string{"sqlite3", ":memory:"}, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	back := store.Back
+
+	err = store.Reconfigure(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "junk_mailbox", Args: []string{"Spam"}},
+			{Name: "appendlimit", Args: []string{"1M"}},
+			{Name: "storage_perdomain", Args: []string{"yes"}},
+			{Name: "trash_retention", Args: []string{"1h"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Back != back {
+		t.Fatal("backend was recreated")
+	}
+	if limit := store.Back.CreateMessageLimit(); limit == nil || *limit != 1024*1024 {
+		t.Errorf("appendlimit is not applied: %v", limit)
+	}
+	if !store.perDomainEnabled() {
+		t.Error("storage_perdomain is not applied")
+	}
+	if store.trashRetention != 0 {
+		t.Error("trash_retention should not be changed")
+	}
+
+	testutils.DoTestDeliveryMeta(t, store, "sender@example.org", []string{"test@example.org"},
+		&module.MsgMetadata{Quarantine: true})
+	usr, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := usr.Status("Spam", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("expected 1 message in Spam, got %d", status.Messages)
+	}
+
+	err = store.Reconfigure(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "dsn", Args: []string{"other.db"}},
+			{Name: "junk_mailbox", Args: []string{"Junk"}},
+		},
+	}))
+	if !errors.Is(err, ErrReopenRequired) {
+		t.Fatalf("expected ErrReopenRequired, got %v", err)
+	}
+	if junk, _ := store.specialMailboxes(); junk != "Spam" {
+		t.Errorf("junk_mailbox changed despite the error: %s", junk)
+	}
+}
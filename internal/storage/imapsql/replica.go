@@ -0,0 +1,113 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// replicaPinDuration is the time for which lookups for an account are
+// routed to the primary database after the account was changed, so
+// replication lag does not cause stale results.
+const replicaPinDuration = 30 * time.Second
+
+// lookupReplica is the database connection used only for account existence
+// checks (Lookup, e.g. imapsql used as a table in destination_in) if
+// lookup_dsn is set.
+//
+// IMAP sessions and deliveries are not routed to the replica since
+// go-imap-sql uses a single database handle for all queries. Accounts are
+// pinned to the primary only after they are created by this process (on
+// login or for postmaster), accounts managed using maddy CLI run in a
+// separate process and can't be pinned.
+type lookupReplica struct {
+	db     *sql.DB
+	driver string
+
+	pinnedLck sync.Mutex
+	pinned    map[string]time.Time
+}
+
+func openLookupReplica(driver, dsn string) (*lookupReplica, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: lookup replica: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("imapsql: lookup replica: %w", err)
+	}
+	return &lookupReplica{
+		db:     db,
+		driver: driver,
+		pinned: map[string]time.Time{},
+	}, nil
+}
+
+// Pin routes reads for the account to the primary database for
+// replicaPinDuration.
+func (r *lookupReplica) Pin(accountName string) {
+	r.pinnedLck.Lock()
+	defer r.pinnedLck.Unlock()
+
+	now := time.Now()
+	for acct, expiry := range r.pinned {
+		if now.After(expiry) {
+			delete(r.pinned, acct)
+		}
+	}
+	r.pinned[accountName] = now.Add(replicaPinDuration)
+}
+
+func (r *lookupReplica) IsPinned(accountName string) bool {
+	r.pinnedLck.Lock()
+	defer r.pinnedLck.Unlock()
+
+	expiry, ok := r.pinned[accountName]
+	return ok && time.Now().Before(expiry)
+}
+
+func (r *lookupReplica) UserExists(ctx context.Context, accountName string) (bool, error) {
+	var one int
+	err := r.db.QueryRowContext(ctx, rebindQuery(r.driver, `SELECT 1 FROM users WHERE username = ?`), accountName).Scan(&one)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *lookupReplica) Close() error {
+	return r.db.Close()
+}
+
+// pinToPrimary should be called after account creation, so the account is
+// looked up using the primary until the change is replicated.
+func (store *Storage) pinToPrimary(accountName string) {
+	if store.lookupReplica != nil {
+		store.lookupReplica.Pin(accountName)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+)
+
+func TestStorage_LookupReplica(t *testing.T) {
+	store := newTestStorage(t)
+	store.authNormalize = store.deliveryNormalize
+
+	// Separate database is used to simulate replication lag.
+	dir := t.TempDir()
+	driver := sqliteprovider.MapDriverName("sqlite3")
+	replicaBack, err := imapsql.New(driver, filepath.Join(dir, "replica.db"),
+		&imapsql.FSStore{Root: dir}, imapsql.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaBack.Close()
+
+	store.lookupReplica, err = openLookupReplica(driver, filepath.Join(dir, "replica.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.lookupReplica.Close()
+
+	lookup := func(name string) bool {
+		t.Helper()
+		_, ok, err := store.Lookup(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// Account creation on login pins it to the primary.
+	usr, err := store.GetOrCreateIMAPAcct("Test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := usr.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if !lookup("test@example.org") {
+		t.Error("recently created account should be looked up using primary")
+	}
+
+	store.lookupReplica.pinned = map[string]time.Time{}
+	if lookup("test@example.org") {
+		t.Error("lookup should use the replica once the account is not pinned anymore")
+	}
+
+	if err := replicaBack.CreateUser("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if !lookup("test@example.org") {
+		t.Error("account existing in replica is not found")
+	}
+
+	// Login to an existing account is not a write and should not pin it.
+	usr, err = store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := usr.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if store.lookupReplica.IsPinned("test@example.org") {
+		t.Error("login to an existing account should not pin it")
+	}
+
+	// Account management methods are used by maddy CLI running in a
+	// separate process, pinning there has no effect.
+	if err := store.CreateIMAPAcct("cli@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if store.lookupReplica.IsPinned("cli@example.org") {
+		t.Error("CreateIMAPAcct should not pin the account")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// postmasterRcpt checks whether rcptTo is the postmaster address (RFC 5321
+// Section 4.5.1) and returns the address of the account it should be
+// delivered to. If storage_perdomain is set, domain-qualified postmaster
+// addresses are delivered to the account with the same name.
+//
+// If the account does not exist, it is created if create_postmaster is set.
+// Otherwise, the address is handled as a regular recipient.
+func (store *Storage) postmasterRcpt(ctx context.Context, rcptTo string) (string, bool) {
+	if store.postmasterAcct == "" {
+		return "", false
+	}
+	mbox, domain, err := address.Split(rcptTo)
+	if err != nil || !strings.EqualFold(mbox, "postmaster") {
+		return "", false
+	}
+	account := store.postmasterAcct
+	if domain != "" && store.perDomainEnabled() {
+		account = rcptTo
+	}
+
+	accountName, err := store.deliveryNormalize(ctx, account)
+	if err != nil {
+		// Reported by the regular resolution.
+		return "", false
+	}
+	if store.createPostmaster {
+		store.ensurePostmaster(accountName)
+		return account, true
+	}
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return account, !errors.Is(err, imapsql.ErrUserDoesntExists)
+	}
+	if err := u.Logout(); err != nil {
+		store.log.Error("logout failed", err, "username", store.logAddr(accountName))
+	}
+	return account, true
+}
+
+// ensurePostmaster creates the account for postmaster messages if it does
+// not exist yet. Errors are logged, delivery fails later if the account is
+// missing.
+func (store *Storage) ensurePostmaster(accountName string) {
+	err := store.CreateIMAPAcct(accountName)
+	if err == nil {
+		store.pinToPrimary(strings.ToLower(accountName))
+		store.log.Msg("created postmaster account", "username", store.logAddr(accountName))
+		return
+	}
+	if !errors.Is(err, imapsql.ErrUserAlreadyExists) {
+		store.log.Error("failed to create postmaster account", err, "username", store.logAddr(accountName))
+	}
+}
+
+// rewriteRule maps recipient addresses matching the pattern to the account.
+type rewriteRule struct {
+	pattern *regexp.Regexp
+	account string
+}
+
+// regexpRulePrefix marks rewrite_rules patterns that are regular
+// expressions instead of globs.
+const regexpRulePrefix = "regexp:"
+
+// globToRegexp converts the glob pattern into an equivalent anchored
+// case-insensitive regular expression. '*' matches any sequence of
+// characters, '?' matches a single character.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("(?i)^")
+	for _, ch := range glob {
+		switch ch {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+func parseRewriteRules(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	rules := make([]rewriteRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one account name required")
+		}
+		if len(child.Children) != 0 {
+			return nil, config.NodeErr(child, "no block expected")
+		}
+
+		expr := globToRegexp(child.Name)
+		if strings.HasPrefix(child.Name, regexpRulePrefix) {
+			expr = "(?i)" + strings.TrimPrefix(child.Name, regexpRulePrefix)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, config.NodeErr(child, "malformed pattern: %v", err)
+		}
+		rules = append(rules, rewriteRule{pattern: pattern, account: child.Args[0]})
+	}
+	return rules, nil
+}
+
+// rewriteRcpt returns the account for the first rewrite rule matching the
+// recipient address.
+func (store *Storage) rewriteRcpt(rcptTo string) (string, bool) {
+	for _, rule := range store.rewriteRules {
+		if rule.pattern.MatchString(rcptTo) {
+			return rule.account, true
+		}
+	}
+	return "", false
+}
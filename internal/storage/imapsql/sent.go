@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// sentMailbox is the name of the folder created for save_to_sent copies if
+// the account has no folder with the \Sent attribute.
+const sentMailbox = "Sent"
+
+var _ module.Modifier = &Storage{}
+
+// ModStateForMsg implements module.Modifier for save_to_sent. The storage
+// is used as a modifier in the submission pipeline so the copy is stored
+// regardless of where the message is delivered.
+func (store *Storage) ModStateForMsg(_ context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &sentState{store: store, msgMeta: msgMeta}, nil
+}
+
+// sentState remembers the message in RewriteBody and stores the copy in
+// OnCommit, so it is not stored if the message is rejected.
+type sentState struct {
+	store   *Storage
+	msgMeta *module.MsgMetadata
+
+	header textproto.Header
+	body   buffer.Buffer
+}
+
+var _ module.ModifierCommitHook = &sentState{}
+
+func (*sentState) RewriteSender(_ context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (*sentState) RewriteRcpt(_ context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s *sentState) RewriteBody(_ context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if !s.store.saveToSent || s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser == "" {
+		return nil
+	}
+	s.header = h.Copy()
+	s.body = body
+	return nil
+}
+
+func (s *sentState) OnCommit(ctx context.Context) error {
+	if s.body == nil {
+		return nil
+	}
+	s.store.storeSentCopy(ctx, s.msgMeta, s.header, s.body)
+	return nil
+}
+
+func (s *sentState) Close() error {
+	s.body = nil
+	return nil
+}
+
+// storeSentCopy stores the copy of the message submitted by the
+// authenticated user in the Sent folder of their account.
+//
+// Errors are logged and do not prevent the message from being sent.
+func (store *Storage) storeSentCopy(ctx context.Context, msgMeta *module.MsgMetadata, header textproto.Header, body buffer.Buffer) {
+	authUser := msgMeta.Conn.AuthUser
+	accountName, err := store.authNormalize(ctx, authUser)
+	if err != nil {
+		store.log.Error("failed to find sender account", err, "username", store.logAddr(authUser), "msg_id", msgMeta.ID)
+		return
+	}
+
+	sent := store.Back.NewDelivery()
+	if err := sent.AddRcpt(accountName, textproto.Header{}); err != nil {
+		store.log.Error("failed to add sender account", err, "username", store.logAddr(accountName), "msg_id", msgMeta.ID)
+		return
+	}
+	// Empty mailbox name keeps the \Sent lookup done by SpecialMailbox,
+	// only the flags are set.
+	sent.UserMailbox(accountName, "", []string{imap.SeenFlag})
+	err = sent.SpecialMailbox(imap.SentAttr, sentMailbox)
+	if err == nil {
+		err = sent.BodyParsed(header, body.Len(), body)
+	}
+	if err == nil {
+		err = sent.Commit()
+	}
+	if err != nil {
+		store.log.Error("failed to store sent copy", err, "username", store.logAddr(accountName), "msg_id", msgMeta.ID)
+		if err := sent.Abort(); err != nil {
+			store.log.Error("failed to abort sent copy delivery", err, "msg_id", msgMeta.ID)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// lookupSharedMailbox checks whether the recipient address should be
+// delivered to a mailbox of another account.
+//
+// Table values have the form of "account/mailbox".
+func (store *Storage) lookupSharedMailbox(ctx context.Context, rcptTo string) (account, mbox string, ok bool, err error) {
+	key, err := address.ForLookup(rcptTo)
+	if err != nil {
+		return "", "", false, store.invalidRcpt(err)
+	}
+
+	val, ok, err := store.sharedMailboxes.Lookup(ctx, key)
+	if err != nil {
+		return "", "", false, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			TargetName:   "imapsql",
+			Err:          err,
+		}
+	}
+	if !ok {
+		return "", "", false, nil
+	}
+
+	account, mbox, found := strings.Cut(val, "/")
+	if !found || account == "" || mbox == "" {
+		store.log.Msg("malformed shared_mailboxes value, should be account/mailbox", "rcpt", store.logAddr(key), "value", val)
+		return "", "", false, store.userDoesNotExist(nil)
+	}
+	return account, mbox, true, nil
+}
@@ -0,0 +1,279 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// sieveRule is a single line of the sieve_lite rule file.
+//
+// Supported forms:
+//
+//	header <field> is|contains <value> fileinto <folder>
+//	size over|under <size> fileinto <folder>
+type sieveRule struct {
+	field string
+	op    string
+	value string
+	size  int
+	// folder is the folder name as specified by the user (using
+	// folder_separator).
+	folder string
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+func (r sieveRule) match(header textproto.Header, bodyLen int) bool {
+	switch r.op {
+	case "over":
+		return bodyLen > r.size
+	case "under":
+		return bodyLen < r.size
+	}
+
+	for fields := header.FieldsByKey(r.field); fields.Next(); {
+		value, err := wordDecoder.DecodeHeader(fields.Value())
+		if err != nil {
+			value = fields.Value()
+		}
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch r.op {
+		case "is":
+			if value == r.value {
+				return true
+			}
+		case "contains":
+			if strings.Contains(value, r.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitRuleLine splits the line into whitespace-separated words. Words can
+// be enclosed in double quotes to include spaces, backslash escapes the next
+// character in quoted words.
+func splitRuleLine(line string) ([]string, error) {
+	var (
+		words   []string
+		current strings.Builder
+		inWord  bool
+		quoted  bool
+		escaped bool
+	)
+	for _, ch := range line {
+		switch {
+		case escaped:
+			current.WriteRune(ch)
+			escaped = false
+		case quoted && ch == '\\':
+			escaped = true
+		case ch == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (ch == ' ' || ch == '\t'):
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(ch)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inWord {
+		words = append(words, current.String())
+	}
+	return words, nil
+}
+
+func parseSieveRule(words []string) (sieveRule, error) {
+	if len(words) < 2 || words[len(words)-2] != "fileinto" {
+		return sieveRule{}, errors.New("rule should end with 'fileinto <folder>'")
+	}
+	rule := sieveRule{folder: words[len(words)-1]}
+	if rule.folder == "" {
+		return sieveRule{}, errors.New("empty folder name")
+	}
+	test := words[:len(words)-2]
+	if len(test) == 0 {
+		return sieveRule{}, errors.New("missing test before 'fileinto'")
+	}
+
+	switch test[0] {
+	case "header":
+		if len(test) != 4 {
+			return sieveRule{}, errors.New("expected 'header <field> is|contains <value>'")
+		}
+		rule.field = test[1]
+		rule.op = test[2]
+		rule.value = strings.ToLower(test[3])
+		if rule.op != "is" && rule.op != "contains" {
+			return sieveRule{}, fmt.Errorf("unknown header comparison: %s", rule.op)
+		}
+	case "size":
+		if len(test) != 3 {
+			return sieveRule{}, errors.New("expected 'size over|under <size>'")
+		}
+		rule.op = test[1]
+		if rule.op != "over" && rule.op != "under" {
+			return sieveRule{}, fmt.Errorf("unknown size comparison: %s", rule.op)
+		}
+		var err error
+		rule.size, err = config.ParseDataSize(test[2])
+		if err != nil {
+			return sieveRule{}, err
+		}
+	default:
+		return sieveRule{}, fmt.Errorf("unknown test: %s", test[0])
+	}
+	return rule, nil
+}
+
+// parseSieveRules reads the rule file. Empty lines and lines starting with
+// '#' are ignored.
+func parseSieveRules(path string) ([]sieveRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []sieveRule
+	scnr := bufio.NewScanner(f)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words, err := splitRuleLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rule, err := parseSieveRule(words)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type sieveCacheEntry struct {
+	modTime time.Time
+	size    int64
+	rules   []sieveRule
+}
+
+// sieveLite loads per-account rule files from the directory and caches
+// parsed rules. The file is parsed again if its modification time or size
+// changes.
+type sieveLite struct {
+	dir string
+
+	cacheLck sync.Mutex
+	cache    map[string]sieveCacheEntry
+}
+
+func newSieveLite(dir string) *sieveLite {
+	return &sieveLite{
+		dir:   dir,
+		cache: make(map[string]sieveCacheEntry),
+	}
+}
+
+// rules returns the rules for the account. nil is returned without an error
+// if the account has no rule file.
+func (sl *sieveLite) rules(accountName string) ([]sieveRule, error) {
+	if accountName == "" || strings.HasPrefix(accountName, ".") ||
+		strings.ContainsAny(accountName, `/\`) {
+		return nil, nil
+	}
+	path := filepath.Join(sl.dir, accountName+".rules")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			sl.cacheLck.Lock()
+			delete(sl.cache, accountName)
+			sl.cacheLck.Unlock()
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sl.cacheLck.Lock()
+	entry, ok := sl.cache[accountName]
+	sl.cacheLck.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.rules, nil
+	}
+
+	rules, err := parseSieveRules(path)
+	if err != nil {
+		return nil, err
+	}
+	sl.cacheLck.Lock()
+	sl.cache[accountName] = sieveCacheEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		rules:   rules,
+	}
+	sl.cacheLck.Unlock()
+	return rules, nil
+}
+
+// sieveFolder evaluates sieve_lite rules of the account and returns the
+// backend name of the folder to deliver the message to. Empty string is
+// returned if no rule matches.
+func (d *delivery) sieveFolder(accountName string, header textproto.Header, bodyLen int) string {
+	rules, err := d.store.sieveLite.rules(accountName)
+	if err != nil {
+		d.store.log.Error("failed to load sieve_lite rules", err, "rcpt", d.store.logAddr(accountName))
+		return ""
+	}
+	for _, rule := range rules {
+		if rule.match(header, bodyLen) {
+			return d.store.backendMailbox(rule.folder)
+		}
+	}
+	return ""
+}
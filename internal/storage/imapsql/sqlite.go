@@ -0,0 +1,98 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkSQLitePageSize checks whether the value is usable as the SQLite
+// database page size.
+func checkSQLitePageSize(size int) error {
+	if size < 512 || size > 65536 || size&(size-1) != 0 {
+		return errors.New("imapsql: sqlite3_page_size should be a power of two between 512 and 65536")
+	}
+	return nil
+}
+
+// sqliteDSN adds PRAGMAs that have to be executed for each connection to the
+// SQLite DSN.
+//
+// Only the transpiled driver (modernc.org/sqlite) supports setting arbitrary
+// PRAGMAs via DSN.
+func (store *Storage) sqliteDSN(dsn string) string {
+	if store.driver != "sqlite" || store.sqliteMmapSize == 0 {
+		return dsn
+	}
+
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	return dsn + "_pragma=mmap_size(" + strconv.FormatInt(store.sqliteMmapSize, 10) + ")"
+}
+
+// initSQLitePageSize creates the database file with the configured page
+// size.
+//
+// Page size can't be changed after the database is created (and switched
+// to WAL mode), so this is done before go-imap-sql initializes the schema.
+// For existing databases the setting is ignored.
+func (store *Storage) initSQLitePageSize(dsn string) error {
+	if store.sqlitePageSize == 0 {
+		return nil
+	}
+
+	path := sqlitePath(dsn)
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.Size() != 0 {
+		store.log.Msg("sqlite3_page_size is ignored for existing database", "path", path)
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	db, err := sql.Open(store.driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA page_size=%d", store.sqlitePageSize)); err != nil {
+		return err
+	}
+	// VACUUM writes the database header, making the page size persistent.
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	return nil
+}
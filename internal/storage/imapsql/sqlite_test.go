@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	sqliteprovider "github.com/foxcpp/maddy/internal/sqlite"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestInitSQLitePageSize(t *testing.T) {
+	if !sqliteprovider.IsAvailable {
+		t.Skip("SQLite is not available")
+	}
+
+	path := filepath.Join(t.TempDir(), "imapsql.db")
+	store := &Storage{
+		driver:         sqliteprovider.MapDriverName("sqlite3"),
+		log:            testutils.Logger(t, "imapsql"),
+		sqlitePageSize: 8192,
+	}
+	if err := store.initSQLitePageSize(path); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPageSize := func() {
+		t.Helper()
+		db, err := sql.Open(store.driver, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var size int
+		if err := db.QueryRow("PRAGMA page_size").Scan(&size); err != nil {
+			t.Fatal(err)
+		}
+		if size != 8192 {
+			t.Errorf("wrong page size: %d", size)
+		}
+	}
+	checkPageSize()
+
+	// Should be ignored for the existing database.
+	store.sqlitePageSize = 1024
+	if err := store.initSQLitePageSize(path); err != nil {
+		t.Fatal(err)
+	}
+	checkPageSize()
+}
+
+func TestCheckSQLitePageSize(t *testing.T) {
+	for _, size := range []int{512, 4096, 65536} {
+		if err := checkSQLitePageSize(size); err != nil {
+			t.Errorf("%d: unexpected error: %v", size, err)
+		}
+	}
+	for _, size := range []int{256, 1000, 131072} {
+		if err := checkSQLitePageSize(size); err == nil {
+			t.Errorf("%d: expected an error", size)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	store := newTestStorage(t)
+	store.driver = sqliteprovider.MapDriverName("sqlite3")
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.DoTestDelivery(t, store, "sender@example.org", []string{"test@example.org"})
+
+	if err := store.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.activeDeliveries.Load(); n != 0 {
+		t.Errorf("expected no active deliveries, got %d", n)
+	}
+
+	dlv, err := store.StartDelivery(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.activeDeliveries.Load(); n != 1 {
+		t.Errorf("expected 1 active delivery, got %d", n)
+	}
+	if err := dlv.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Abort after a failed Commit should not be counted twice.
+	if err := dlv.Abort(context.Background()); err != nil {
+		t.Log(err)
+	}
+	if n := store.activeDeliveries.Load(); n != 0 {
+		t.Errorf("expected no active deliveries, got %d", n)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// lookupDBServers resolves the dsn_srv name and returns the list of database
+// servers in the order they should be tried.
+func (store *Storage) lookupDBServers(ctx context.Context) ([]*net.SRV, error) {
+	r, ok := store.resolver.(srvResolver)
+	if !ok {
+		return nil, errors.New("resolver does not support SRV lookups")
+	}
+
+	// Some resolvers do not handle empty service and proto correctly,
+	// so split the name.
+	service, proto, name := "", "", store.dsnSrv
+	if labels := strings.SplitN(name, ".", 3); len(labels) == 3 &&
+		strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		service, proto, name = labels[0][1:], labels[1][1:], labels[2]
+	}
+
+	_, srvs, err := r.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(srvs) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", store.dsnSrv)
+	}
+
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return srvs, nil
+}
+
+// dsnForServer changes the DSN to use the specified database server.
+func dsnForServer(driver, dsn string, srv *net.SRV) (string, error) {
+	host := strings.TrimSuffix(srv.Target, ".")
+	port := strconv.Itoa(int(srv.Port))
+
+	switch driver {
+	case "postgres":
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			dsn, err = pq.ParseURL(dsn)
+			if err != nil {
+				return "", err
+			}
+		}
+		// Values specified later take precedence.
+		return strings.TrimSpace(dsn + " host=" + pqQuote(host) + " port=" + port), nil
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(host, port)
+		return cfg.FormatDSN(), nil
+	default:
+		return "", fmt.Errorf("dsn_srv is not supported for driver %s", driver)
+	}
+}
+
+// candidateDSNs returns the list of DSNs to try when connecting to the
+// database.
+func (store *Storage) candidateDSNs(ctx context.Context, dsn string) ([]string, error) {
+	if store.dsnSrv == "" {
+		return []string{dsn}, nil
+	}
+
+	srvs, err := store.lookupDBServers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("dsn_srv: %w", err)
+	}
+	dsns := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		serverDSN, err := dsnForServer(store.driver, dsn, srv)
+		if err != nil {
+			return nil, fmt.Errorf("dsn_srv: %w", err)
+		}
+		dsns = append(dsns, serverDSN)
+	}
+	return dsns, nil
+}
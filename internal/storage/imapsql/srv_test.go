@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestCandidateDSNs(t *testing.T) {
+	store := &Storage{
+		driver: "postgres",
+		dsnSrv: "_postgresql._tcp.example.org",
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"_postgresql._tcp.example.org.": {
+				SRV: []net.SRV{
+					{Target: "backup.example.org.", Port: 5433, Priority: 20, Weight: 10},
+					{Target: "primary.example.org.", Port: 5432, Priority: 10, Weight: 10},
+				},
+			},
+		}},
+	}
+
+	dsns, err := store.candidateDSNs(context.Background(), "dbname=maddy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"dbname=maddy host='primary.example.org' port=5432",
+		"dbname=maddy host='backup.example.org' port=5433",
+	}
+	if len(dsns) != len(expected) {
+		t.Fatalf("wrong DSNs: %v", dsns)
+	}
+	for i := range expected {
+		if dsns[i] != expected[i] {
+			t.Errorf("wrong DSN %d\nwant: %s\ngot:  %s", i, expected[i], dsns[i])
+		}
+	}
+
+	store.driver = "mysql"
+	dsns, err = store.candidateDSNs(context.Background(), "maddy:secret@/maddy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := mysql.ParseDSN(dsns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "primary.example.org:5432" || cfg.DBName != "maddy" {
+		t.Errorf("wrong DSN: %s", dsns[0])
+	}
+
+	store.dsnSrv = "_postgresql._tcp.nonexistent.example.org"
+	if _, err := store.candidateDSNs(context.Background(), "dbname=maddy"); err == nil {
+		t.Error("expected error for missing SRV records")
+	}
+}
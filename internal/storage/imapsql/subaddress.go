@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// splitDetail splits the subaddress (detail) from the local part of the
+// address, e.g. user+lists@example.org => user@example.org, lists.
+//
+// Details that can't be used as a folder name are discarded.
+func (store *Storage) splitDetail(addr string) (base, detail string) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return addr, ""
+	}
+	idx := strings.Index(mbox, store.detailSeparator)
+	if idx == -1 {
+		return addr, ""
+	}
+
+	detail = mbox[idx+len(store.detailSeparator):]
+	base = mbox[:idx]
+	if domain != "" {
+		base += "@" + domain
+	}
+
+	// Do not allow to create nested folders or access special ones.
+	if strings.Contains(detail, imapsql.MailboxPathSep) ||
+		(store.folderSeparator != "" && strings.Contains(detail, store.folderSeparator)) ||
+		strings.EqualFold(detail, "INBOX") {
+		detail = ""
+	}
+	return base, detail
+}
+
+// detailFolder returns the folder to deliver the message with the specified
+// subaddress to and whether it should be created if it does not exist
+// (plus_addressing_create_folder).
+func (d *delivery) detailFolder(detail string) (string, bool) {
+	return detail, detail != "" && d.store.plusCreateFolder
+}
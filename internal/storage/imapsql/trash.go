@@ -0,0 +1,299 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// trashSweepInterval is the delay between trash_retention sweeper runs.
+var trashSweepInterval = time.Hour
+
+// trashMailbox returns the name of the mailbox with \Trash special-use
+// attribute or "Trash" mailbox if there is no such mailbox. Empty string is
+// returned if the account has neither.
+func trashMailbox(u backend.User) (string, error) {
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return "", err
+	}
+	fallback := ""
+	for _, info := range mboxes {
+		for _, attr := range info.Attributes {
+			if attr == imap.TrashAttr {
+				return info.Name, nil
+			}
+		}
+		if info.Name == "Trash" {
+			fallback = info.Name
+		}
+	}
+	return fallback, nil
+}
+
+// trashLog keeps the time messages were first seen in the Trash mailbox in
+// the maddy_trashed table of the storage database. Messages are identified
+// by the UID and UIDVALIDITY of the Trash mailbox, so the record is
+// invalidated if the message is moved out of the mailbox.
+type trashLog struct {
+	db     *sql.DB
+	driver string
+}
+
+func newTrashLog(db *sql.DB, driver string) (*trashLog, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_trashed (
+			account VARCHAR(255) NOT NULL,
+			uidvalidity BIGINT NOT NULL,
+			uid BIGINT NOT NULL,
+			trashed BIGINT NOT NULL,
+			PRIMARY KEY (account, uidvalidity, uid)
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("create table maddy_trashed: %w", err)
+	}
+	return &trashLog{db: db, driver: driver}, nil
+}
+
+// Load returns the recorded time for messages in the Trash mailbox of the
+// account. Records for the mailbox with different UIDVALIDITY are removed.
+func (l *trashLog) Load(ctx context.Context, account string, uidValidity uint32) (map[uint32]time.Time, error) {
+	_, err := l.db.ExecContext(ctx, rebindQuery(l.driver, `DELETE FROM maddy_trashed WHERE account = ? AND uidvalidity <> ?`),
+		account, int64(uidValidity))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := l.db.QueryContext(ctx, rebindQuery(l.driver, `SELECT uid, trashed FROM maddy_trashed WHERE account = ? AND uidvalidity = ?`),
+		account, int64(uidValidity))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[uint32]time.Time)
+	for rows.Next() {
+		var uid, trashed int64
+		if err := rows.Scan(&uid, &trashed); err != nil {
+			return nil, err
+		}
+		seen[uint32(uid)] = time.Unix(trashed, 0)
+	}
+	return seen, rows.Err()
+}
+
+// Add records the messages with the specified time.
+func (l *trashLog) Add(ctx context.Context, account string, uidValidity uint32, uids []uint32, trashed time.Time) error {
+	insert := rebindQuery(l.driver, `INSERT INTO maddy_trashed (account, uidvalidity, uid, trashed) VALUES (?, ?, ?, ?)`)
+	for _, uid := range uids {
+		if _, err := l.db.ExecContext(ctx, insert, account, int64(uidValidity), int64(uid), trashed.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes records for the messages.
+func (l *trashLog) Remove(ctx context.Context, account string, uidValidity uint32, uids []uint32) error {
+	del := rebindQuery(l.driver, `DELETE FROM maddy_trashed WHERE account = ? AND uidvalidity = ? AND uid = ?`)
+	for _, uid := range uids {
+		if _, err := l.db.ExecContext(ctx, del, account, int64(uidValidity), int64(uid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *Storage) getTrashLog() (*trashLog, error) {
+	store.trashLogLck.Lock()
+	defer store.trashLogLck.Unlock()
+
+	if store.trashLog == nil {
+		var err error
+		store.trashLog, err = newTrashLog(store.Back.DB, store.driver)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.trashLog, nil
+}
+
+// ExpireTrash removes messages stored in the Trash mailbox of the account
+// for longer than olderThan. It returns the amount of removed messages.
+//
+// Since messages are moved to Trash by IMAP clients, the time of the move
+// is not known. Instead, the time when ExpireTrash first saw the message in
+// the mailbox is recorded and used to determine its age. ExpireTrash
+// should be called periodically for that to be accurate.
+func (store *Storage) ExpireTrash(accountName string, olderThan time.Duration) (int, error) {
+	ctx := context.TODO()
+
+	tl, err := store.getTrashLog()
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.log.Error("logout failed", err, "username", store.logAddr(accountName))
+		}
+	}()
+
+	mboxName, err := trashMailbox(u)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: list mailboxes: %w", err)
+	}
+	if mboxName == "" {
+		return 0, nil
+	}
+	status, err := u.(*imapsql.User).Status(mboxName, []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: mailbox status: %w", err)
+	}
+	_, mbox, err := u.GetMailbox(mboxName, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer mbox.Close()
+
+	seen, err := tl.Load(ctx, accountName, status.UidValidity)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: load trash log: %w", err)
+	}
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+
+	now := time.Now()
+	cutoff := now.Add(-olderThan)
+	var (
+		newUIDs     []uint32
+		expiredUIDs []uint32
+		expired     = new(imap.SeqSet)
+	)
+	for msg := range ch {
+		trashed, ok := seen[msg.Uid]
+		delete(seen, msg.Uid)
+		if !ok {
+			newUIDs = append(newUIDs, msg.Uid)
+			continue
+		}
+		if trashed.Before(cutoff) {
+			expired.AddNum(msg.Uid)
+			expiredUIDs = append(expiredUIDs, msg.Uid)
+		}
+	}
+	if err := <-errCh; err != nil {
+		return 0, fmt.Errorf("imapsql: list messages: %w", err)
+	}
+
+	// Messages that are no longer in the mailbox.
+	goneUIDs := make([]uint32, 0, len(seen))
+	for uid := range seen {
+		goneUIDs = append(goneUIDs, uid)
+	}
+	if err := tl.Remove(ctx, accountName, status.UidValidity, goneUIDs); err != nil {
+		return 0, fmt.Errorf("imapsql: update trash log: %w", err)
+	}
+	if err := tl.Add(ctx, accountName, status.UidValidity, newUIDs, now); err != nil {
+		return 0, fmt.Errorf("imapsql: update trash log: %w", err)
+	}
+	if len(expiredUIDs) == 0 {
+		return 0, nil
+	}
+
+	if err := mbox.(*imapsql.Mailbox).DelMessages(true, expired); err != nil {
+		return 0, fmt.Errorf("imapsql: delete messages: %w", err)
+	}
+	if err := tl.Remove(ctx, accountName, status.UidValidity, expiredUIDs); err != nil {
+		return 0, fmt.Errorf("imapsql: update trash log: %w", err)
+	}
+	return len(expiredUIDs), nil
+}
+
+// sweepTrash runs ExpireTrash for the trash_retention_accounts (or all
+// accounts if not set) every trashSweepInterval until store.trashStop is
+// closed.
+func (store *Storage) sweepTrash() {
+	defer close(store.trashDone)
+
+	ticker := time.NewTicker(trashSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.trashStop:
+			return
+		case <-ticker.C:
+		}
+
+		accounts := store.trashAccounts
+		if accounts == nil {
+			var err error
+			accounts, err = store.ListIMAPAccts()
+			if err != nil {
+				store.log.Error("trash_retention: failed to list accounts", err)
+				continue
+			}
+		}
+
+		total := 0
+		for _, accountName := range accounts {
+			select {
+			case <-store.trashStop:
+				return
+			default:
+			}
+
+			if store.trashAccounts != nil && store.authNormalize != nil {
+				name, err := store.authNormalize(context.TODO(), accountName)
+				if err != nil {
+					store.log.Error("trash_retention: malformed account name", err, "username", store.logAddr(accountName))
+					continue
+				}
+				accountName = name
+			}
+
+			expired, err := store.ExpireTrash(accountName, store.trashRetention)
+			if err != nil {
+				store.log.Error("trash_retention: failed to expire messages", err, "username", store.logAddr(accountName))
+				continue
+			}
+			if expired != 0 {
+				store.log.DebugMsg("expired trashed messages", "username", store.logAddr(accountName), "count", expired)
+			}
+			total += expired
+		}
+		store.log.Msg("trash_retention sweep done", "accounts", len(accounts), "expired", total)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+func TestStorage_ExpireTrash(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("test2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.(*imapsql.User).CreateMailboxSpecial("Deleted Items", imap.TrashAttr); err != nil {
+		t.Fatal(err)
+	}
+	addMsg := func(mbox string, date time.Time) {
+		t.Helper()
+		body := bytes.NewReader([]byte("Subject: test\r\n\r\nfoobar\r\n"))
+		if err := u.CreateMessage(mbox, nil, date, body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	addMsg("Deleted Items", now.Add(-10*24*time.Hour))
+	addMsg("Deleted Items", now.Add(-8*24*time.Hour))
+	addMsg("Deleted Items", now.Add(-time.Hour))
+	addMsg("INBOX", now.Add(-10*24*time.Hour))
+
+	// Internal date is not used, messages are counted as trashed when
+	// ExpireTrash first sees them.
+	expired, err := store.ExpireTrash("test@example.org", 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 0 {
+		t.Errorf("expected no expired messages, got %d", expired)
+	}
+
+	_, err = store.Back.DB.Exec(`UPDATE maddy_trashed SET trashed = ? WHERE uid IN (1, 3)`,
+		now.Add(-8*24*time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err = store.ExpireTrash("test@example.org", 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 2 {
+		t.Errorf("expected 2 expired messages, got %d", expired)
+	}
+	var records int
+	if err := store.Back.DB.QueryRow(`SELECT COUNT(*) FROM maddy_trashed`).Scan(&records); err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 {
+		t.Errorf("expected 1 record for remaining message, got %d", records)
+	}
+
+	for mbox, expected := range map[string]uint32{
+		"Deleted Items": 1,
+		"INBOX":         1,
+	} {
+		status, err := u.Status(mbox, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != expected {
+			t.Errorf("expected %d messages in %s, got %d", expected, mbox, status.Messages)
+		}
+	}
+
+	// No Trash mailbox.
+	expired, err = store.ExpireTrash("test2@example.org", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 0 {
+		t.Errorf("expected no expired messages, got %d", expired)
+	}
+}
+
+func TestStorage_SweepTrash(t *testing.T) {
+	store := newTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Trash"); err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.NewReader([]byte("Subject: test\r\n\r\nfoobar\r\n"))
+	if err := u.CreateMessage("Trash", nil, time.Now().Add(-2*time.Hour), body, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	oldInterval := trashSweepInterval
+	trashSweepInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		trashSweepInterval = oldInterval
+	})
+
+	// The message is expired on the next run after it is seen.
+	store.trashRetention = time.Nanosecond
+	store.trashStop = make(chan struct{})
+	store.trashDone = make(chan struct{})
+	go store.sweepTrash()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := u.Status("Trash", []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(store.trashStop)
+	<-store.trashDone
+}
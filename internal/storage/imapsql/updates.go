@@ -0,0 +1,52 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"github.com/emersion/go-imap"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// coalesceUpdate appends the update to the list of pending updates.
+//
+// If both the update and the last pending update are new message
+// notifications for the same mailbox, they are merged into one. Only the
+// last update is considered so the relative order of updates is preserved.
+func coalesceUpdate(pending []mess.Update, upd mess.Update) []mess.Update {
+	if len(pending) == 0 || upd.Type != mess.UpdNewMessage {
+		return append(pending, upd)
+	}
+
+	last := &pending[len(pending)-1]
+	if last.Type != mess.UpdNewMessage || last.Key != upd.Key {
+		return append(pending, upd)
+	}
+
+	lastSet, err := imap.ParseSeqSet(last.SeqSet)
+	if err != nil {
+		return append(pending, upd)
+	}
+	updSet, err := imap.ParseSeqSet(upd.SeqSet)
+	if err != nil {
+		return append(pending, upd)
+	}
+	lastSet.AddSet(updSet)
+	last.SeqSet = lastSet.String()
+	return pending
+}
@@ -0,0 +1,50 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"reflect"
+	"testing"
+
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+func TestCoalesceUpdate(t *testing.T) {
+	var pending []mess.Update
+	for _, upd := range []mess.Update{
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "1"},
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "2"},
+		{Type: mess.UpdNewMessage, Key: uint64(2), SeqSet: "5"},
+		{Type: mess.UpdNewMessage, Key: uint64(2), SeqSet: "7"},
+		{Type: mess.UpdRemoved, Key: uint64(1), SeqSet: "1"},
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "3"},
+	} {
+		pending = coalesceUpdate(pending, upd)
+	}
+
+	expected := []mess.Update{
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "1:2"},
+		{Type: mess.UpdNewMessage, Key: uint64(2), SeqSet: "5,7"},
+		{Type: mess.UpdRemoved, Key: uint64(1), SeqSet: "1"},
+		{Type: mess.UpdNewMessage, Key: uint64(1), SeqSet: "3"},
+	}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("wrong result\nwant: %+v\ngot:  %+v", expected, pending)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// UsageSink receives per-account delivery statistics if usage_tracking is
+// enabled.
+//
+// RecordUsage is called after the message is committed to the storage once
+// for each recipient account. Errors are logged and do not affect the
+// delivery.
+type UsageSink interface {
+	RecordUsage(ctx context.Context, account string, messages int, bytes int64) error
+}
+
+// sqlUsageSink is the default UsageSink that keeps counters in the
+// maddy_usage table of the storage database.
+type sqlUsageSink struct {
+	db     *sql.DB
+	driver string
+}
+
+func newSQLUsageSink(db *sql.DB, driver string) (*sqlUsageSink, error) {
+	s := &sqlUsageSink{db: db, driver: driver}
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_usage (
+			account VARCHAR(255) NOT NULL PRIMARY KEY,
+			messages BIGINT NOT NULL DEFAULT 0,
+			bytes BIGINT NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("create table maddy_usage: %w", err)
+	}
+	return s, nil
+}
+
+func (s *sqlUsageSink) query(q string) string {
+	return rebindQuery(s.driver, q)
+}
+
+// rebindQuery replaces ? placeholders with the driver-specific ones.
+func rebindQuery(driver, q string) string {
+	if driver != "postgres" {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlUsageSink) RecordUsage(ctx context.Context, account string, messages int, bytes int64) error {
+	update := s.query(`UPDATE maddy_usage SET messages = messages + ?, bytes = bytes + ? WHERE account = ?`)
+
+	// Insert may fail if the row was created concurrently, in this case
+	// the update is retried.
+	for i := 0; i < 2; i++ {
+		res, err := s.db.ExecContext(ctx, update, messages, bytes, account)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 0 {
+			return nil
+		}
+
+		_, err = s.db.ExecContext(ctx, s.query(`INSERT INTO maddy_usage (account, messages, bytes) VALUES (?, ?, ?)`),
+			account, messages, bytes)
+		if err == nil {
+			return nil
+		}
+		if i == 1 {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetUsageSink replaces the sink used for usage tracking. It is effective
+// only if usage_tracking is enabled and should be called before the storage
+// is used for deliveries.
+func (store *Storage) SetUsageSink(sink UsageSink) {
+	store.usageSink = sink
+}
@@ -843,6 +843,8 @@ func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
 	metaCopy := *meta
 	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
 	metaCopy.MsgMeta.Conn = nil
+	// authres.Result is an interface and can't be deserialized.
+	metaCopy.MsgMeta.AuthResults = nil
 
 	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
 		return err
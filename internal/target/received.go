@@ -31,7 +31,7 @@ import (
 )
 
 func SanitizeForHeader(raw string) string {
-	return strings.ReplaceAll(raw, "\n", "")
+	return strings.NewReplacer("\r", "", "\n", "").Replace(raw)
 }
 
 func GenerateReceived(ctx context.Context, msgMeta *module.MsgMetadata, ourHostname, mailFrom string) (string, error) {
@@ -0,0 +1,38 @@
+//go:build !otel
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Init is no-op if maddy is built without the otel tag.
+func Init(context.Context) (func(context.Context) error, error) {
+	return func(context.Context) error { return nil }, nil
+}
+
+func startSpan(ctx context.Context, _ *module.MsgMetadata, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func inject(context.Context, *module.MsgMetadata) {}
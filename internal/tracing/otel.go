@@ -0,0 +1,112 @@
+//go:build otel
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/foxcpp/maddy"
+
+var propagator = propagation.TraceContext{}
+
+// Init configures the OTLP/HTTP exporter if OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The returned function flushes
+// pending spans and should be called on shutdown.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("maddy"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, msgMeta *module.MsgMetadata, name string) (context.Context, Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() && msgMeta != nil && len(msgMeta.TraceContext) != 0 {
+		ctx = propagator.Extract(ctx, propagation.MapCarrier(msgMeta.TraceContext))
+	}
+
+	var opts []trace.SpanStartOption
+	if msgMeta != nil && msgMeta.ID != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("maddy.msg_id", msgMeta.ID)))
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, opts...)
+	return ctx, otelSpan{span}
+}
+
+func inject(ctx context.Context, msgMeta *module.MsgMetadata) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	msgMeta.TraceContext = carrier
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttr(key string, value interface{}) {
+	switch value := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, value))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, value))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, value))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, value))
+	}
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	} else {
+		s.span.SetStatus(codes.Ok, "")
+	}
+	s.span.End()
+}
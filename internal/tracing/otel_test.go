@@ -0,0 +1,52 @@
+//go:build otel
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInject(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+
+	msgMeta := &module.MsgMetadata{ID: "test"}
+	ctx, span := StartSpan(context.Background(), msgMeta, "smtp.Message")
+	Inject(ctx, msgMeta)
+	span.End(nil)
+	if msgMeta.TraceContext["traceparent"] == "" {
+		t.Fatalf("traceparent is not set: %v", msgMeta.TraceContext)
+	}
+
+	// Same as queue delivery: no span in the context.
+	childCtx, child := StartSpan(context.Background(), msgMeta, "imapsql.Body")
+	child.End(nil)
+	if trace.SpanContextFromContext(childCtx).TraceID() != trace.SpanContextFromContext(ctx).TraceID() {
+		t.Error("trace is not continued using TraceContext")
+	}
+}
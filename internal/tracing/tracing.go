@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tracing implements optional OpenTelemetry instrumentation.
+//
+// Spans are recorded only if maddy is built with the otel tag and the
+// exporter is configured using standard OTEL_EXPORTER_OTLP_* environment
+// variables. Otherwise all functions are no-op.
+package tracing
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Span is the traced operation.
+type Span interface {
+	// SetAttr records the attribute of the operation. Supported value
+	// types are string, bool, int and int64.
+	SetAttr(key string, value interface{})
+
+	// End completes the span. If err is not nil, the operation is marked
+	// as failed.
+	End(err error)
+}
+
+// StartSpan starts the span for the operation on the message.
+//
+// The parent span is taken from ctx. If there is none, the trace context
+// carried in msgMeta.TraceContext is used, if any.
+func StartSpan(ctx context.Context, msgMeta *module.MsgMetadata, name string) (context.Context, Span) {
+	return startSpan(ctx, msgMeta, name)
+}
+
+// Inject stores the trace context of the span in ctx into
+// msgMeta.TraceContext so the trace can be continued once the message
+// leaves the current context, e.g. when it is delivered from the queue.
+func Inject(ctx context.Context, msgMeta *module.MsgMetadata) {
+	inject(ctx, msgMeta)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttr(string, interface{}) {}
+
+func (noopSpan) End(error) {}
@@ -0,0 +1,50 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestStartSpan(t *testing.T) {
+	shutdown, err := Init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	for _, msgMeta := range []*module.MsgMetadata{
+		nil,
+		{ID: "test"},
+		{ID: "test", TraceContext: map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		}},
+	} {
+		ctx, span := StartSpan(context.Background(), msgMeta, "test")
+		if ctx == nil {
+			t.Fatal("nil context returned")
+		}
+		span.SetAttr("maddy.rcpt_count", 1)
+		span.End(errors.New("test"))
+	}
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package maddy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -40,6 +41,7 @@ import (
 	"github.com/foxcpp/maddy/framework/resource/netresource"
 	"github.com/foxcpp/maddy/internal/authz"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/tracing"
 	"github.com/urfave/cli/v2"
 
 	// Import packages for side-effect of module registration.
@@ -221,6 +223,17 @@ func Run(c *cli.Context) error {
 		}
 	}()
 
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.DefaultLogger.Error("failed to initialize tracing", err)
+	} else {
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				log.DefaultLogger.Error("failed to flush traces", err)
+			}
+		}()
+	}
+
 	if err := moduleMain(c.Path("config")); err != nil {
 		systemdStatusErr(err)
 		return cli.Exit(err.Error(), 1)
@@ -465,6 +478,11 @@ func moduleReload(oldContainer *container.C, configPath string, asyncStopWg *syn
 	rollbackReload := func() {
 		// Restore DefaultLogger config that might be set by moduleConfig
 		log.DefaultLogger.Out = oldContainer.DefaultLogger.Out
+		// Old server keeps running, make it at least reread secondary files
+		// (keys, certificates) that might have been changed.
+		if err := oldContainer.Lifetime.ReloadAll(); err != nil {
+			oldContainer.DefaultLogger.Error("failed to reload old server", err)
+		}
 	}
 
 	oldContainer.DefaultLogger.Msg("loading new configuration...")
@@ -481,6 +499,9 @@ func moduleReload(oldContainer *container.C, configPath string, asyncStopWg *syn
 		// Restore DefaultLogger config that might be set by moduleConfig
 		log.DefaultLogger.Out = oldContainer.DefaultLogger.Out
 		container.Global = oldContainer
+		if err := oldContainer.Lifetime.ReloadAll(); err != nil {
+			oldContainer.DefaultLogger.Error("failed to reload old server", err)
+		}
 	}
 
 	if err := oldContainer.Lifetime.EarlyStopAll(); err != nil {